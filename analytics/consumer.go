@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
@@ -11,6 +15,7 @@ import (
 
 	"github.com/segmentio/kafka-go"
 	_ "github.com/lib/pq"
+	migrate "github.com/yourusername/4-in-a-row-migrate"
 )
 
 type GameEvent struct {
@@ -22,6 +27,7 @@ type GameEvent struct {
 	Player2IsBot bool         `json:"player2IsBot"`
 	Move         *MoveData    `json:"move,omitempty"`
 	Result       *GameResult  `json:"result,omitempty"`
+	Deletion     *PlayerDeletion `json:"deletion,omitempty"`
 }
 
 type MoveData struct {
@@ -36,11 +42,27 @@ type GameResult struct {
 	DurationSecs int `json:"durationSecs"`
 }
 
+type PlayerDeletion struct {
+	Username    string `json:"username"`
+	AnonymousID string `json:"anonymousId"`
+}
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const (
+	eventMaxAttempts = 5
+	retryDelay       = time.Second // doubled after every failed attempt
+	maxRetryDelay    = time.Minute
+)
+
 type Analytics struct {
 	db *sql.DB
 }
 
-func NewAnalytics(connStr string) (*Analytics, error) {
+// NewAnalytics connects to Postgres and, with migrate set, brings the schema
+// up to date first.
+func NewAnalytics(connStr string, migrate bool) (*Analytics, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -51,46 +73,39 @@ func NewAnalytics(connStr string) (*Analytics, error) {
 	}
 
 	analytics := &Analytics{db: db}
-	if err := analytics.createTables(); err != nil {
-		return nil, err
+	if migrate {
+		migrator, err := analytics.Migrator()
+		if err != nil {
+			return nil, err
+		}
+		applied, err := migrator.Up(0)
+		if err != nil {
+			return nil, err
+		}
+		if applied > 0 {
+			log.Printf("Applied %d database migration(s)", applied)
+		}
 	}
 
 	return analytics, nil
 }
 
-func (a *Analytics) createTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS analytics_events (
-			id SERIAL PRIMARY KEY,
-			event_type VARCHAR(50),
-			game_id VARCHAR(255),
-			timestamp TIMESTAMP,
-			player1 VARCHAR(255),
-			player2 VARCHAR(255),
-			player2_is_bot BOOLEAN,
-			data JSONB
-		)`,
-		`CREATE TABLE IF NOT EXISTS analytics_metrics (
-			id SERIAL PRIMARY KEY,
-			metric_name VARCHAR(100),
-			metric_value NUMERIC,
-			calculated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_events_type ON analytics_events(event_type)`,
-		`CREATE INDEX IF NOT EXISTS idx_events_timestamp ON analytics_events(timestamp)`,
-		`CREATE INDEX IF NOT EXISTS idx_events_game ON analytics_events(game_id)`,
-	}
-
-	for _, query := range queries {
-		if _, err := a.db.Exec(query); err != nil {
-			return err
+// ProcessEvent stores event, or applies it if it is a deletion.
+func (a *Analytics) ProcessEvent(event GameEvent) error {
+	// Deletions are applied, never stored: they name the deleted player
+	if event.EventType == "player_deleted" {
+		if event.Deletion == nil {
+			return nil
 		}
+		return a.anonymizePlayer(*event.Deletion, event.Timestamp)
 	}
 
-	return nil
-}
+	// Events are keyed by game, so a player's last ones may arrive after
+	// their deletion
+	if err := a.anonymizeEvent(&event); err != nil {
+		return err
+	}
 
-func (a *Analytics) ProcessEvent(event GameEvent) {
 	// Store raw event
 	data, _ := json.Marshal(event)
 	
@@ -100,8 +115,7 @@ func (a *Analytics) ProcessEvent(event GameEvent) {
 	`, event.EventType, event.GameID, event.Timestamp, event.Player1, event.Player2, event.Player2IsBot, data)
 	
 	if err != nil {
-		log.Printf("Error storing event: %v", err)
-		return
+		return err
 	}
 
 	// Process specific event types
@@ -119,6 +133,102 @@ func (a *Analytics) ProcessEvent(event GameEvent) {
 			a.updateMetrics()
 		}
 	}
+	return nil
+}
+
+// processRetried processes event, retrying with backoff while it fails.
+// Deletions are retried until they succeed; other events are dropped after
+// eventMaxAttempts. It reports false if ctx is cancelled first.
+func (a *Analytics) processRetried(ctx context.Context, event GameEvent) bool {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := a.ProcessEvent(event)
+		if err == nil {
+			return true
+		}
+		if event.EventType != "player_deleted" && attempt == eventMaxAttempts {
+			log.Printf("Error storing %s event of game %s, dropping it: %v", event.EventType, event.GameID, err)
+			return true
+		}
+		log.Printf("Error processing %s event, retrying in %s: %v", event.EventType, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if delay < maxRetryDelay {
+			delay *= 2
+		}
+	}
+}
+
+// usernameHash is how deleted_players refers to a deleted username.
+func usernameHash(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:])
+}
+
+// anonymizePlayer replaces a deleted player's username with their anonymous
+// ID in every event from before deletedAt, so the events still count towards
+// the metrics, and remembers the deletion for events still on their way.
+func (a *Analytics) anonymizePlayer(d PlayerDeletion, deletedAt time.Time) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO deleted_players (username_hash, anonymous_id, deleted_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username_hash) DO UPDATE SET anonymous_id = EXCLUDED.anonymous_id, deleted_at = EXCLUDED.deleted_at
+	`, usernameHash(d.Username), d.AnonymousID, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	updated := int64(0)
+	for _, column := range []string{"player1", "player2"} {
+		res, err := tx.Exec(`
+			UPDATE analytics_events
+			SET `+column+` = $2, data = jsonb_set(data, '{`+column+`}', to_jsonb($2::text))
+			WHERE `+column+` = $1 AND timestamp <= $3
+		`, d.Username, d.AnonymousID, deletedAt)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		updated += n
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Anonymized %d events of a deleted player as %s", updated, d.AnonymousID)
+	return nil
+}
+
+// anonymizeEvent replaces the usernames of players deleted after event
+// happened with their anonymous IDs. Events from after a deletion belong to
+// whoever registered the name again.
+func (a *Analytics) anonymizeEvent(event *GameEvent) error {
+	for _, name := range []*string{&event.Player1, &event.Player2} {
+		if *name == "" {
+			continue
+		}
+		var anonymousID string
+		err := a.db.QueryRow(`
+			SELECT anonymous_id FROM deleted_players WHERE username_hash = $1 AND deleted_at >= $2
+		`, usernameHash(*name), event.Timestamp).Scan(&anonymousID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		*name = anonymousID
+	}
+	return nil
 }
 
 func (a *Analytics) updateMetrics() {
@@ -167,6 +277,15 @@ func (a *Analytics) updateMetrics() {
 	`, gamesToday)
 }
 
+// Migrator returns the runner for the migrations embedded in the binary.
+func (a *Analytics) Migrator() (*migrate.Migrator, error) {
+	files, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(a.db, files, true)
+}
+
 func (a *Analytics) Close() error {
 	return a.db.Close()
 }
@@ -187,7 +306,14 @@ func main() {
 	connStr := "host=" + dbHost + " port=" + dbPort + " user=" + dbUser + 
 		" password=" + dbPassword + " dbname=" + dbName + " sslmode=disable"
 	
-	analytics, err := NewAnalytics(connStr)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(connStr, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	
+	analytics, err := NewAnalytics(connStr, getEnv("AUTO_MIGRATE", "true") == "true")
 	if err != nil {
 		log.Fatal("Failed to initialize analytics:", err)
 	}
@@ -226,7 +352,7 @@ func main() {
 		case <-ctx.Done():
 			return
 		default:
-			msg, err := reader.ReadMessage(ctx)
+			msg, err := reader.FetchMessage(ctx)
 			if err != nil {
 				if ctx.Err() != nil {
 					return
@@ -235,17 +361,41 @@ func main() {
 				continue
 			}
 
+			// The offset is only committed once the event has been
+			// processed, so that a deletion is never lost to a database
+			// error or a restart
 			var event GameEvent
 			if err := json.Unmarshal(msg.Value, &event); err != nil {
 				log.Printf("Error unmarshaling event: %v", err)
-				continue
+			} else if !analytics.processRetried(ctx, event) {
+				return
 			}
 
-			analytics.ProcessEvent(event)
+			if err := reader.CommitMessages(ctx, msg); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Error committing offset: %v", err)
+			}
 		}
 	}
 }
 
+// runMigrate runs the migrate subcommand against the database.
+func runMigrate(connStr string, args []string) error {
+	analytics, err := NewAnalytics(connStr, false)
+	if err != nil {
+		return err
+	}
+	defer analytics.Close()
+
+	migrator, err := analytics.Migrator()
+	if err != nil {
+		return err
+	}
+	return migrate.RunCommand(migrator, args)
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -5,4 +5,13 @@ go 1.21
 require (
 	github.com/lib/pq v1.10.9
 	github.com/segmentio/kafka-go v0.4.47
+	github.com/yourusername/4-in-a-row-migrate v0.0.0
 )
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+)
+
+// The migration runner shared by both services
+replace github.com/yourusername/4-in-a-row-migrate => ../migrate
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS analytics_metrics;
+DROP TABLE IF EXISTS analytics_events;
@@ -0,0 +1,23 @@
+-- Schema as it was before versioned migrations. Every statement is
+-- idempotent so that databases created by earlier releases adopt it as is.
+
+CREATE TABLE IF NOT EXISTS analytics_events (
+	id SERIAL PRIMARY KEY,
+	event_type VARCHAR(50),
+	game_id VARCHAR(255),
+	timestamp TIMESTAMP,
+	player1 VARCHAR(255),
+	player2 VARCHAR(255),
+	player2_is_bot BOOLEAN,
+	data JSONB
+);
+
+CREATE TABLE IF NOT EXISTS analytics_metrics (
+	id SERIAL PRIMARY KEY,
+	metric_name VARCHAR(100),
+	metric_value NUMERIC,
+	calculated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_events_type ON analytics_events(event_type);
+CREATE INDEX IF NOT EXISTS idx_events_timestamp ON analytics_events(timestamp);
+CREATE INDEX IF NOT EXISTS idx_events_game ON analytics_events(game_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_events_player2;
+DROP INDEX IF EXISTS idx_events_player1;
@@ -0,0 +1,4 @@
+-- Looking up a player's events, e.g. to anonymize a deleted account
+
+CREATE INDEX IF NOT EXISTS idx_events_player1 ON analytics_events(player1);
+CREATE INDEX IF NOT EXISTS idx_events_player2 ON analytics_events(player2);
@@ -0,0 +1,8 @@
+-- Players deleted from the backend, so that their events arriving after the
+-- deletion are anonymized too. Only a hash of the username is kept.
+
+CREATE TABLE IF NOT EXISTS deleted_players (
+	username_hash CHAR(64) PRIMARY KEY,
+	anonymous_id VARCHAR(255) NOT NULL,
+	deleted_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Deleted players are renamed into their own namespace, which registration
+// refuses.
+const deletedPrefix = "deleted-"
+
+// erasureRetryInterval is how often deletions analytics could not be told
+// about are sent again.
+const erasureRetryInterval = time.Minute
+
+var (
+	ErrRevokedToken   = errors.New("session token revoked")
+	errPlayerBusy     = errors.New("player is in a game or waiting for one")
+	errPlayerBanned   = errors.New("player is banned")
+	errErasurePending = errors.New("account deleted, analytics will be anonymized once the event bus is reachable")
+)
+
+// Account is a registered username.
+type Account struct {
+	Username    string    `json:"username"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ClaimedFrom string    `json:"claimedFrom,omitempty"` // guest ID the account was upgraded from
+}
+
+// SeasonStanding is a player's place in one season's final standings.
+type SeasonStanding struct {
+	SeasonID int `json:"seasonId"`
+	LeaderboardEntry
+}
+
+// PlayerData is everything stored about one player, as handed out by the
+// data export.
+type PlayerData struct {
+	Username        string           `json:"username"`
+	ExportedAt      time.Time        `json:"exportedAt"`
+	Account         *Account         `json:"account"` // nil for guests
+	Stats           *PlayerStats     `json:"stats"`   // nil before their first finished game
+	RatingHistory   []RatingPoint    `json:"ratingHistory"`
+	SeasonStandings []SeasonStanding `json:"seasonStandings"`
+	Games           []GameRecord     `json:"games"` // oldest first, with their moves
+	Chat            []ChatMessage    `json:"chat"`
+	Ban             *Ban             `json:"ban,omitempty"`
+}
+
+func newAnonymousID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return deletedPrefix + hex.EncodeToString(b), nil
+}
+
+// sessionRevoked reports whether claims belong to a guest that has been
+// deleted or claimed as an account, or to an account that has been deleted
+// since the token was issued, including one whose name has been registered
+// again by someone else.
+func sessionRevoked(claims *SessionClaims) (bool, error) {
+	if claims.Guest {
+		return gameServer.store.GuestRevoked(claims.Username)
+	}
+	account, err := gameServer.store.GetAccount(claims.Username)
+	if errors.Is(err, ErrAccountNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return account.CreatedAt.Unix() > claims.IssuedAt, nil
+}
+
+// ExportPlayer collects everything stored about username.
+func (gs *GameServer) ExportPlayer(username string) (*PlayerData, error) {
+	// Include writes still on their way to the store when possible
+	if err := gs.persist.Flush(); err != nil {
+		log.Printf("Exporting player data without pending writes: %v", err)
+	}
+
+	data, err := gs.store.ExportPlayerData(username)
+	if err != nil {
+		return nil, err
+	}
+	data.ExportedAt = time.Now()
+	return data, nil
+}
+
+// DeletePlayer erases username: their account and chat messages are
+// deleted and everything else is moved to a random anonymous ID, so that
+// their games keep counting in their opponents' stats and the leaderboards.
+// Analytics is told to do the same with its events; if it cannot be told
+// right away, errErasurePending is returned and it is told later. A banned
+// player is not deleted until the ban ends, so that the name cannot be
+// registered again to shake it off. It reports whether anything was stored
+// about them.
+func (gs *GameServer) DeletePlayer(username string) (bool, error) {
+	if gs.isBusy(username) {
+		return false, errPlayerBusy
+	}
+	ban, err := gs.BanFor(username)
+	if err != nil {
+		return false, err
+	}
+	if ban != nil {
+		return false, errPlayerBanned
+	}
+	// A game result still queued would bring the username back
+	if err := gs.persist.Flush(); err != nil {
+		return false, err
+	}
+
+	anonymousID, err := newAnonymousID()
+	if err != nil {
+		return false, err
+	}
+	deletedAt := time.Now()
+	// Without Kafka there is no analytics service holding events
+	notify := gs.kafka != nil
+	found, err := gs.store.DeletePlayerData(username, anonymousID, notify)
+	if err != nil {
+		return false, err
+	}
+	gs.kickUser(username, "Your account has been deleted")
+	if !found {
+		return false, nil
+	}
+	log.Printf("Deleted a player's data, their games now belong to %s", anonymousID)
+
+	if notify {
+		if err := gs.sendErasure(PlayerDeletion{Username: username, AnonymousID: anonymousID, DeletedAt: deletedAt}); err != nil {
+			log.Printf("Error telling analytics about deleted player %s, will retry: %v", anonymousID, err)
+			return true, errErasurePending
+		}
+	}
+	return true, nil
+}
+
+// sendErasure tells analytics about a deletion and, once the event has been
+// stored by Kafka, forgets it. Analytics only commits the event once it has
+// anonymized the player. The player's own events are keyed by game and may
+// reach it later from other partitions; it anonymizes those of them that
+// happened before the event's timestamp as they arrive.
+func (gs *GameServer) sendErasure(d PlayerDeletion) error {
+	err := gs.kafka.SendEventAcked(GameEvent{
+		EventType: "player_deleted",
+		Timestamp: d.DeletedAt,
+		Deletion:  &d,
+	})
+	if err != nil {
+		return err
+	}
+	return gs.store.DeletePendingErasure(d.AnonymousID)
+}
+
+// erasureLoop sends the deletions analytics could not be told about when
+// they happened.
+func (gs *GameServer) erasureLoop() {
+	if gs.kafka == nil {
+		return
+	}
+
+	ticker := time.NewTicker(erasureRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		erasures, err := gs.store.PendingErasures()
+		if err != nil {
+			log.Printf("Error loading pending erasures: %v", err)
+			continue
+		}
+		for _, d := range erasures {
+			if err := gs.sendErasure(d); err != nil {
+				log.Printf("Error telling analytics about deleted player %s: %v", d.AnonymousID, err)
+				break
+			}
+			log.Printf("Told analytics about deleted player %s", d.AnonymousID)
+		}
+	}
+}
+
+// writePlayerData sends data as a JSON file download.
+func writePlayerData(w http.ResponseWriter, data *PlayerData) {
+	filename := "fourinarow-" + data.Username + "-" + data.ExportedAt.Format("20060102") + ".json"
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	writeJSON(w, http.StatusOK, data)
+}
+
+// authenticateAccount returns the claims of the request's session, or
+// answers it with an error and returns nil.
+func authenticateAccount(w http.ResponseWriter, r *http.Request) *SessionClaims {
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	revoked, err := sessionRevoked(claims)
+	if err != nil {
+		log.Printf("Error checking session of %s: %v", claims.Username, err)
+		http.Error(w, "Could not check session", http.StatusInternalServerError)
+		return nil
+	}
+	if revoked {
+		http.Error(w, ErrRevokedToken.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	ban, err := gameServer.BanFor(claims.Username)
+	if err != nil {
+		log.Printf("Error checking ban for %s: %v", claims.Username, err)
+		http.Error(w, "Could not check session", http.StatusInternalServerError)
+		return nil
+	}
+	if ban != nil {
+		http.Error(w, "Banned: "+ban.Reason, http.StatusForbidden)
+		return nil
+	}
+	return claims
+}
+
+// handleAccountExport sends the calling player everything stored about them.
+func handleAccountExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authenticateAccount(w, r)
+	if claims == nil {
+		return
+	}
+
+	data, err := gameServer.ExportPlayer(claims.Username)
+	if err != nil {
+		log.Printf("Error exporting data of %s: %v", claims.Username, err)
+		http.Error(w, "Could not export data", http.StatusInternalServerError)
+		return
+	}
+	writePlayerData(w, data)
+}
+
+// handleAccount deletes the calling player's account. Registered players
+// confirm with their password: {"password": ""}.
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authenticateAccount(w, r)
+	if claims == nil {
+		return
+	}
+
+	if !claims.Guest {
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		hash, err := gameServer.store.GetPasswordHash(claims.Username)
+		if err != nil {
+			log.Printf("Error loading account %s: %v", claims.Username, err)
+			http.Error(w, "Could not delete account", http.StatusInternalServerError)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+			http.Error(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if _, err := gameServer.DeletePlayer(claims.Username); err != nil {
+		writeDeleteError(w, claims.Username, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDeleteError answers a deletion that failed, or that is still waiting
+// to reach analytics.
+func writeDeleteError(w http.ResponseWriter, username string, err error) {
+	switch {
+	case errors.Is(err, errErasurePending):
+		writeJSON(w, http.StatusAccepted, map[string]string{"message": err.Error()})
+	case errors.Is(err, errPlayerBusy):
+		http.Error(w, "Finish the current game before deleting the account", http.StatusConflict)
+	case errors.Is(err, errPlayerBanned):
+		http.Error(w, "Banned players cannot be deleted until the ban ends", http.StatusConflict)
+	case errors.Is(err, errPersistBacklog):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Error deleting data of %s: %v", username, err)
+		http.Error(w, "Could not delete account", http.StatusInternalServerError)
+	}
+}
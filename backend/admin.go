@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Results an admin can end a game with
+const (
+	AdminResultDraw    = "draw"
+	AdminResultPlayer1 = "player1" // player 1 wins
+	AdminResultPlayer2 = "player2" // player 2 wins
+	AdminResultAbort   = "abort"   // discard the game without a result
+)
+
+var errGameNotLive = errors.New("game is not live on this instance")
+
+// Ban keeps a username from connecting until ExpiresAt, or for good when
+// ExpiresAt is nil.
+type Ban struct {
+	Username  string     `json:"username"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+func (b Ban) activeAt(now time.Time) bool {
+	return b.ExpiresAt == nil || now.Before(*b.ExpiresAt)
+}
+
+// AdminGameSummary is a live game as listed by the admin API.
+type AdminGameSummary struct {
+	GameID           string       `json:"gameId"`
+	Player1          string       `json:"player1"`
+	Player2          string       `json:"player2"`
+	Player2IsBot     bool         `json:"player2IsBot"`
+	Player1Connected bool         `json:"player1Connected"`
+	Player2Connected bool         `json:"player2Connected"`
+	Status           string       `json:"status"`
+	Options          MatchOptions `json:"options"`
+	MoveCount        int          `json:"moveCount"`
+	CurrentTurn      int          `json:"currentTurn"`
+	Spectators       int          `json:"spectators"`
+	StartedAt        time.Time    `json:"startedAt"`
+	DurationSecs     int          `json:"durationSecs"`
+}
+
+// AdminGameDetail adds the board and move list to a summary.
+type AdminGameDetail struct {
+	AdminGameSummary
+	GameState GameState `json:"gameState"`
+	Moves     []int     `json:"moves"`
+}
+
+func adminSummary(game *Game, now time.Time) AdminGameSummary {
+	return AdminGameSummary{
+		GameID:           game.ID,
+		Player1:          game.Player1.Username,
+		Player2:          game.Player2.Username,
+		Player2IsBot:     game.Player2.IsBot,
+		Player1Connected: game.Player1.Connected,
+		Player2Connected: game.Player2.Connected,
+		Status:           game.Status,
+		Options:          game.Options,
+		MoveCount:        game.MoveCount,
+		CurrentTurn:      game.CurrentTurn,
+		Spectators:       len(game.Spectators),
+		StartedAt:        game.StartTime,
+		DurationSecs:     int(now.Sub(game.StartTime).Seconds()),
+	}
+}
+
+// LiveGames lists the games being played on this instance, oldest first.
+func (gs *GameServer) LiveGames() []AdminGameSummary {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	now := time.Now()
+	games := make([]AdminGameSummary, 0, len(gs.games))
+	for _, game := range gs.games {
+		if game.Status == "playing" {
+			games = append(games, adminSummary(game, now))
+		}
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].StartedAt.Before(games[j].StartedAt)
+	})
+	return games
+}
+
+// LiveGame returns the board and moves of a game on this instance.
+func (gs *GameServer) LiveGame(gameID string) (*AdminGameDetail, error) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	game := gs.games[gameID]
+	if game == nil {
+		return nil, errGameNotLive
+	}
+	return &AdminGameDetail{
+		AdminGameSummary: adminSummary(game, time.Now()),
+		GameState:        gs.getGameState(game),
+		Moves:            append([]int{}, game.Moves...),
+	}, nil
+}
+
+// EndGame stops a live game with the given result, telling its players and
+// spectators why.
+func (gs *GameServer) EndGame(gameID, result, reason string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	game := gs.games[gameID]
+	if game == nil || game.Status != "playing" {
+		return errGameNotLive
+	}
+
+	switch result {
+	case AdminResultDraw:
+		game.Winner = 0
+	case AdminResultPlayer1:
+		game.Winner = Player1
+	case AdminResultPlayer2:
+		game.Winner = Player2
+	case AdminResultAbort:
+		gs.sendToParticipants(game, Message{
+			Type: "game_aborted",
+			Data: GameAbortedPayload{GameID: game.ID, Reason: reason},
+		})
+		gs.abortGame(game)
+		log.Printf("Admin aborted game %s: %s", game.ID, reason)
+		return nil
+	default:
+		return fmt.Errorf("unknown result %q (expected draw, player1, player2 or abort)", result)
+	}
+
+	if reason != "" {
+		gs.sendToParticipants(game, Message{
+			Type: "notice",
+			Data: NoticePayload{Message: reason, Timestamp: time.Now().Unix()},
+		})
+	}
+	game.Status = "finished"
+	game.EndTime = time.Now()
+	gs.broadcastGameState(game)
+	gs.handleGameEnd(game)
+	delete(gs.games, game.ID)
+	log.Printf("Admin ended game %s as %s: %s", game.ID, result, reason)
+	return nil
+}
+
+// KickUser closes every connection username has, on every instance, and
+// returns how many instances it reached. A player in a game keeps their seat
+// until the forfeit timeout, as after any disconnect.
+func (gs *GameServer) KickUser(username, reason string) (int, error) {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Admin kicked %s: %s", username, reason)
+	return gs.fanOut(ClusterMessage{Kind: clusterKickUser, Username: username, Data: data}, func() {
+		gs.kickUser(username, reason)
+	})
+}
+
+// kickUser closes the connections username has to this instance.
+func (gs *GameServer) kickUser(username, reason string) {
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	kicked := 0
+	for _, s := range gs.sessions {
+		if s.identity != username {
+			continue
+		}
+		s.client.Kick(Message{Type: "kicked", Data: KickedPayload{Reason: reason}})
+		kicked++
+	}
+	if kicked > 0 {
+		log.Printf("Kicked %s (%d connections)", username, kicked)
+	}
+}
+
+// BanUser stores ban and kicks the user off every instance.
+func (gs *GameServer) BanUser(ban Ban) error {
+	if err := gs.store.SaveBan(ban); err != nil {
+		return err
+	}
+
+	log.Printf("Admin banned %s: %s", ban.Username, ban.Reason)
+	if _, err := gs.KickUser(ban.Username, "You have been banned: "+ban.Reason); err != nil {
+		// The ban stands; it keeps them out when they reconnect
+		log.Printf("Error kicking banned %s: %v", ban.Username, err)
+	}
+	return nil
+}
+
+// UnbanUser lifts a ban, reporting whether there was one.
+func (gs *GameServer) UnbanUser(username string) (bool, error) {
+	return gs.store.DeleteBan(username)
+}
+
+// BanFor returns the ban in force on username, or nil.
+func (gs *GameServer) BanFor(username string) (*Ban, error) {
+	return gs.store.GetBan(username, time.Now())
+}
+
+// Bans lists the bans in force, newest first.
+func (gs *GameServer) Bans() ([]Ban, error) {
+	return gs.store.ListBans(time.Now())
+}
+
+// ClearQueue sends every waiting player away, on every instance, and returns
+// how many instances it reached.
+func (gs *GameServer) ClearQueue() (int, error) {
+	log.Printf("Admin cleared the matchmaking queue")
+	return gs.fanOut(ClusterMessage{Kind: clusterClearQueue}, gs.clearQueue)
+}
+
+// clearQueue sends the players waiting on this instance away.
+func (gs *GameServer) clearQueue() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	cleared := 0
+	for opts, queue := range gs.waitingPlayers {
+		for _, p := range queue {
+			gs.cluster.Dequeue(p.Username, p.Client.id)
+			sendError(p.Client, ErrCodeQueueCleared, "The matchmaking queue was cleared, please join again")
+			cleared++
+		}
+		delete(gs.waitingPlayers, opts)
+	}
+	log.Printf("Cleared the matchmaking queue (%d players)", cleared)
+}
+
+// Broadcast sends a notice to every connection, on every instance, and
+// returns how many instances it reached.
+func (gs *GameServer) Broadcast(text string) (int, error) {
+	notice := NoticePayload{Message: text, Timestamp: time.Now().Unix()}
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Admin broadcast: %s", text)
+	return gs.fanOut(ClusterMessage{Kind: clusterNotice, Data: data}, func() {
+		gs.broadcast(notice)
+	})
+}
+
+// broadcast sends notice to every connection on this instance.
+func (gs *GameServer) broadcast(notice NoticePayload) {
+	msg := Message{Type: "notice", Data: notice}
+
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	sent := 0
+	for _, s := range gs.sessions {
+		if s.client.Send(msg) == nil {
+			sent++
+		}
+	}
+	log.Printf("Sent notice to %d connections", sent)
+}
+
+// fanOut runs an admin action here and sends msg for the other instances to
+// run it too. It returns how many instances it reached, this one included;
+// the error is for the instances it could not list or reach.
+func (gs *GameServer) fanOut(msg ClusterMessage, local func()) (int, error) {
+	local()
+
+	instances, err := gs.cluster.Instances()
+	if err != nil {
+		return 1, fmt.Errorf("listing instances: %w", err)
+	}
+	self := gs.cluster.InstanceID()
+	reached := 1
+	var failed []string
+	for _, instance := range instances {
+		if instance == self {
+			continue
+		}
+		if gs.sendCluster(instance, msg) != nil {
+			failed = append(failed, instance)
+			continue
+		}
+		reached++
+	}
+	if len(failed) > 0 {
+		return reached, fmt.Errorf("could not reach %s", strings.Join(failed, ", "))
+	}
+	return reached, nil
+}
+
+// requireAdmin guards the admin API with the ADMIN_TOKEN bearer token. The
+// API is off when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := gameServer.config.AdminToken
+		if token == "" {
+			http.Error(w, "Admin API disabled", http.StatusNotFound)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdmin serves everything under /api/admin/:
+//
+//	GET    games                 live games on this instance
+//	GET    games/{id}            board and moves of one game
+//	POST   games/{id}/end        {"result": "draw|player1|player2|abort", "reason": ""}
+//	POST   players/{name}/kick   {"reason": ""}
+//	POST   players/{name}/ban    {"reason": "", "durationSecs": 0 for permanent}
+//	DELETE players/{name}/ban
+//	POST   players/{name}/mute   {"durationSecs": 600}
+//	GET    players/{name}/export everything stored about the player
+//	DELETE players/{name}        delete the player's account and anonymize their games
+//	GET    bans
+//	DELETE queue
+//	POST   broadcast             {"message": ""}
+//	POST   seasons               {"name": "", "startsAt": RFC 3339, "endsAt": RFC 3339}
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/"), "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) == 2 {
+		route += "/*"
+	} else if len(parts) == 3 {
+		route += "/*/" + parts[2]
+	}
+
+	switch route {
+	case "GET games":
+		writeJSON(w, http.StatusOK, gameServer.LiveGames())
+	case "GET games/*":
+		game, err := gameServer.LiveGame(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, game)
+	case "POST games/*/end":
+		var req struct {
+			Result string `json:"result"`
+			Reason string `json:"reason"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		err := gameServer.EndGame(parts[1], req.Result, req.Reason)
+		if errors.Is(err, errGameNotLive) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"gameId": parts[1], "result": req.Result})
+	case "POST players/*/kick":
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		reached, err := gameServer.KickUser(parts[1], req.Reason)
+		writeFanOut(w, reached, err)
+	case "POST players/*/ban":
+		var req struct {
+			Reason       string `json:"reason"`
+			DurationSecs int    `json:"durationSecs"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		if req.DurationSecs < 0 {
+			http.Error(w, "durationSecs must not be negative", http.StatusBadRequest)
+			return
+		}
+		ban := Ban{Username: parts[1], Reason: req.Reason, CreatedAt: time.Now()}
+		if req.DurationSecs > 0 {
+			expires := ban.CreatedAt.Add(time.Duration(req.DurationSecs) * time.Second)
+			ban.ExpiresAt = &expires
+		}
+		if err := gameServer.BanUser(ban); err != nil {
+			log.Printf("Error banning %s: %v", ban.Username, err)
+			http.Error(w, "Could not save ban", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, ban)
+	case "DELETE players/*/ban":
+		lifted, err := gameServer.UnbanUser(parts[1])
+		if err != nil {
+			log.Printf("Error unbanning %s: %v", parts[1], err)
+			http.Error(w, "Could not lift ban", http.StatusInternalServerError)
+			return
+		}
+		if !lifted {
+			http.Error(w, "Not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST players/*/mute":
+		var req struct {
+			DurationSecs int `json:"durationSecs"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		if req.DurationSecs <= 0 {
+			http.Error(w, "durationSecs must be positive", http.StatusBadRequest)
+			return
+		}
+		gameServer.MuteUser(parts[1], time.Duration(req.DurationSecs)*time.Second)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"username": parts[1], "mutedForSecs": req.DurationSecs})
+	case "GET players/*/export":
+		data, err := gameServer.ExportPlayer(parts[1])
+		if err != nil {
+			log.Printf("Error exporting data of %s: %v", parts[1], err)
+			http.Error(w, "Could not export data", http.StatusInternalServerError)
+			return
+		}
+		writePlayerData(w, data)
+	case "DELETE players/*":
+		found, err := gameServer.DeletePlayer(parts[1])
+		if err != nil {
+			writeDeleteError(w, parts[1], err)
+			return
+		}
+		if !found {
+			http.Error(w, "No data stored for this player", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST seasons":
+		var req struct {
+			Name     string    `json:"name"`
+			StartsAt time.Time `json:"startsAt"`
+			EndsAt   time.Time `json:"endsAt"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		if req.Name == "" || req.StartsAt.IsZero() || !req.EndsAt.After(req.StartsAt) {
+			http.Error(w, "name, startsAt and a later endsAt are required", http.StatusBadRequest)
+			return
+		}
+		season, err := gameServer.store.CreateSeason(req.Name, req.StartsAt, req.EndsAt)
+		if errors.Is(err, ErrSeasonOverlap) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating season %s: %v", req.Name, err)
+			http.Error(w, "Could not create season", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, season)
+	case "GET bans":
+		bans, err := gameServer.Bans()
+		if err != nil {
+			log.Printf("Error listing bans: %v", err)
+			http.Error(w, "Could not list bans", http.StatusInternalServerError)
+			return
+		}
+		if bans == nil {
+			bans = []Ban{}
+		}
+		writeJSON(w, http.StatusOK, bans)
+	case "DELETE queue":
+		reached, err := gameServer.ClearQueue()
+		writeFanOut(w, reached, err)
+	case "POST broadcast":
+		var req struct {
+			Message string `json:"message"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Message) == "" {
+			http.Error(w, "message is required", http.StatusBadRequest)
+			return
+		}
+		reached, err := gameServer.Broadcast(req.Message)
+		writeFanOut(w, reached, err)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// writeFanOut answers an admin action run on every instance with how many
+// it reached, or 502 when some could not be reached.
+func writeFanOut(w http.ResponseWriter, reached int, err error) {
+	if err != nil {
+		log.Printf("Admin action reached %d instances: %v", reached, err)
+		http.Error(w, fmt.Sprintf("Reached only %d instances: %v", reached, err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"instances": reached})
+}
+
+// decodeAdminRequest reads an optional JSON body into v, answering the
+// request itself when the body is invalid.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+var (
+	ErrInvalidToken       = errors.New("invalid session token")
+	ErrExpiredToken       = errors.New("session token expired")
+	ErrAccountExists      = errors.New("username already taken")
+	ErrAccountNotFound    = errors.New("account not found")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// dummyHash is compared against when a login names an unknown account, so
+// that response times don't reveal which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+var tokenSigner *TokenSigner
+
+// Purpose of tokens that are not session tokens. They are signed with the
+// same key, so Verify must never accept them as a session.
+const tokenPurposeGuestResume = "guest_resume"
+
+// SessionClaims identify the holder of a session token.
+type SessionClaims struct {
+	Username  string `json:"sub"`
+	Guest     bool   `json:"guest,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenSigner issues and verifies HMAC-SHA256 signed session tokens of the
+// form base64url(claims JSON) "." base64url(signature).
+type TokenSigner struct {
+	secret    []byte
+	ttl       time.Duration
+	resumeTTL time.Duration // lifetime of guest resume tokens
+}
+
+// NewTokenSigner uses secret to sign tokens. With an empty secret a random
+// one is generated, which means tokens do not survive a restart.
+func NewTokenSigner(secret string, ttl, resumeTTL time.Duration) *TokenSigner {
+	key := []byte(secret)
+	if len(key) == 0 {
+		log.Println("Warning: AUTH_SECRET not set, generating a random one; sessions will not survive restarts")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("Failed to generate auth secret:", err)
+		}
+	}
+	return &TokenSigner{secret: key, ttl: ttl, resumeTTL: resumeTTL}
+}
+
+// Sign issues a session token for username.
+func (ts *TokenSigner) Sign(username string, guest bool) (string, SessionClaims, error) {
+	return ts.issue(SessionClaims{Username: username, Guest: guest}, ts.ttl)
+}
+
+// SignGuestResume issues the long-lived token a guest keeps to get a new
+// session for the same guest ID later.
+func (ts *TokenSigner) SignGuestResume(guestID string) (string, error) {
+	token, _, err := ts.issue(SessionClaims{Username: guestID, Guest: true, Purpose: tokenPurposeGuestResume}, ts.resumeTTL)
+	return token, err
+}
+
+func (ts *TokenSigner) issue(claims SessionClaims, ttl time.Duration) (string, SessionClaims, error) {
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", SessionClaims{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + ts.signature(encoded), claims, nil
+}
+
+// Verify checks a session token.
+func (ts *TokenSigner) Verify(token string) (*SessionClaims, error) {
+	return ts.verify(token, "")
+}
+
+func (ts *TokenSigner) VerifyGuestResume(token string) (*SessionClaims, error) {
+	return ts.verify(token, tokenPurposeGuestResume)
+}
+
+func (ts *TokenSigner) verify(token, purpose string) (*SessionClaims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(ts.signature(encoded))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims SessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Username == "" || claims.Purpose != purpose {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+func (ts *TokenSigner) signature(encoded string) string {
+	mac := hmac.New(sha256.New, ts.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authenticateRequest returns the claims of the session token carried in the
+// Authorization header or, for WebSocket upgrades where browsers cannot set
+// headers, the "token" query parameter.
+func authenticateRequest(r *http.Request) (*SessionClaims, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	return tokenSigner.Verify(token)
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	Token       string `json:"token"`
+	Username    string `json:"username"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Guest       bool   `json:"guest,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"` // guests only
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateCredentials(creds); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Could not create account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := gameServer.store.CreateAccount(creds.Username, string(hash)); err != nil {
+		if errors.Is(err, ErrAccountExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating account %s: %v", creds.Username, err)
+		http.Error(w, "Could not create account", http.StatusInternalServerError)
+		return
+	}
+
+	writeSession(w, creds.Username, false, http.StatusCreated)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := gameServer.store.GetPasswordHash(creds.Username)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		log.Printf("Error loading account %s: %v", creds.Username, err)
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return
+	}
+
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(creds.Password))
+		http.Error(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Password)) != nil {
+		http.Error(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	writeSession(w, creds.Username, false, http.StatusOK)
+}
+
+func writeSession(w http.ResponseWriter, username string, guest bool, status int) {
+	token, claims, err := tokenSigner.Sign(username, guest)
+	if err != nil {
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
+
+	resp := sessionResponse{
+		Token:     token,
+		Username:  username,
+		ExpiresAt: claims.ExpiresAt,
+		Guest:     guest,
+	}
+	if guest {
+		if resp.ResumeToken, err = tokenSigner.SignGuestResume(username); err != nil {
+			http.Error(w, "Could not create session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validateCredentials checks a username and password for a new account and
+// returns a message for the client, or "" if they are acceptable.
+func validateCredentials(creds credentials) string {
+	if !isValidUsername(creds.Username) || isReservedUsername(creds.Username) {
+		return "Invalid username. Must be 1-50 alphanumeric or basic characters."
+	}
+	if len(creds.Password) < minPasswordLength || len(creds.Password) > maxPasswordLength {
+		return fmt.Sprintf("Password must be %d-%d characters", minPasswordLength, maxPasswordLength)
+	}
+	return ""
+}
+
+// isReservedUsername reports names that cannot be registered: the bot's
+// name and the guest and deleted player ID namespaces.
+func isReservedUsername(username string) bool {
+	lower := strings.ToLower(username)
+	return strings.EqualFold(username, "BOT") || strings.HasPrefix(lower, guestPrefix) || strings.HasPrefix(lower, deletedPrefix)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSignerSession(t *testing.T) {
+	ts := NewTokenSigner("secret", time.Hour, 24*time.Hour)
+	for _, guest := range []bool{false, true} {
+		token, issued, err := ts.Sign("alice", guest)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		claims, err := ts.Verify(token)
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		if *claims != issued || claims.Username != "alice" || claims.Guest != guest {
+			t.Fatalf("Verify = %+v, want %+v", *claims, issued)
+		}
+		if claims.ExpiresAt-claims.IssuedAt != int64(time.Hour/time.Second) {
+			t.Fatalf("token lasts %ds, want an hour", claims.ExpiresAt-claims.IssuedAt)
+		}
+	}
+}
+
+func TestTokenSignerPurposes(t *testing.T) {
+	ts := NewTokenSigner("secret", time.Hour, 24*time.Hour)
+	session, _, err := ts.Sign("guest-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume, err := ts.SignGuestResume("guest-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Verify(resume); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify(resume token) = %v, want ErrInvalidToken", err)
+	}
+	if _, err := ts.VerifyGuestResume(session); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("VerifyGuestResume(session token) = %v, want ErrInvalidToken", err)
+	}
+	claims, err := ts.VerifyGuestResume(resume)
+	if err != nil {
+		t.Fatalf("VerifyGuestResume: %v", err)
+	}
+	if claims.Username != "guest-1" || !claims.Guest || claims.ExpiresAt-claims.IssuedAt != int64(24*time.Hour/time.Second) {
+		t.Fatalf("VerifyGuestResume = %+v", *claims)
+	}
+}
+
+func TestTokenSignerExpiry(t *testing.T) {
+	expired := NewTokenSigner("secret", -time.Second, -time.Second)
+	session, _, err := expired.Sign("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume, err := expired.SignGuestResume("guest-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expiry is checked after the signature, with any signer for the key
+	ts := NewTokenSigner("secret", time.Hour, time.Hour)
+	if _, err := ts.Verify(session); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("Verify(expired session) = %v, want ErrExpiredToken", err)
+	}
+	if _, err := ts.VerifyGuestResume(resume); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("VerifyGuestResume(expired resume token) = %v, want ErrExpiredToken", err)
+	}
+}
+
+func TestTokenSignerRejectsForgedTokens(t *testing.T) {
+	ts := NewTokenSigner("secret", time.Hour, time.Hour)
+	token, _, err := ts.Sign("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := NewTokenSigner("other secret", time.Hour, time.Hour).Sign("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	// Same signature over claims naming someone else
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","iat":0,"exp":9999999999}`)) + "." + sig
+	// Validly signed, but naming no one
+	anonymous := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999}`))
+	anonymous += "." + ts.signature(anonymous)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", payload},
+		{"other key", otherKey},
+		{"changed claims", forged},
+		{"changed signature", payload + "." + strings.Repeat("A", len(sig))},
+		{"no username", anonymous},
+		{"not JSON", "bm90IGpzb24." + ts.signature("bm90IGpzb24")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ts.Verify(tt.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
@@ -1,18 +1,59 @@
 package main
 
 import (
+	"log"
 	"math"
 	"math/rand"
 	"time"
 )
 
 type Bot struct {
-	PlayerNum int
+	PlayerNum  int
+	Difficulty BotDifficulty
 }
 
-func NewBot(playerNum int) *Bot {
+// BotDifficulty controls how far ahead the bot searches and how often it
+// plays a random move instead of its best one. Rating is the bot's nominal
+// strength, used both to pick a level for a player and to rate the game.
+type BotDifficulty struct {
+	Name       string
+	Depth      int
+	Randomness float64
+	Rating     int
+}
+
+var (
+	BotEasy   = BotDifficulty{Name: "easy", Depth: 1, Randomness: 0.35, Rating: 1000}
+	BotMedium = BotDifficulty{Name: "medium", Depth: 3, Randomness: 0.1, Rating: 1300}
+	BotHard   = BotDifficulty{Name: "hard", Depth: 5, Randomness: 0, Rating: 1600}
+)
+
+// botDifficultyFor picks the level whose nominal rating is closest to the
+// player's.
+func botDifficultyFor(rating int) BotDifficulty {
+	best := BotEasy
+	for _, d := range []BotDifficulty{BotMedium, BotHard} {
+		if abs(d.Rating-rating) < abs(best.Rating-rating) {
+			best = d
+		}
+	}
+	return best
+}
+
+// botDifficultyByName returns the level called name, defaulting to medium.
+func botDifficultyByName(name string) BotDifficulty {
+	for _, d := range []BotDifficulty{BotEasy, BotMedium, BotHard} {
+		if d.Name == name {
+			return d
+		}
+	}
+	return BotMedium
+}
+
+func NewBot(playerNum int, difficulty BotDifficulty) *Bot {
 	return &Bot{
-		PlayerNum: playerNum,
+		PlayerNum:  playerNum,
+		Difficulty: difficulty,
 	}
 }
 
@@ -40,6 +81,11 @@ func (b *Bot) GetBestMove(game *Game) int {
 		}
 	}
 	
+	// Weaker bots sometimes just play anywhere
+	if b.Difficulty.Randomness > 0 && rand.Float64() < b.Difficulty.Randomness {
+		return validMoves[rand.Intn(len(validMoves))]
+	}
+	
 	// 2. Check if need to block opponent's immediate win
 	for _, col := range validMoves {
 		_, _, wins := game.SimulateMove(col, opponent)
@@ -64,7 +110,7 @@ func (b *Bot) GetBestMove(game *Game) int {
 		game.Board[row][col] = b.PlayerNum
 		
 		// Calculate score using minimax
-		score := b.minimax(game, 5, false, alpha, beta, opponent)
+		score := b.minimax(game, b.Difficulty.Depth, false, alpha, beta, opponent)
 		
 		// Undo move
 		game.Board[row][col] = Empty
@@ -215,7 +261,7 @@ func (b *Bot) minimax(game *Game, depth int, isMaximizing bool, alpha, beta int,
 			// Check if this move wins
 			if game.CheckWin(row, col, b.PlayerNum) {
 				game.Board[row][col] = Empty
-				return 10000 - (5 - depth) // Prefer faster wins
+				return 10000 - (b.Difficulty.Depth - depth) // Prefer faster wins
 			}
 			
 			score := b.minimax(game, depth-1, false, alpha, beta, opponent)
@@ -245,7 +291,7 @@ func (b *Bot) minimax(game *Game, depth int, isMaximizing bool, alpha, beta int,
 			// Check if opponent wins
 			if game.CheckWin(row, col, opponent) {
 				game.Board[row][col] = Empty
-				return -10000 + (5 - depth) // Prefer blocking later losses
+				return -10000 + (b.Difficulty.Depth - depth) // Prefer blocking later losses
 			}
 			
 			score := b.minimax(game, depth-1, true, alpha, beta, opponent)
@@ -370,6 +416,8 @@ func (b *Bot) MakeMoveWithDelay(game *Game, gameServer *GameServer) {
 	
 	col := b.GetBestMove(game)
 	if col >= 0 {
-		gameServer.handleMove(game, col, b.PlayerNum)
+		if _, err := gameServer.handleMove(game, col, b.PlayerNum, ""); err != nil {
+			log.Printf("Bot move rejected: %v", err)
+		}
 	}
 }
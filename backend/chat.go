@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ChatFilter screens chat messages before they are relayed. It returns the
+// text to deliver and whether the original should be flagged for review.
+type ChatFilter interface {
+	Filter(text string) (clean string, flagged bool)
+}
+
+// WordListFilter masks blocked words (case-insensitive, whole words only).
+type WordListFilter struct {
+	blocked map[string]bool
+}
+
+func NewWordListFilter(words []string) *WordListFilter {
+	f := &WordListFilter{blocked: make(map[string]bool)}
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if w != "" {
+			f.blocked[w] = true
+		}
+	}
+	return f
+}
+
+func (f *WordListFilter) Filter(text string) (string, bool) {
+	if len(f.blocked) == 0 {
+		return text, false
+	}
+
+	flagged := false
+	var out strings.Builder
+	var word strings.Builder
+
+	flush := func() {
+		w := word.String()
+		if f.blocked[strings.ToLower(w)] {
+			flagged = true
+			w = strings.Repeat("*", utf8.RuneCountInString(w))
+		}
+		out.WriteString(w)
+		word.Reset()
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word.WriteRune(r)
+			continue
+		}
+		flush()
+		out.WriteRune(r)
+	}
+	flush()
+
+	return out.String(), flagged
+}
+
+// ChatMessage is a persisted chat line. Text is what was delivered; Original
+// is what the player typed, kept for moderation when the filter changed it.
+type ChatMessage struct {
+	GameID    string    `json:"gameId"`
+	Username  string    `json:"username"`
+	Text      string    `json:"text"`
+	Original  string    `json:"original,omitempty"`
+	Flagged   bool      `json:"flagged"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (gs *GameServer) handleChat(client *Client, requestID, username, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		reject(client, requestID, ErrCodeBadRequest, "Message is empty")
+		return
+	}
+
+	if utf8.RuneCountInString(text) > gs.config.ChatMaxLength {
+		reject(client, requestID, ErrCodeMessageTooLong, "Message too long")
+		return
+	}
+
+	if gs.persist.Backlogged() {
+		reject(client, requestID, ErrCodeUnavailable, "Server is busy, please try again in a moment")
+		return
+	}
+
+	now := time.Now()
+
+	gs.mu.Lock()
+
+	if until, muted := gs.mutedUsers[username]; muted {
+		if now.Before(until) {
+			gs.mu.Unlock()
+			reject(client, requestID, ErrCodeMuted, "You are muted")
+			return
+		}
+		delete(gs.mutedUsers, username)
+	}
+
+	limiter := gs.chatLimiters[username]
+	if limiter == nil {
+		limiter = newTokenBucket(gs.config.ChatRateLimit, gs.config.ChatRateWindow)
+		gs.chatLimiters[username] = limiter
+	}
+	if !limiter.Allow(now) {
+		gs.mu.Unlock()
+		reject(client, requestID, ErrCodeRateLimited, "You are sending messages too fast")
+		return
+	}
+
+	game := gs.games[gs.playerGames[username]]
+	if game == nil || game.Status != "playing" {
+		gs.mu.Unlock()
+		reject(client, requestID, ErrCodeNotInGame, "You are not in a game")
+		return
+	}
+
+	clean, flagged := gs.chatFilter.Filter(text)
+
+	msg := Message{
+		Type: "chat",
+		Data: ChatRelayPayload{
+			GameID:    game.ID,
+			From:      username,
+			Text:      clean,
+			Timestamp: now.Unix(),
+		},
+	}
+
+	for _, p := range []*Player{game.Player1, game.Player2} {
+		if p.IsBot || !p.Connected || p.Client == nil || p.MutedUsers[username] {
+			continue
+		}
+		if err := p.Client.Send(msg); err != nil {
+			log.Printf("Error relaying chat to %s: %v", p.Username, err)
+		}
+	}
+
+	if gs.config.ChatToSpectators {
+		for spectator := range game.Spectators {
+			spectator.Send(msg)
+		}
+	}
+
+	gs.mu.Unlock()
+
+	ack(client, requestID)
+
+	record := ChatMessage{
+		GameID:    game.ID,
+		Username:  username,
+		Text:      clean,
+		Flagged:   flagged,
+		CreatedAt: now,
+	}
+	if clean != text {
+		record.Original = text
+	}
+	if err := gs.persist.SaveChatMessage(record); err != nil {
+		log.Printf("Error saving chat message in game %s: %v", game.ID, err)
+	}
+}
+
+// handleMute toggles whether username receives chat from target for the rest
+// of the current game.
+func (gs *GameServer) handleMute(client *Client, requestID, username, target string, mute bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	var player *Player
+	if game := gs.games[gs.playerGames[username]]; game != nil {
+		player = game.PlayerByName(username)
+	}
+	if player == nil {
+		reject(client, requestID, ErrCodeNotInGame, "You are not in a game")
+		return
+	}
+
+	if mute {
+		player.MutedUsers[target] = true
+	} else {
+		delete(player.MutedUsers, target)
+	}
+
+	client.Send(Message{
+		Type: "mute_updated",
+		Data: MuteUpdatedPayload{
+			Username: target,
+			Muted:    mute,
+		},
+	})
+	ack(client, requestID)
+}
+
+// MuteUser stops username from sending chat anywhere on the server until the
+// given duration has passed.
+func (gs *GameServer) MuteUser(username string, d time.Duration) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.mutedUsers[username] = time.Now().Add(d)
+}
+
+// pruneChatLimiters drops rate limiters for users who have been quiet long
+// enough for their bucket to refill. Caller must hold gs.mu.
+func (gs *GameServer) pruneChatLimiters(now time.Time) {
+	for username, limiter := range gs.chatLimiters {
+		if limiter.Full(now) {
+			delete(gs.chatLimiters, username)
+		}
+	}
+}
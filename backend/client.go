@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// What to do with a client whose send queue is full
+const (
+	SlowClientDisconnect = "disconnect"
+	SlowClientDrop       = "drop"
+)
+
+var (
+	ErrClientClosed = errors.New("client closed")
+	ErrSlowClient   = errors.New("client send queue full")
+)
+
+// Server-wide counters for slow clients, reported on /api/metrics
+var (
+	droppedMessages       atomic.Int64
+	slowClientDisconnects atomic.Int64
+)
+
+// Client wraps a WebSocket connection with a buffered outbound queue drained
+// by a single writer goroutine, so callers never block on the network and
+// gorilla/websocket never sees concurrent writers. Reads still happen on the
+// connection directly, from HandleConnection.
+//
+// A relay client stands in on a game's owning instance for a connection held
+// by another instance: it has no connection, and hands everything it is sent
+// to relay instead.
+type Client struct {
+	id           string // unique across the cluster
+	conn         *websocket.Conn
+	relay        func(kind string, data []byte)
+	remote       string // instance holding the connection of a relay client
+	send         chan []byte
+	done         chan struct{}
+	closeOnce    sync.Once
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	slowPolicy   string
+}
+
+// NewClient starts the writer goroutine for conn.
+func NewClient(conn *websocket.Conn, cfg Config) *Client {
+	c := &Client{
+		id:           uuid.New().String(),
+		conn:         conn,
+		send:         make(chan []byte, cfg.SendQueueSize),
+		done:         make(chan struct{}),
+		writeTimeout: cfg.WriteTimeout,
+		pingInterval: cfg.PingInterval,
+		slowPolicy:   cfg.SlowClientPolicy,
+	}
+	go c.writePump()
+	return c
+}
+
+// newRelayClient returns a client whose messages go to relay as
+// clusterDeliver, or clusterKick for the last one.
+func newRelayClient(id string, relay func(kind string, data []byte)) *Client {
+	return &Client{
+		id:    id,
+		relay: relay,
+		done:  make(chan struct{}),
+	}
+}
+
+// Send queues msg for delivery without blocking. The message is encoded
+// immediately, so callers may keep mutating whatever it was built from.
+func (c *Client) Send(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.sendRaw(data, msg.Type)
+}
+
+// sendRaw queues an encoded message of type msgType.
+func (c *Client) sendRaw(data []byte, msgType string) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	if c.relay != nil {
+		c.relay(clusterDeliver, data)
+		return nil
+	}
+
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return nil
+	default:
+	}
+
+	if c.slowPolicy == SlowClientDrop {
+		droppedMessages.Add(1)
+		log.Printf("Dropping %s message for slow client %s", msgType, c.conn.RemoteAddr())
+		return ErrSlowClient
+	}
+
+	slowClientDisconnects.Add(1)
+	log.Printf("Disconnecting slow client %s", c.conn.RemoteAddr())
+	c.Close()
+	return ErrClientClosed
+}
+
+// Kick delivers a final message and then closes the connection once
+// everything queued before it has been written.
+func (c *Client) Kick(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.kickRaw(data, msg.Type)
+}
+
+func (c *Client) kickRaw(data []byte, msgType string) {
+	if c.relay != nil {
+		select {
+		case <-c.done:
+		default:
+			c.relay(clusterKick, data)
+		}
+		c.Close()
+		return
+	}
+
+	if err := c.sendRaw(data, msgType); err != nil {
+		c.Close()
+		return
+	}
+
+	// A nil frame tells the writer to close after draining the queue
+	select {
+	case c.send <- nil:
+	default:
+		c.Close()
+	}
+}
+
+// Close stops the writer and closes the connection, which also unblocks the
+// reader in HandleConnection. It is safe to call more than once.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// Done is closed once the connection has been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	defer c.Close()
+
+	for {
+		select {
+		case data := <-c.send:
+			if data == nil {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Error writing to %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		case <-ticker.C:
+			// The reader extends its deadline when the pong comes back
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Error pinging %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Values of CLUSTER_BACKEND
+const (
+	ClusterMemory   = "memory"   // single instance
+	ClusterPostgres = "postgres" // shared through the game database
+)
+
+// Cluster is the state and messaging shared by the backend instances of one
+// deployment. Each game is owned by the instance that created it, which runs
+// its logic; players and spectators connected to other instances reach it by
+// message. With MemoryCluster a single instance is its own cluster.
+type Cluster interface {
+	InstanceID() string
+
+	// Matchmaking queue shared by all instances
+	Enqueue(entry QueueEntry) error
+	Dequeue(username, connID string) error           // only if still queued from connID
+	Waiting(opts MatchOptions) ([]QueueEntry, error) // oldest first
+	// Claim takes all the given players out of the queue, or none of them if
+	// any has left or been matched by another instance in the meantime.
+	Claim(usernames ...string) (bool, error)
+
+	// Which instance owns which game
+	RegisterGame(gameID string, player1, player2 string) error
+	UnregisterGame(gameID string) error
+	GameOwner(gameID string) (string, error)                      // "" if unknown
+	PlayerGame(username string) (gameID, owner string, err error) // "" if none
+
+	// Messaging between instances. Messages to one instance arrive in the
+	// order they were sent.
+	Instances() ([]string, error) // live instances, this one included
+	Send(instanceID string, msg ClusterMessage) error
+	Listen(handler func(ClusterMessage))
+	Close() error
+}
+
+// QueueEntry is a waiting player as every instance sees them.
+type QueueEntry struct {
+	Username   string
+	InstanceID string // instance holding the player's connection
+	ConnID     string
+	Options    MatchOptions
+	Rating     int
+	BotPolicy  BotPolicy
+	JoinedAt   time.Time
+}
+
+// Kinds of ClusterMessage
+const (
+	clusterDeliver = "deliver" // to a connection's instance: write Data to ConnID
+	clusterKick    = "kick"    // same, then close the connection
+	clusterInbound = "inbound" // to a game's owner: Data is a message from ConnID
+	clusterTouch   = "touch"   // to a game's owner: ConnID is still alive
+	clusterClosed  = "closed"  // to a game's owner: ConnID has gone
+	clusterMatched = "matched" // to a connection's instance: ConnID's player is now in GameID
+
+	// Admin actions, sent to every instance
+	clusterNotice     = "notice"      // Data is a NoticePayload for every local connection
+	clusterKickUser   = "kick_user"   // close Username's local connections, Data is the reason
+	clusterClearQueue = "clear_queue" // send the players waiting here away
+)
+
+// ClusterMessage is what instances send each other about connections.
+type ClusterMessage struct {
+	Kind     string          `json:"kind"`
+	From     string          `json:"from"`
+	ConnID   string          `json:"connId"`
+	Username string          `json:"username,omitempty"`
+	GameID   string          `json:"gameId,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// MemoryCluster keeps everything in process, for running a single instance.
+type MemoryCluster struct {
+	id    string
+	mu    sync.Mutex
+	queue map[string]QueueEntry
+	games map[string][2]string // gameID -> players
+	inbox chan ClusterMessage
+}
+
+func NewMemoryCluster(instanceID string) *MemoryCluster {
+	return &MemoryCluster{
+		id:    instanceID,
+		queue: make(map[string]QueueEntry),
+		games: make(map[string][2]string),
+		inbox: make(chan ClusterMessage, 256),
+	}
+}
+
+func (c *MemoryCluster) InstanceID() string {
+	return c.id
+}
+
+func (c *MemoryCluster) Enqueue(entry QueueEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queue[entry.Username] = entry
+	return nil
+}
+
+func (c *MemoryCluster) Dequeue(username, connID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.queue[username].ConnID == connID {
+		delete(c.queue, username)
+	}
+	return nil
+}
+
+func (c *MemoryCluster) Waiting(opts MatchOptions) ([]QueueEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []QueueEntry
+	for _, e := range c.queue {
+		if e.Options == opts {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].JoinedAt.Before(entries[j].JoinedAt)
+	})
+	return entries, nil
+}
+
+func (c *MemoryCluster) Claim(usernames ...string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, u := range usernames {
+		if _, ok := c.queue[u]; !ok {
+			return false, nil
+		}
+	}
+	for _, u := range usernames {
+		delete(c.queue, u)
+	}
+	return true, nil
+}
+
+func (c *MemoryCluster) RegisterGame(gameID string, player1, player2 string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.games[gameID] = [2]string{player1, player2}
+	return nil
+}
+
+func (c *MemoryCluster) UnregisterGame(gameID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.games, gameID)
+	return nil
+}
+
+func (c *MemoryCluster) GameOwner(gameID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.games[gameID]; ok {
+		return c.id, nil
+	}
+	return "", nil
+}
+
+func (c *MemoryCluster) PlayerGame(username string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for gameID, players := range c.games {
+		if players[0] == username || players[1] == username {
+			return gameID, c.id, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (c *MemoryCluster) Instances() ([]string, error) {
+	return []string{c.id}, nil
+}
+
+func (c *MemoryCluster) Send(instanceID string, msg ClusterMessage) error {
+	if instanceID != c.id {
+		return fmt.Errorf("unknown instance %q", instanceID)
+	}
+	c.inbox <- msg
+	return nil
+}
+
+func (c *MemoryCluster) Listen(handler func(ClusterMessage)) {
+	go func() {
+		for msg := range c.inbox {
+			handler(msg)
+		}
+	}()
+}
+
+func (c *MemoryCluster) Close() error {
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	clusterHeartbeatInterval = 5 * time.Second
+	// Queue entries and games of instances silent for longer are ignored
+	clusterInstanceTimeout = 30 * time.Second
+	// NOTIFY payloads must stay below 8000 bytes
+	maxNotifyPayload = 7900
+)
+
+// PostgresCluster shares state through tables in the game database and
+// messages through LISTEN/NOTIFY, one channel per instance.
+type PostgresCluster struct {
+	id       string
+	db       *sql.DB
+	listener *pq.Listener
+	notifyMu sync.Mutex
+	notify   *sql.Conn // one connection, so notifications keep their order
+	stop     chan struct{}
+}
+
+// NewPostgresCluster joins the cluster as instanceID. Its tables are created
+// by migration 0002_cluster.
+func NewPostgresCluster(connStr string, db *sql.DB, instanceID string) (*PostgresCluster, error) {
+	// Players queued by an earlier run of this instance are long gone, and
+	// the games it owned are registered again as they are recovered
+	for _, table := range []string{"cluster_queue", "cluster_games"} {
+		if _, err := db.Exec(`DELETE FROM `+table+` WHERE instance_id = $1`, instanceID); err != nil {
+			return nil, err
+		}
+	}
+
+	notify, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Cluster listener: %v", err)
+		}
+	})
+	if err := listener.Listen(clusterChannel(instanceID)); err != nil {
+		notify.Close()
+		listener.Close()
+		return nil, err
+	}
+
+	c := &PostgresCluster{
+		id:       instanceID,
+		db:       db,
+		listener: listener,
+		notify:   notify,
+		stop:     make(chan struct{}),
+	}
+	if err := c.heartbeat(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.heartbeatLoop()
+
+	return c, nil
+}
+
+// clusterChannel is the NOTIFY channel of an instance.
+func clusterChannel(instanceID string) string {
+	var b strings.Builder
+	b.WriteString("fourinarow_")
+	for _, r := range strings.ToLower(instanceID) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+func (c *PostgresCluster) InstanceID() string {
+	return c.id
+}
+
+func (c *PostgresCluster) heartbeat() error {
+	_, err := c.db.Exec(`
+		INSERT INTO cluster_instances (instance_id, last_seen) VALUES ($1, $2)
+		ON CONFLICT (instance_id) DO UPDATE SET last_seen = EXCLUDED.last_seen
+	`, c.id, time.Now())
+	return err
+}
+
+func (c *PostgresCluster) heartbeatLoop() {
+	ticker := time.NewTicker(clusterHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.heartbeat(); err != nil {
+				log.Printf("Cluster heartbeat failed: %v", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *PostgresCluster) Enqueue(e QueueEntry) error {
+	_, err := c.db.Exec(`
+		INSERT INTO cluster_queue (username, instance_id, conn_id, board_size, variant, time_control, rating, bot_mode, bot_after_ms, joined_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (username) DO UPDATE SET
+			instance_id = EXCLUDED.instance_id,
+			conn_id = EXCLUDED.conn_id,
+			board_size = EXCLUDED.board_size,
+			variant = EXCLUDED.variant,
+			time_control = EXCLUDED.time_control,
+			rating = EXCLUDED.rating,
+			bot_mode = EXCLUDED.bot_mode,
+			bot_after_ms = EXCLUDED.bot_after_ms,
+			joined_at = EXCLUDED.joined_at
+	`, e.Username, e.InstanceID, e.ConnID, e.Options.BoardSize, e.Options.Variant, e.Options.TimeControl,
+		e.Rating, e.BotPolicy.Mode, e.BotPolicy.After.Milliseconds(), e.JoinedAt)
+	return err
+}
+
+func (c *PostgresCluster) Dequeue(username, connID string) error {
+	_, err := c.db.Exec(`DELETE FROM cluster_queue WHERE username = $1 AND conn_id = $2`, username, connID)
+	return err
+}
+
+func (c *PostgresCluster) Waiting(opts MatchOptions) ([]QueueEntry, error) {
+	rows, err := c.db.Query(`
+		SELECT q.username, q.instance_id, q.conn_id, q.rating, q.bot_mode, q.bot_after_ms, q.joined_at
+		FROM cluster_queue q
+		JOIN cluster_instances i ON i.instance_id = q.instance_id
+		WHERE q.board_size = $1 AND q.variant = $2 AND q.time_control = $3 AND i.last_seen > $4
+		ORDER BY q.joined_at
+	`, opts.BoardSize, opts.Variant, opts.TimeControl, time.Now().Add(-clusterInstanceTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []QueueEntry
+	for rows.Next() {
+		e := QueueEntry{Options: opts}
+		var afterMs int64
+		if err := rows.Scan(&e.Username, &e.InstanceID, &e.ConnID, &e.Rating, &e.BotPolicy.Mode, &afterMs, &e.JoinedAt); err != nil {
+			return nil, err
+		}
+		e.BotPolicy.After = time.Duration(afterMs) * time.Millisecond
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (c *PostgresCluster) Claim(usernames ...string) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM cluster_queue WHERE username = ANY($1)`, pq.Array(usernames))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if int(n) != len(usernames) {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+func (c *PostgresCluster) RegisterGame(gameID string, player1, player2 string) error {
+	_, err := c.db.Exec(`
+		INSERT INTO cluster_games (game_id, instance_id, player1, player2) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (game_id) DO UPDATE SET instance_id = EXCLUDED.instance_id
+	`, gameID, c.id, player1, player2)
+	return err
+}
+
+func (c *PostgresCluster) UnregisterGame(gameID string) error {
+	_, err := c.db.Exec(`DELETE FROM cluster_games WHERE game_id = $1`, gameID)
+	return err
+}
+
+func (c *PostgresCluster) GameOwner(gameID string) (string, error) {
+	var owner string
+	err := c.db.QueryRow(`
+		SELECT g.instance_id FROM cluster_games g
+		JOIN cluster_instances i ON i.instance_id = g.instance_id
+		WHERE g.game_id = $1 AND i.last_seen > $2
+	`, gameID, time.Now().Add(-clusterInstanceTimeout)).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return owner, err
+}
+
+func (c *PostgresCluster) PlayerGame(username string) (string, string, error) {
+	var gameID, owner string
+	err := c.db.QueryRow(`
+		SELECT g.game_id, g.instance_id FROM cluster_games g
+		JOIN cluster_instances i ON i.instance_id = g.instance_id
+		WHERE (g.player1 = $1 OR g.player2 = $1) AND i.last_seen > $2
+		LIMIT 1
+	`, username, time.Now().Add(-clusterInstanceTimeout)).Scan(&gameID, &owner)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return gameID, owner, err
+}
+
+func (c *PostgresCluster) Instances() ([]string, error) {
+	rows, err := c.db.Query(`
+		SELECT instance_id FROM cluster_instances WHERE last_seen > $1 ORDER BY instance_id
+	`, time.Now().Add(-clusterInstanceTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instances []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		instances = append(instances, id)
+	}
+	return instances, rows.Err()
+}
+
+func (c *PostgresCluster) Send(instanceID string, msg ClusterMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		return fmt.Errorf("%s message of %d bytes is too large to notify", msg.Kind, len(payload))
+	}
+
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+
+	_, err = c.notify.ExecContext(context.Background(), `SELECT pg_notify($1, $2)`, clusterChannel(instanceID), string(payload))
+	return err
+}
+
+func (c *PostgresCluster) Listen(handler func(ClusterMessage)) {
+	go func() {
+		for n := range c.listener.Notify {
+			if n == nil {
+				// The connection was re-established; anything sent in the
+				// meantime is lost and players will resync on reconnect
+				continue
+			}
+			var msg ClusterMessage
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				log.Printf("Cluster: bad message: %v", err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+}
+
+func (c *PostgresCluster) Close() error {
+	close(c.stop)
+	c.db.Exec(`DELETE FROM cluster_queue WHERE instance_id = $1`, c.id)
+	c.db.Exec(`DELETE FROM cluster_instances WHERE instance_id = $1`, c.id)
+	c.notify.Close()
+	return c.listener.Close()
+}
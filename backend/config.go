@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server-wide settings read from the environment at startup.
+type Config struct {
+	// Bot fallback used when a player does not ask for a specific policy
+	DefaultBotPolicy BotPolicy
+	// Upper bound on the wait a player may request before a bot joins
+	MaxBotWait time.Duration
+
+	ChatMaxLength    int // characters per message
+	ChatRateLimit    int // messages allowed per ChatRateWindow
+	ChatRateWindow   time.Duration
+	ChatToSpectators bool     // relay player chat to spectators
+	ChatBlockedWords []string // masked by the default chat filter
+
+	AuthSecret     string // HMAC key for session tokens
+	SessionTTL     time.Duration
+	GuestResumeTTL time.Duration
+
+	SendQueueSize    int           // outbound messages buffered per connection
+	WriteTimeout     time.Duration // deadline for a single WebSocket write
+	SlowClientPolicy string        // SlowClientDisconnect or SlowClientDrop
+
+	PingInterval   time.Duration // how often the server pings each client
+	PongTimeout    time.Duration // silence after which a client is considered gone
+	ForfeitTimeout time.Duration // how long a disconnected player has to come back
+
+	RecoveryMaxAge  time.Duration // games idle longer than this are not resumed after a restart
+	StaleGamePolicy string        // StaleGameDraw, StaleGameForfeit or StaleGameAbort
+
+	DrainTimeout time.Duration // how long shutdown waits for live games to finish
+	DrainPolicy  string        // DrainPersist or DrainAdjudicate for games still running
+
+	ClusterBackend string // ClusterMemory or ClusterPostgres
+	InstanceID     string // this instance's name in the cluster, stable across restarts
+
+	AdminToken string // bearer token for /api/admin/, which is off without one
+
+	MaxConnsPerIP     int // open WebSockets per client address, 0 for no limit
+	ConnRatePerIP     int // new WebSockets per client address per minute, 0 for no limit
+	MessageRateLimit  int // client messages allowed per MessageRateWindow, 0 for no limit
+	MessageRateWindow time.Duration
+	MaxMessageBytes   int64    // larger client messages close the connection
+	AllowedOrigins    []string // browser origins allowed to connect, empty for the server's own
+	TrustProxy        bool     // take client addresses from X-Forwarded-For
+
+	SeasonLength    time.Duration // length of automatically scheduled seasons, 0 to only use seasons created by admins
+	SeasonCarryover float64       // share of a rating's distance from DefaultRating kept at season start
+
+	PersistWorkers   int    // goroutines writing games, moves and chat to the store
+	PersistQueueSize int    // writes held in memory at most; past half of it they are spilled to disk
+	PersistSpillPath string // file holding writes while the store is unreachable
+}
+
+func LoadConfig() Config {
+	cfg := Config{
+		MaxBotWait: getEnvSeconds("BOT_FALLBACK_MAX_SECONDS", 120),
+
+		ChatMaxLength:    getEnvInt("CHAT_MAX_LENGTH", 200),
+		ChatRateLimit:    getEnvInt("CHAT_RATE_LIMIT", 5),
+		ChatRateWindow:   getEnvSeconds("CHAT_RATE_WINDOW_SECONDS", 10),
+		ChatToSpectators: getEnv("CHAT_SPECTATORS", "false") == "true",
+		ChatBlockedWords: strings.Split(getEnv("CHAT_BLOCKED_WORDS", ""), ","),
+
+		AuthSecret: getEnv("AUTH_SECRET", ""),
+		SessionTTL: time.Duration(getEnvInt("SESSION_TTL_HOURS", 24*7)) * time.Hour,
+
+		GuestResumeTTL: time.Duration(getEnvInt("GUEST_RESUME_TTL_DAYS", 90)) * 24 * time.Hour,
+
+		SendQueueSize:    getEnvInt("WS_SEND_QUEUE_SIZE", 64),
+		WriteTimeout:     getEnvSeconds("WS_WRITE_TIMEOUT_SECONDS", 10),
+		SlowClientPolicy: getEnv("WS_SLOW_CLIENT_POLICY", SlowClientDisconnect),
+
+		PingInterval:   getEnvSeconds("WS_PING_INTERVAL_SECONDS", 10),
+		PongTimeout:    getEnvSeconds("WS_PONG_TIMEOUT_SECONDS", 25),
+		ForfeitTimeout: getEnvSeconds("FORFEIT_TIMEOUT_SECONDS", 30),
+
+		RecoveryMaxAge:  getEnvSeconds("RECOVERY_MAX_AGE_SECONDS", 600),
+		StaleGamePolicy: getEnv("STALE_GAME_POLICY", StaleGameDraw),
+
+		DrainTimeout: getEnvSeconds("DRAIN_TIMEOUT_SECONDS", 45),
+		DrainPolicy:  getEnv("DRAIN_POLICY", DrainPersist),
+
+		ClusterBackend: getEnv("CLUSTER_BACKEND", ClusterMemory),
+		InstanceID:     getEnv("INSTANCE_ID", ""),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		MaxConnsPerIP:     getEnvInt("WS_MAX_CONNS_PER_IP", 10),
+		ConnRatePerIP:     getEnvInt("WS_CONN_RATE_PER_MINUTE", 30),
+		MessageRateLimit:  getEnvInt("WS_MSG_RATE_LIMIT", 20),
+		MessageRateWindow: getEnvSeconds("WS_MSG_RATE_WINDOW_SECONDS", 5),
+		MaxMessageBytes:   int64(getEnvInt("WS_MAX_MESSAGE_BYTES", 4096)),
+		TrustProxy:        getEnv("TRUST_PROXY", "false") == "true",
+
+		SeasonLength:    time.Duration(getEnvInt("SEASON_LENGTH_DAYS", 0)) * 24 * time.Hour,
+		SeasonCarryover: getEnvFloat("SEASON_RATING_CARRYOVER", 0.5),
+
+		PersistWorkers:   getEnvInt("PERSIST_WORKERS", 4),
+		PersistQueueSize: getEnvInt("PERSIST_QUEUE_SIZE", 1024),
+		PersistSpillPath: getEnv("PERSIST_SPILL_PATH", "persist-spill.jsonl"),
+	}
+
+	for _, origin := range strings.Split(getEnv("ALLOWED_ORIGINS", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+		}
+	}
+	if len(cfg.AllowedOrigins) == 0 {
+		log.Println("Warning: ALLOWED_ORIGINS not set, accepting WebSockets from the server's own origin only")
+	}
+
+	policy, err := NewBotPolicy(
+		getEnv("BOT_FALLBACK_POLICY", BotAfter),
+		int(getEnvSeconds("BOT_FALLBACK_SECONDS", 10)/time.Second),
+		BotPolicy{},
+		cfg.MaxBotWait,
+	)
+	if err != nil {
+		log.Printf("Warning: %v, using bot after 10 seconds", err)
+		policy = BotPolicy{Mode: BotAfter, After: 10 * time.Second}
+	}
+	cfg.DefaultBotPolicy = policy
+
+	if cfg.ChatRateLimit < 1 || cfg.ChatRateWindow <= 0 {
+		log.Printf("Warning: CHAT_RATE_LIMIT and CHAT_RATE_WINDOW_SECONDS must be positive, using 5 per 10 seconds")
+		cfg.ChatRateLimit, cfg.ChatRateWindow = 5, 10*time.Second
+	}
+
+	if cfg.PongTimeout <= cfg.PingInterval {
+		log.Printf("Warning: WS_PONG_TIMEOUT_SECONDS must exceed WS_PING_INTERVAL_SECONDS, using %v", 2*cfg.PingInterval+5*time.Second)
+		cfg.PongTimeout = 2*cfg.PingInterval + 5*time.Second
+	}
+
+	// A zero limit turns a limiter off; a zero window would divide by zero
+	if cfg.MaxConnsPerIP < 0 {
+		log.Printf("Warning: WS_MAX_CONNS_PER_IP must not be negative, using 10")
+		cfg.MaxConnsPerIP = 10
+	}
+	if cfg.ConnRatePerIP < 0 {
+		log.Printf("Warning: WS_CONN_RATE_PER_MINUTE must not be negative, using 30")
+		cfg.ConnRatePerIP = 30
+	}
+	if cfg.MessageRateLimit < 0 || cfg.MessageRateWindow <= 0 {
+		log.Printf("Warning: WS_MSG_RATE_LIMIT must not be negative and WS_MSG_RATE_WINDOW_SECONDS must be positive, using 20 per 5 seconds")
+		cfg.MessageRateLimit, cfg.MessageRateWindow = 20, 5*time.Second
+	}
+
+	if cfg.SlowClientPolicy != SlowClientDisconnect && cfg.SlowClientPolicy != SlowClientDrop {
+		log.Printf("Warning: unknown WS_SLOW_CLIENT_POLICY %q, disconnecting slow clients", cfg.SlowClientPolicy)
+		cfg.SlowClientPolicy = SlowClientDisconnect
+	}
+
+	switch cfg.StaleGamePolicy {
+	case StaleGameDraw, StaleGameForfeit, StaleGameAbort:
+	default:
+		log.Printf("Warning: unknown STALE_GAME_POLICY %q, using %s", cfg.StaleGamePolicy, StaleGameDraw)
+		cfg.StaleGamePolicy = StaleGameDraw
+	}
+
+	if cfg.DrainPolicy != DrainPersist && cfg.DrainPolicy != DrainAdjudicate {
+		log.Printf("Warning: unknown DRAIN_POLICY %q, using %s", cfg.DrainPolicy, DrainPersist)
+		cfg.DrainPolicy = DrainPersist
+	}
+
+	if cfg.ClusterBackend != ClusterMemory && cfg.ClusterBackend != ClusterPostgres {
+		log.Printf("Warning: unknown CLUSTER_BACKEND %q, using %s", cfg.ClusterBackend, ClusterMemory)
+		cfg.ClusterBackend = ClusterMemory
+	}
+
+	if cfg.SeasonCarryover < 0 || cfg.SeasonCarryover > 1 {
+		log.Printf("Warning: SEASON_RATING_CARRYOVER must be between 0 and 1, using 0.5")
+		cfg.SeasonCarryover = 0.5
+	}
+
+	if cfg.PersistWorkers < 1 || cfg.PersistQueueSize < cfg.PersistWorkers {
+		log.Printf("Warning: PERSIST_WORKERS must be at least 1 and PERSIST_QUEUE_SIZE at least as large, using 4 and 1024")
+		cfg.PersistWorkers, cfg.PersistQueueSize = 4, 1024
+	}
+
+	if cfg.InstanceID == "" {
+		cfg.InstanceID, _ = os.Hostname()
+		if cfg.InstanceID == "" {
+			cfg.InstanceID = "backend"
+		}
+	}
+
+	return cfg
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q, using %g", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+func getEnvSeconds(key string, defaultSeconds int) time.Duration {
+	return time.Duration(getEnvInt(key, defaultSeconds)) * time.Second
+}
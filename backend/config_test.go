@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadConfigRateLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		chatLimit  int
+		chatWindow time.Duration
+	}{
+		{"defaults", nil, 5, 10 * time.Second},
+		{"set", map[string]string{"CHAT_RATE_LIMIT": "3", "CHAT_RATE_WINDOW_SECONDS": "60"}, 3, time.Minute},
+		{"zero chat limit", map[string]string{"CHAT_RATE_LIMIT": "0"}, 5, 10 * time.Second},
+		{"negative chat limit", map[string]string{"CHAT_RATE_LIMIT": "-1"}, 5, 10 * time.Second},
+		{"zero chat window", map[string]string{"CHAT_RATE_WINDOW_SECONDS": "0"}, 5, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg := LoadConfig()
+			if cfg.ChatRateLimit != tt.chatLimit || cfg.ChatRateWindow != tt.chatWindow {
+				t.Errorf("chat limit %d per %v, want %d per %v", cfg.ChatRateLimit, cfg.ChatRateWindow, tt.chatLimit, tt.chatWindow)
+			}
+		})
+	}
+}
+
+func TestLoadConfigConnectionLimits(t *testing.T) {
+	type limits struct {
+		maxConns, connRate, msgLimit int
+		msgWindow                    time.Duration
+	}
+	defaults := limits{10, 30, 20, 5 * time.Second}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want limits
+	}{
+		{"defaults", nil, defaults},
+		{"limits off", map[string]string{"WS_MAX_CONNS_PER_IP": "0", "WS_CONN_RATE_PER_MINUTE": "0", "WS_MSG_RATE_LIMIT": "0"}, limits{0, 0, 0, 5 * time.Second}},
+		{"set", map[string]string{"WS_MAX_CONNS_PER_IP": "2", "WS_CONN_RATE_PER_MINUTE": "5", "WS_MSG_RATE_LIMIT": "50", "WS_MSG_RATE_WINDOW_SECONDS": "10"}, limits{2, 5, 50, 10 * time.Second}},
+		{"negative", map[string]string{"WS_MAX_CONNS_PER_IP": "-1", "WS_CONN_RATE_PER_MINUTE": "-1", "WS_MSG_RATE_LIMIT": "-1"}, defaults},
+		{"zero window", map[string]string{"WS_MSG_RATE_LIMIT": "50", "WS_MSG_RATE_WINDOW_SECONDS": "0"}, defaults},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg := LoadConfig()
+			got := limits{cfg.MaxConnsPerIP, cfg.ConnRatePerIP, cfg.MessageRateLimit, cfg.MessageRateWindow}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
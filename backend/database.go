@@ -1,71 +1,106 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	migrate "github.com/yourusername/4-in-a-row-migrate"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
+// Each dialect has its own migrations; the queries below are plain SQL that
+// both Postgres and SQLite understand.
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// Database is the Store kept in Postgres or SQLite.
 type Database struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect string // StorePostgres or StoreSQLite
 }
 
-func NewDatabase(connectionString string) (*Database, error) {
+// NewDatabase connects to Postgres and, with migrate set, brings the schema
+// up to date first.
+func NewDatabase(connectionString string, migrate bool) (*Database, error) {
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
+	return openDatabase(db, StorePostgres, migrate)
+}
+
+// NewSQLiteDatabase opens or creates the SQLite database at path and, with
+// migrate set, brings the schema up to date first.
+func NewSQLiteDatabase(path string, migrate bool) (*Database, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
 		return nil, err
 	}
+	// SQLite allows one writer at a time; a single connection keeps
+	// transactions from failing with SQLITE_BUSY instead of waiting
+	db.SetMaxOpenConns(1)
+
+	return openDatabase(db, StoreSQLite, migrate)
+}
 
-	database := &Database{db: db}
-	if err := database.createTables(); err != nil {
+func openDatabase(db *sql.DB, dialect string, migrate bool) (*Database, error) {
+	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
+	database := &Database{db: db, dialect: dialect}
+	if migrate {
+		migrator, err := database.Migrator()
+		if err != nil {
+			return nil, err
+		}
+		applied, err := migrator.Up(0)
+		if err != nil {
+			return nil, err
+		}
+		if applied > 0 {
+			log.Printf("Applied %d database migration(s)", applied)
+		}
+	}
+
 	return database, nil
 }
 
-func (d *Database) createTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS games (
-			id VARCHAR(255) PRIMARY KEY,
-			player1_username VARCHAR(255),
-			player2_username VARCHAR(255),
-			winner INTEGER,
-			status VARCHAR(50),
-			start_time TIMESTAMP,
-			end_time TIMESTAMP,
-			move_count INTEGER,
-			duration_seconds INTEGER
-		)`,
-		`CREATE TABLE IF NOT EXISTS players (
-			username VARCHAR(255) PRIMARY KEY,
-			games_played INTEGER DEFAULT 0,
-			games_won INTEGER DEFAULT 0,
-			games_lost INTEGER DEFAULT 0,
-			games_drawn INTEGER DEFAULT 0,
-			total_moves INTEGER DEFAULT 0,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_players_wins ON players(games_won DESC)`,
-	}
-
-	for _, query := range queries {
-		if _, err := d.db.Exec(query); err != nil {
-			return err
-		}
+// Migrator returns the runner for the migrations embedded in the binary.
+func (d *Database) Migrator() (*migrate.Migrator, error) {
+	files, err := fs.Sub(migrationFiles, "migrations/"+d.dialect)
+	if err != nil {
+		return nil, err
 	}
+	// SQLite runs one write transaction at a time anyway
+	return migrate.New(d.db, files, d.dialect == StorePostgres)
+}
 
-	return nil
+// execer is what the queries below need, from the database or from a
+// transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 func (d *Database) SaveGame(game *Game) error {
+	return saveGame(d.db, game)
+}
+
+func saveGame(ex execer, game *Game) error {
 	duration := 0
 	if !game.EndTime.IsZero() {
 		duration = int(game.EndTime.Sub(game.StartTime).Seconds())
@@ -81,23 +116,133 @@ func (d *Database) SaveGame(game *Game) error {
 		player2Username = game.Player2.Username
 	}
 
-	_, err := d.db.Exec(`
-		INSERT INTO games (id, player1_username, player2_username, winner, status, start_time, end_time, move_count, duration_seconds)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	_, err := ex.Exec(`
+		INSERT INTO games (id, player1_username, player2_username, winner, status, start_time, end_time, move_count, duration_seconds, board_size, variant, time_control)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (id) DO UPDATE SET
 			winner = EXCLUDED.winner,
 			status = EXCLUDED.status,
 			end_time = EXCLUDED.end_time,
 			move_count = EXCLUDED.move_count,
 			duration_seconds = EXCLUDED.duration_seconds
-	`, game.ID, player1Username, player2Username, game.Winner, game.Status, game.StartTime, game.EndTime, game.MoveCount, duration)
+		WHERE games.status IS DISTINCT FROM 'finished'
+	`, game.ID, player1Username, player2Username, game.Winner, game.Status, game.StartTime, game.EndTime, game.MoveCount, duration,
+		game.Options.BoardSize, game.Options.Variant, game.Options.TimeControl)
 
 	return err
 }
 
-func (d *Database) UpdatePlayerStats(username string, won bool, drawn bool) error {
+// PlayerResult is how a finished game counts for one of its human players.
+type PlayerResult struct {
+	Username    string
+	Won         bool
+	Drawn       bool
+	Moves       int // moves the player made
+	RatingDelta int
+}
+
+// RecordGameResult stores a finished game, fills in any of its moves that
+// were not saved as they were played, and applies each player's stats and
+// rating change, all in one transaction. A transaction that loses a
+// serialization conflict or deadlock is retried. Recording the same game
+// twice changes nothing the second time.
+func (d *Database) RecordGameResult(game *Game, moves []MoveRecord, players []PlayerResult) error {
+	// Always touch players in the same order so that two games ending
+	// together cannot deadlock on each other's rows
+	players = append([]PlayerResult(nil), players...)
+	sort.Slice(players, func(i, j int) bool { return players[i].Username < players[j].Username })
+
+	return d.retryTx(func(tx *sql.Tx) error {
+		// Writes replayed after a failure may include results that were
+		// recorded already
+		var status sql.NullString
+		err := tx.QueryRow(`SELECT status FROM games WHERE id = $1`, game.ID).Scan(&status)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if status.String == "finished" {
+			return nil
+		}
+
+		if err := saveGame(tx, game); err != nil {
+			return err
+		}
+		for _, move := range moves {
+			if err := saveMove(tx, game.ID, move); err != nil {
+				return err
+			}
+		}
+		for _, p := range players {
+			if err := updatePlayerStats(tx, p.Username, p.Won, p.Drawn, p.Moves); err != nil {
+				return err
+			}
+			if err := updateRating(tx, p.Username, game.ID, p.RatingDelta); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM live_games WHERE game_id = $1`, game.ID)
+		return err
+	})
+}
+
+const (
+	maxTxAttempts = 5
+	txRetryDelay  = 20 * time.Millisecond
+)
+
+// retryTx runs fn in a transaction, serializable on Postgres, and commits
+// it. It starts over, after a short and growing pause, when the transaction
+// fails in a way that succeeds if simply tried again.
+func (d *Database) retryTx(fn func(tx *sql.Tx) error) error {
+	opts := &sql.TxOptions{}
+	if d.dialect == StorePostgres {
+		opts.Isolation = sql.LevelSerializable
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		if err = d.runTx(opts, fn); err == nil || !retryable(err) {
+			return err
+		}
+		log.Printf("Retrying transaction after attempt %d: %v", attempt, err)
+		time.Sleep(time.Duration(attempt) * txRetryDelay)
+	}
+	return err
+}
+
+func (d *Database) runTx(opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryable reports whether err is a serialization failure or deadlock on
+// Postgres, or a locked database on SQLite.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code() & 0xff // primary result code
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+	return false
+}
+
+// updatePlayerStats counts a finished game, in which the player made moves
+// moves, towards their stats. Streaks count consecutive wins.
+func updatePlayerStats(ex execer, username string, won bool, drawn bool, moves int) error {
 	// Ensure player exists
-	_, err := d.db.Exec(`
+	_, err := ex.Exec(`
 		INSERT INTO players (username, games_played, games_won, games_lost, games_drawn)
 		VALUES ($1, 0, 0, 0, 0)
 		ON CONFLICT (username) DO NOTHING
@@ -108,67 +253,605 @@ func (d *Database) UpdatePlayerStats(username string, won bool, drawn bool) erro
 
 	// Update stats
 	if drawn {
-		_, err = d.db.Exec(`
+		_, err = ex.Exec(`
 			UPDATE players SET
 				games_played = games_played + 1,
-				games_drawn = games_drawn + 1
+				games_drawn = games_drawn + 1,
+				total_moves = total_moves + $2,
+				current_streak = 0
 			WHERE username = $1
-		`, username)
+		`, username, moves)
 	} else if won {
-		_, err = d.db.Exec(`
+		_, err = ex.Exec(`
 			UPDATE players SET
 				games_played = games_played + 1,
-				games_won = games_won + 1
+				games_won = games_won + 1,
+				total_moves = total_moves + $2,
+				current_streak = current_streak + 1,
+				best_streak = CASE WHEN current_streak + 1 > best_streak THEN current_streak + 1 ELSE best_streak END
 			WHERE username = $1
-		`, username)
+		`, username, moves)
 	} else {
-		_, err = d.db.Exec(`
+		_, err = ex.Exec(`
 			UPDATE players SET
 				games_played = games_played + 1,
-				games_lost = games_lost + 1
+				games_lost = games_lost + 1,
+				total_moves = total_moves + $2,
+				current_streak = 0
 			WHERE username = $1
-		`, username)
+		`, username, moves)
 	}
 
 	return err
 }
 
-func (d *Database) GetLeaderboard(limit int) ([]LeaderboardEntry, error) {
+// GetRating returns the player's current rating, or DefaultRating if they
+// have not finished a game yet.
+func (d *Database) GetRating(username string) (int, error) {
+	var rating int
+	err := d.db.QueryRow(`SELECT rating FROM players WHERE username = $1`, username).Scan(&rating)
+	if err == sql.ErrNoRows {
+		return DefaultRating, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rating, nil
+}
+
+// updateRating applies a rating change from gameID to an existing player and
+// records the new rating in their history.
+func updateRating(ex execer, username, gameID string, delta int) error {
+	var rating int
+	err := ex.QueryRow(`UPDATE players SET rating = rating + $2 WHERE username = $1 RETURNING rating`, username, delta).Scan(&rating)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(`
+		INSERT INTO rating_history (username, game_id, rating, delta, recorded_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, username, gameID, rating, delta, time.Now())
+	return err
+}
+
+// CreateAccount registers a username with its bcrypt password hash.
+func (d *Database) CreateAccount(username, passwordHash string) error {
+	result, err := d.db.Exec(`
+		INSERT INTO accounts (username, password_hash, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username) DO NOTHING
+	`, username, passwordHash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAccountExists
+	}
+	return nil
+}
+
+func (d *Database) GetPasswordHash(username string) (string, error) {
+	var hash string
+	err := d.db.QueryRow(`SELECT password_hash FROM accounts WHERE username = $1`, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrAccountNotFound
+	}
+	return hash, err
+}
+
+// ClaimGuest turns a guest into a registered account, moving the guest's
+// stats, game history and chat to the new username and revoking the guest's
+// sessions.
+func (d *Database) ClaimGuest(guestID, username, passwordHash string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO accounts (username, password_hash, claimed_from, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO NOTHING
+	`, username, passwordHash, guestID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAccountExists
+	}
+
+	// A name with history of its own belongs to someone else
+	var hasHistory bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM players WHERE username = $1)`, username).Scan(&hasHistory); err != nil {
+		return err
+	}
+	if hasHistory {
+		return ErrAccountExists
+	}
+
+	renames := []string{
+		`UPDATE players SET username = $1 WHERE username = $2`,
+		`UPDATE games SET player1_username = $1 WHERE player1_username = $2`,
+		`UPDATE games SET player2_username = $1 WHERE player2_username = $2`,
+		`UPDATE chat_messages SET username = $1 WHERE username = $2`,
+		`UPDATE rating_history SET username = $1 WHERE username = $2`,
+		`UPDATE season_standings SET username = $1 WHERE username = $2`,
+	}
+	for _, query := range renames {
+		if _, err := tx.Exec(query, username, guestID); err != nil {
+			return err
+		}
+	}
+
+	// The guest's sessions end with the rename, as if it had been deleted
+	if _, err := tx.Exec(`
+		INSERT INTO deleted_guests (guest_id, deleted_at) VALUES ($1, $2)
+		ON CONFLICT (guest_id) DO NOTHING
+	`, guestID, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GuestClaimed reports whether a guest ID has been upgraded to an account.
+func (d *Database) GuestClaimed(guestID string) (bool, error) {
+	var claimed bool
+	err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM accounts WHERE claimed_from = $1)`, guestID).Scan(&claimed)
+	return claimed, err
+}
+
+// GetAccount returns the registered account called username.
+func (d *Database) GetAccount(username string) (*Account, error) {
+	account := Account{Username: username}
+	var created sql.NullTime
+	var claimedFrom sql.NullString
+	err := d.db.QueryRow(`
+		SELECT created_at, claimed_from FROM accounts WHERE username = $1
+	`, username).Scan(&created, &claimedFrom)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	account.CreatedAt = created.Time
+	account.ClaimedFrom = claimedFrom.String
+	return &account, nil
+}
+
+// ExportPlayerData collects everything stored about username.
+func (d *Database) ExportPlayerData(username string) (*PlayerData, error) {
+	data := &PlayerData{
+		Username:        username,
+		RatingHistory:   []RatingPoint{},
+		SeasonStandings: []SeasonStanding{},
+		Games:           []GameRecord{},
+		Chat:            []ChatMessage{},
+	}
+
+	var err error
+	if data.Account, err = d.GetAccount(username); err != nil && !errors.Is(err, ErrAccountNotFound) {
+		return nil, err
+	}
+	if data.Stats, err = d.GetPlayerStats(username); err != nil && !errors.Is(err, ErrPlayerNotFound) {
+		return nil, err
+	}
+	// Any ban, including one that has expired
+	if data.Ban, err = d.GetBan(username, time.Time{}); err != nil {
+		return nil, err
+	}
+
 	rows, err := d.db.Query(`
-		SELECT username, games_played, games_won, games_lost, games_drawn
-		FROM players
-		WHERE username != 'BOT' AND games_played > 0
-		ORDER BY games_won DESC, (games_won::float / NULLIF(games_played, 0)) DESC, games_played DESC
-		LIMIT $1
-	`, limit)
+		SELECT COALESCE(game_id, ''), rating, delta, recorded_at
+		FROM rating_history
+		WHERE username = $1
+		ORDER BY recorded_at, id
+	`, username)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	for rows.Next() {
+		var p RatingPoint
+		if err := rows.Scan(&p.GameID, &p.Rating, &p.Delta, &p.RecordedAt); err != nil {
+			return nil, err
+		}
+		data.RatingHistory = append(data.RatingHistory, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	var leaderboard []LeaderboardEntry
+	rows, err = d.db.Query(`
+		SELECT season_id, rank, username, games_played, games_won, games_lost, games_drawn, rating
+		FROM season_standings
+		WHERE username = $1
+		ORDER BY season_id
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s SeasonStanding
+		if err := rows.Scan(&s.SeasonID, &s.Rank, &s.Username, &s.GamesPlayed, &s.GamesWon, &s.GamesLost, &s.GamesDrawn, &s.Rating); err != nil {
+			return nil, err
+		}
+		if s.GamesPlayed > 0 {
+			s.WinRate = float64(s.GamesWon) / float64(s.GamesPlayed)
+		}
+		data.SeasonStandings = append(data.SeasonStandings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = d.db.Query(`
+		SELECT `+gameColumns+`
+		FROM games
+		WHERE player1_username = $1 OR player2_username = $1
+		ORDER BY start_time, id
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	index := make(map[string]int)
+	for rows.Next() {
+		g, err := scanGameRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		index[g.ID] = len(data.Games)
+		data.Games = append(data.Games, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = d.db.Query(`
+		SELECT game_id, move_num, player_num, column_index, row_index, played_at
+		FROM moves
+		WHERE game_id IN (SELECT id FROM games WHERE player1_username = $1 OR player2_username = $1)
+		ORDER BY game_id, move_num
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var gameID string
+		var m MoveRecord
+		if err := rows.Scan(&gameID, &m.MoveNum, &m.PlayerNum, &m.Column, &m.Row, &m.PlayedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := index[gameID]; ok {
+			data.Games[i].Moves = append(data.Games[i].Moves, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = d.db.Query(`
+		SELECT game_id, username, message, COALESCE(original_message, ''), flagged, created_at
+		FROM chat_messages
+		WHERE username = $1
+		ORDER BY created_at, id
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg ChatMessage
+		if err := rows.Scan(&msg.GameID, &msg.Username, &msg.Text, &msg.Original, &msg.Flagged, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		data.Chat = append(data.Chat, msg)
+	}
+	return data, rows.Err()
+}
+
+// DeletePlayerData removes username's account, ban and chat, and renames
+// them to anonymousID everywhere else, so that their games still count in
+// everyone's stats. A guest ID is remembered as deleted, and with
+// notifyAnalytics the deletion is kept until analytics has been told. It
+// reports whether anything was stored about them.
+func (d *Database) DeletePlayerData(username, anonymousID string, notifyAnalytics bool) (bool, error) {
+	deletes := []string{
+		`DELETE FROM accounts WHERE username = $1`,
+		`DELETE FROM bans WHERE username = $1`,
+		`DELETE FROM chat_messages WHERE username = $1`,
+	}
+	renames := []string{
+		`UPDATE players SET username = $1 WHERE username = $2`,
+		`UPDATE games SET player1_username = $1 WHERE player1_username = $2`,
+		`UPDATE games SET player2_username = $1 WHERE player2_username = $2`,
+		`UPDATE rating_history SET username = $1 WHERE username = $2`,
+		`UPDATE season_standings SET username = $1 WHERE username = $2`,
+	}
+
+	var found bool
+	err := d.retryTx(func(tx *sql.Tx) error {
+		found = false
+		count := func(res sql.Result) {
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				found = true
+			}
+		}
+		for _, query := range deletes {
+			res, err := tx.Exec(query, username)
+			if err != nil {
+				return err
+			}
+			count(res)
+		}
+		for _, query := range renames {
+			res, err := tx.Exec(query, anonymousID, username)
+			if err != nil {
+				return err
+			}
+			count(res)
+		}
+
+		now := time.Now().UTC()
+		// Guest IDs are random and name no one, so they can be kept
+		if strings.HasPrefix(username, guestPrefix) {
+			if _, err := tx.Exec(`
+				INSERT INTO deleted_guests (guest_id, deleted_at) VALUES ($1, $2)
+				ON CONFLICT (guest_id) DO NOTHING
+			`, username, now); err != nil {
+				return err
+			}
+		}
+		if found && notifyAnalytics {
+			if _, err := tx.Exec(`
+				INSERT INTO pending_erasures (anonymous_id, username, created_at) VALUES ($1, $2, $3)
+			`, anonymousID, username, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// GuestRevoked reports whether a guest ID has been deleted or claimed.
+func (d *Database) GuestRevoked(guestID string) (bool, error) {
+	var deleted bool
+	err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM deleted_guests WHERE guest_id = $1)`, guestID).Scan(&deleted)
+	return deleted, err
+}
+
+// PendingErasures returns the deletions analytics has not been told about
+// yet, oldest first.
+func (d *Database) PendingErasures() ([]PlayerDeletion, error) {
+	rows, err := d.db.Query(`SELECT username, anonymous_id, created_at FROM pending_erasures ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var erasures []PlayerDeletion
+	for rows.Next() {
+		var e PlayerDeletion
+		if err := rows.Scan(&e.Username, &e.AnonymousID, &e.DeletedAt); err != nil {
+			return nil, err
+		}
+		erasures = append(erasures, e)
+	}
+	return erasures, rows.Err()
+}
+
+// DeletePendingErasure forgets a deletion once analytics has been told.
+func (d *Database) DeletePendingErasure(anonymousID string) error {
+	_, err := d.db.Exec(`DELETE FROM pending_erasures WHERE anonymous_id = $1`, anonymousID)
+	return err
+}
+
+func (d *Database) SaveChatMessage(msg ChatMessage) error {
+	var original sql.NullString
+	if msg.Original != "" {
+		original = sql.NullString{String: msg.Original, Valid: true}
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO chat_messages (game_id, username, message, original_message, flagged, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, msg.GameID, msg.Username, msg.Text, original, msg.Flagged, msg.CreatedAt)
+	return err
+}
+
+// Leaderboard sort keys.
+const (
+	SortWins    = "wins"
+	SortWinRate = "winrate"
+	SortRating  = "rating"
+	SortStreak  = "streak"
+)
+
+// Leaderboard time windows.
+const (
+	WindowAll    = "all"
+	WindowMonth  = "month"  // the last 30 days
+	WindowWeek   = "week"   // the last 7 days
+	WindowSeason = "season" // the running season
+)
+
+// LeaderboardQuery selects a page of the leaderboard. Around, when set,
+// replaces Offset with a page centered on that player. From and To, when
+// set, count only games that ended in [From, To) instead of Window.
+type LeaderboardQuery struct {
+	Sort     string
+	MinGames int // only applies to SortWinRate
+	Window   string
+	From, To time.Time
+	Variant  string
+	Around   string
+	Limit    int
+	Offset   int
+}
+
+var leaderboardOrder = map[string]string{
+	SortWins:    "s.won DESC, s.won * 1.0 / s.played DESC, s.played DESC",
+	SortWinRate: "s.won * 1.0 / s.played DESC, s.won DESC",
+	SortRating:  "p.rating DESC, s.won DESC",
+	SortStreak:  "p.current_streak DESC, p.best_streak DESC, s.won DESC",
+}
+
+// gameStatsQuery sums up each player's results over the games matching where.
+func gameStatsQuery(where string) string {
+	return `
+		SELECT username, COUNT(*) AS played, SUM(won) AS won, SUM(lost) AS lost, SUM(drawn) AS drawn
+		FROM (
+			SELECT player1_username AS username,
+				CASE WHEN winner = 1 THEN 1 ELSE 0 END AS won,
+				CASE WHEN winner = 2 THEN 1 ELSE 0 END AS lost,
+				CASE WHEN winner = 0 THEN 1 ELSE 0 END AS drawn
+			FROM games WHERE ` + where + `
+			UNION ALL
+			SELECT player2_username,
+				CASE WHEN winner = 2 THEN 1 ELSE 0 END,
+				CASE WHEN winner = 1 THEN 1 ELSE 0 END,
+				CASE WHEN winner = 0 THEN 1 ELSE 0 END
+			FROM games WHERE ` + where + `
+		) results
+		GROUP BY username`
+}
+
+// GetLeaderboard returns one page of ranked players and how many are ranked
+// in all. Games played within a time window or a single variant are counted
+// from the games table; rating and streaks are always the current ones.
+// Around a player who is not ranked, ErrPlayerNotFound is returned.
+func (d *Database) GetLeaderboard(q LeaderboardQuery) ([]LeaderboardEntry, int, error) {
+	order, ok := leaderboardOrder[q.Sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	from, to := q.From, q.To
+	if from.IsZero() && to.IsZero() {
+		switch q.Window {
+		case WindowMonth:
+			from = time.Now().AddDate(0, 0, -30)
+		case WindowWeek:
+			from = time.Now().AddDate(0, 0, -7)
+		}
+	}
+
+	stats := `SELECT username, games_played AS played, games_won AS won, games_lost AS lost, games_drawn AS drawn FROM players`
+	if !from.IsZero() || !to.IsZero() || q.Variant != "" {
+		cond := []string{"status = 'finished'"}
+		if !from.IsZero() {
+			cond = append(cond, "end_time >= "+arg(from))
+		}
+		if !to.IsZero() {
+			cond = append(cond, "end_time < "+arg(to))
+		}
+		if q.Variant != "" {
+			// Games from before variants were recorded are standard ones
+			cond = append(cond, "COALESCE(variant, "+arg(VariantStandard)+") = "+arg(q.Variant))
+		}
+		stats = gameStatsQuery(strings.Join(cond, " AND "))
+	}
+
+	minGames := 1
+	if q.Sort == SortWinRate && q.MinGames > 1 {
+		minGames = q.MinGames
+	}
+	ranked := `
+		WITH ranked AS (
+			SELECT s.username, s.played, s.won, s.lost, s.drawn, p.rating, p.current_streak, p.best_streak,
+				ROW_NUMBER() OVER (ORDER BY ` + order + `, s.username) AS rank
+			FROM (` + stats + `) s
+			JOIN players p ON p.username = s.username
+			WHERE s.username != 'BOT' AND s.played >= ` + arg(minGames) + `
+		)`
+
+	var total int
+	if err := d.db.QueryRow(ranked+` SELECT COUNT(*) FROM ranked`, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	offset := q.Offset
+	if q.Around != "" {
+		var center int
+		err := d.db.QueryRow(ranked+` SELECT rank FROM ranked WHERE username = `+arg(q.Around), args...).Scan(&center)
+		if err == sql.ErrNoRows {
+			return nil, total, ErrPlayerNotFound
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = aroundOffset(center, q.Limit, total)
+	}
+	page := `rank > ` + arg(offset) + ` AND rank <= ` + arg(offset+q.Limit)
+
+	rows, err := d.db.Query(ranked+`
+		SELECT rank, username, played, won, lost, drawn, rating, current_streak, best_streak
+		FROM ranked
+		WHERE `+page+`
+		ORDER BY rank
+	`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	leaderboard := []LeaderboardEntry{}
 	for rows.Next() {
 		var entry LeaderboardEntry
-		if err := rows.Scan(&entry.Username, &entry.GamesPlayed, &entry.GamesWon, &entry.GamesLost, &entry.GamesDrawn); err != nil {
+		if err := rows.Scan(&entry.Rank, &entry.Username, &entry.GamesPlayed, &entry.GamesWon, &entry.GamesLost, &entry.GamesDrawn,
+			&entry.Rating, &entry.CurrentStreak, &entry.BestStreak); err != nil {
 			log.Printf("Error scanning leaderboard entry: %v", err)
 			continue
 		}
+		entry.WinRate = float64(entry.GamesWon) / float64(entry.GamesPlayed)
 		leaderboard = append(leaderboard, entry)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-	return leaderboard, nil
+	return leaderboard, total, nil
+}
+
+// aroundOffset returns the offset of a page of limit players out of total
+// that centers the player ranked center, moved as needed to stay full at the
+// top and bottom of the leaderboard.
+func aroundOffset(center, limit, total int) int {
+	offset := center - 1 - limit/2
+	if offset > total-limit {
+		offset = total - limit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
 }
 
 func (d *Database) GetPlayerStats(username string) (*PlayerStats, error) {
 	var stats PlayerStats
 	err := d.db.QueryRow(`
-		SELECT username, games_played, games_won, games_lost, games_drawn, total_moves, created_at
+		SELECT username, games_played, games_won, games_lost, games_drawn, total_moves, rating, current_streak, best_streak, created_at
 		FROM players
 		WHERE username = $1
-	`, username).Scan(&stats.Username, &stats.GamesPlayed, &stats.GamesWon, &stats.GamesLost, &stats.GamesDrawn, &stats.TotalMoves, &stats.CreatedAt)
+	`, username).Scan(&stats.Username, &stats.GamesPlayed, &stats.GamesWon, &stats.GamesLost, &stats.GamesDrawn, &stats.TotalMoves,
+		&stats.Rating, &stats.CurrentStreak, &stats.BestStreak, &stats.CreatedAt)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("player not found")
+		return nil, ErrPlayerNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -177,24 +860,675 @@ func (d *Database) GetPlayerStats(username string) (*PlayerStats, error) {
 	return &stats, nil
 }
 
+// pingTimeout bounds Ping, which health checks wait on.
+const pingTimeout = 2 * time.Second
+
+func (d *Database) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return d.db.PingContext(ctx)
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
 type LeaderboardEntry struct {
-	Username    string `json:"username"`
-	GamesPlayed int    `json:"gamesPlayed"`
-	GamesWon    int    `json:"gamesWon"`
-	GamesLost   int    `json:"gamesLost"`
-	GamesDrawn  int    `json:"gamesDrawn"`
+	Rank          int     `json:"rank"`
+	Username      string  `json:"username"`
+	GamesPlayed   int     `json:"gamesPlayed"`
+	GamesWon      int     `json:"gamesWon"`
+	GamesLost     int     `json:"gamesLost"`
+	GamesDrawn    int     `json:"gamesDrawn"`
+	WinRate       float64 `json:"winRate"`
+	Rating        int     `json:"rating"`
+	CurrentStreak int     `json:"currentStreak"`
+	BestStreak    int     `json:"bestStreak"`
 }
 
 type PlayerStats struct {
-	Username    string    `json:"username"`
-	GamesPlayed int       `json:"gamesPlayed"`
-	GamesWon    int       `json:"gamesWon"`
-	GamesLost   int       `json:"gamesLost"`
-	GamesDrawn  int       `json:"gamesDrawn"`
-	TotalMoves  int       `json:"totalMoves"`
-	CreatedAt   time.Time `json:"createdAt"`
+	Username      string    `json:"username"`
+	GamesPlayed   int       `json:"gamesPlayed"`
+	GamesWon      int       `json:"gamesWon"`
+	GamesLost     int       `json:"gamesLost"`
+	GamesDrawn    int       `json:"gamesDrawn"`
+	TotalMoves    int       `json:"totalMoves"`
+	Rating        int       `json:"rating"`
+	CurrentStreak int       `json:"currentStreak"`
+	BestStreak    int       `json:"bestStreak"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// ErrPlayerNotFound is returned for a username that has never finished a game.
+var ErrPlayerNotFound = errors.New("player not found")
+
+// RatingPoint is a player's rating after one rated game.
+type RatingPoint struct {
+	GameID     string    `json:"gameId,omitempty"`
+	Rating     int       `json:"rating"`
+	Delta      int       `json:"delta"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+// GameAverages describes a player's typical finished game.
+type GameAverages struct {
+	Moves        float64 `json:"moves"`
+	DurationSecs float64 `json:"durationSecs"`
+}
+
+// GetRatingHistory returns the player's last limit ratings, oldest first.
+func (d *Database) GetRatingHistory(username string, limit int) ([]RatingPoint, error) {
+	rows, err := d.db.Query(`
+		SELECT game_id, rating, delta, recorded_at FROM (
+			SELECT COALESCE(game_id, '') AS game_id, rating, delta, recorded_at, id
+			FROM rating_history
+			WHERE username = $1
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT $2
+		) recent
+		ORDER BY recorded_at, id
+	`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []RatingPoint{}
+	for rows.Next() {
+		var p RatingPoint
+		if err := rows.Scan(&p.GameID, &p.Rating, &p.Delta, &p.RecordedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, p)
+	}
+	return history, rows.Err()
+}
+
+// GetFavoriteOpening returns the column the player most often plays as their
+// first move, or -1 if no moves of theirs are stored.
+func (d *Database) GetFavoriteOpening(username string) (int, error) {
+	var column int
+	err := d.db.QueryRow(`
+		SELECT m.column_index
+		FROM moves m
+		JOIN games g ON g.id = m.game_id
+		WHERE m.move_num <= 2 AND (
+			(g.player1_username = $1 AND m.player_num = 1) OR
+			(g.player2_username = $1 AND m.player_num = 2))
+		GROUP BY m.column_index
+		ORDER BY COUNT(*) DESC, m.column_index
+		LIMIT 1
+	`, username).Scan(&column)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return column, err
+}
+
+// GetGameAverages returns the average length of the player's finished games.
+func (d *Database) GetGameAverages(username string) (GameAverages, error) {
+	var avg GameAverages
+	var moves, duration sql.NullFloat64
+	err := d.db.QueryRow(`
+		SELECT AVG(move_count), AVG(duration_seconds)
+		FROM games
+		WHERE status = 'finished' AND (player1_username = $1 OR player2_username = $1)
+	`, username).Scan(&moves, &duration)
+	avg.Moves, avg.DurationSecs = moves.Float64, duration.Float64
+	return avg, err
+}
+
+// LiveGame is the stored snapshot of an in-progress game.
+type LiveGame struct {
+	GameID    string
+	State     []byte
+	UpdatedAt time.Time
+}
+
+// SaveLiveGame stores the latest snapshot of an in-progress game owned by
+// instanceID.
+func (d *Database) SaveLiveGame(gameID, instanceID string, state []byte, updatedAt time.Time) error {
+	_, err := d.db.Exec(`
+		INSERT INTO live_games (game_id, instance_id, state, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (game_id) DO UPDATE SET
+			instance_id = EXCLUDED.instance_id,
+			state = EXCLUDED.state,
+			updated_at = EXCLUDED.updated_at
+	`, gameID, instanceID, string(state), updatedAt)
+	return err
+}
+
+// DeleteLiveGame forgets the snapshot of a game that has ended.
+func (d *Database) DeleteLiveGame(gameID string) error {
+	_, err := d.db.Exec(`DELETE FROM live_games WHERE game_id = $1`, gameID)
+	return err
+}
+
+// LoadLiveGames returns the stored snapshots of instanceID's games, or every
+// snapshot if instanceID is empty. Games saved before instances were recorded
+// belong to everyone.
+func (d *Database) LoadLiveGames(instanceID string) ([]LiveGame, error) {
+	rows, err := d.db.Query(`
+		SELECT game_id, state, updated_at FROM live_games
+		WHERE $1 = '' OR instance_id = $1 OR instance_id IS NULL
+	`, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var games []LiveGame
+	for rows.Next() {
+		var g LiveGame
+		if err := rows.Scan(&g.GameID, &g.State, &g.UpdatedAt); err != nil {
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+// SaveBan bans a username, replacing any earlier ban.
+func (d *Database) SaveBan(ban Ban) error {
+	var expires sql.NullTime
+	if ban.ExpiresAt != nil {
+		expires = sql.NullTime{Time: *ban.ExpiresAt, Valid: true}
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO bans (username, reason, expires_at, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET
+			reason = EXCLUDED.reason,
+			expires_at = EXCLUDED.expires_at,
+			created_at = EXCLUDED.created_at
+	`, ban.Username, ban.Reason, expires, ban.CreatedAt)
+	return err
+}
+
+// DeleteBan lifts the ban on username, reporting whether there was one.
+func (d *Database) DeleteBan(username string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM bans WHERE username = $1`, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetBan returns the ban in force on username at now, or nil.
+func (d *Database) GetBan(username string, now time.Time) (*Ban, error) {
+	ban := Ban{Username: username}
+	var expires sql.NullTime
+	err := d.db.QueryRow(`
+		SELECT reason, expires_at, created_at FROM bans
+		WHERE username = $1 AND (expires_at IS NULL OR expires_at > $2)
+	`, username, now).Scan(&ban.Reason, &expires, &ban.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expires.Valid {
+		ban.ExpiresAt = &expires.Time
+	}
+	return &ban, nil
+}
+
+// ListBans returns the bans in force at now, newest first.
+func (d *Database) ListBans(now time.Time) ([]Ban, error) {
+	rows, err := d.db.Query(`
+		SELECT username, reason, expires_at, created_at FROM bans
+		WHERE expires_at IS NULL OR expires_at > $1
+		ORDER BY created_at DESC
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var ban Ban
+		var expires sql.NullTime
+		if err := rows.Scan(&ban.Username, &ban.Reason, &expires, &ban.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			ban.ExpiresAt = &expires.Time
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// MoveRecord is one stored move, numbered from 1.
+type MoveRecord struct {
+	MoveNum   int       `json:"moveNum"`
+	PlayerNum int       `json:"playerNum"`
+	Column    int       `json:"column"`
+	Row       int       `json:"row"`
+	PlayedAt  time.Time `json:"playedAt"`
+}
+
+// GameRecord is a stored game. Moves is only filled in by GetGame.
+type GameRecord struct {
+	ID           string       `json:"id"`
+	Player1      string       `json:"player1"`
+	Player2      string       `json:"player2"`
+	Winner       int          `json:"winner"` // 0 for a draw or a game not finished
+	WinnerName   string       `json:"winnerName,omitempty"`
+	Status       string       `json:"status"`
+	StartTime    time.Time    `json:"startTime"`
+	EndTime      *time.Time   `json:"endTime,omitempty"`
+	MoveCount    int          `json:"moveCount"`
+	DurationSecs int          `json:"durationSecs"`
+	Options      MatchOptions `json:"options"`
+	Moves        []MoveRecord `json:"moves,omitempty"`
+}
+
+// GameFilter narrows down a player's game history.
+type GameFilter struct {
+	Result   string // "win", "loss" or "draw" from the player's side; empty for all
+	Opponent string
+	Limit    int
+	Offset   int
+}
+
+// SaveMove stores a move as it is played.
+func (d *Database) SaveMove(gameID string, move MoveRecord) error {
+	return saveMove(d.db, gameID, move)
+}
+
+func saveMove(ex execer, gameID string, move MoveRecord) error {
+	_, err := ex.Exec(`
+		INSERT INTO moves (game_id, move_num, player_num, column_index, row_index, played_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (game_id, move_num) DO NOTHING
+	`, gameID, move.MoveNum, move.PlayerNum, move.Column, move.Row, move.PlayedAt)
+	return err
+}
+
+const gameColumns = `id, player1_username, player2_username, winner, status, start_time, end_time,
+	move_count, duration_seconds, board_size, variant, time_control`
+
+func scanGameRecord(scan func(dest ...interface{}) error, extra ...interface{}) (GameRecord, error) {
+	var g GameRecord
+	var p1, p2, status, boardSize, variant, timeControl sql.NullString
+	var winner, moveCount, duration sql.NullInt64
+	var start, end sql.NullTime
+
+	dest := []interface{}{&g.ID, &p1, &p2, &winner, &status, &start, &end, &moveCount, &duration, &boardSize, &variant, &timeControl}
+	if err := scan(append(dest, extra...)...); err != nil {
+		return g, err
+	}
+
+	g.Player1, g.Player2, g.Status = p1.String, p2.String, status.String
+	g.Winner = int(winner.Int64)
+	g.StartTime = start.Time
+	// Games still in progress are saved with a zero end time
+	if end.Valid && !end.Time.IsZero() && end.Time.Year() > 1 {
+		g.EndTime = &end.Time
+	}
+	g.MoveCount = int(moveCount.Int64)
+	g.DurationSecs = int(duration.Int64)
+	g.Options = MatchOptions{BoardSize: boardSize.String, Variant: variant.String, TimeControl: timeControl.String}
+	if g.Status == "finished" {
+		switch g.Winner {
+		case Player1:
+			g.WinnerName = g.Player1
+		case Player2:
+			g.WinnerName = g.Player2
+		}
+	}
+	return g, nil
+}
+
+// GetPlayerGames returns a page of username's games, newest first, and the
+// number of games matching the filter.
+func (d *Database) GetPlayerGames(username string, f GameFilter) ([]GameRecord, int, error) {
+	where := []string{"(player1_username = $1 OR player2_username = $1)"}
+	args := []interface{}{username}
+
+	if f.Opponent != "" {
+		args = append(args, f.Opponent)
+		n := len(args)
+		where = append(where, fmt.Sprintf("((player1_username = $1 AND player2_username = $%d) OR (player2_username = $1 AND player1_username = $%d))", n, n))
+	}
+
+	won := "((player1_username = $1 AND winner = 1) OR (player2_username = $1 AND winner = 2))"
+	switch f.Result {
+	case "win":
+		where = append(where, "status = 'finished' AND "+won)
+	case "loss":
+		where = append(where, "status = 'finished' AND winner <> 0 AND NOT "+won)
+	case "draw":
+		where = append(where, "status = 'finished' AND winner = 0")
+	}
+
+	args = append(args, f.Limit, f.Offset)
+	query := fmt.Sprintf(`
+		SELECT %s, COUNT(*) OVER ()
+		FROM games
+		WHERE %s
+		ORDER BY start_time DESC, id
+		LIMIT $%d OFFSET $%d
+	`, gameColumns, strings.Join(where, " AND "), len(args)-1, len(args))
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	games := []GameRecord{}
+	total := 0
+	for rows.Next() {
+		g, err := scanGameRecord(rows.Scan, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		games = append(games, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// A page past the end has no rows to carry the total
+	if len(games) == 0 && f.Offset > 0 {
+		countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM games WHERE %s`, strings.Join(where, " AND "))
+		if err := d.db.QueryRow(countQuery, args[:len(args)-2]...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+	return games, total, nil
+}
+
+// HeadToHead is the record of a's finished games against b.
+type HeadToHead struct {
+	Games        int          `json:"games"`
+	WinsA        int          `json:"winsA"`
+	WinsB        int          `json:"winsB"`
+	Draws        int          `json:"draws"`
+	AverageGame  GameAverages `json:"averageGame"`
+	FirstA       FirstPlayer  `json:"asFirstA"` // games in which a moved first
+	FirstB       FirstPlayer  `json:"asFirstB"`
+	FirstWinRate float64      `json:"firstPlayerWinRate"`
+}
+
+// FirstPlayer counts how one player did when moving first.
+type FirstPlayer struct {
+	Games int `json:"games"`
+	Wins  int `json:"wins"`
+}
+
+// GetHeadToHead sums up the finished games between a and b.
+func (d *Database) GetHeadToHead(a, b string) (HeadToHead, error) {
+	var h HeadToHead
+	var moves, duration sql.NullFloat64
+	err := d.db.QueryRow(`
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE (player1_username = $1 AND winner = 1) OR (player2_username = $1 AND winner = 2)),
+			COUNT(*) FILTER (WHERE (player1_username = $2 AND winner = 1) OR (player2_username = $2 AND winner = 2)),
+			COUNT(*) FILTER (WHERE winner = 0),
+			AVG(move_count),
+			AVG(duration_seconds),
+			COUNT(*) FILTER (WHERE player1_username = $1),
+			COUNT(*) FILTER (WHERE player1_username = $1 AND winner = 1),
+			COUNT(*) FILTER (WHERE player1_username = $2),
+			COUNT(*) FILTER (WHERE player1_username = $2 AND winner = 1)
+		FROM games
+		WHERE status = 'finished' AND (
+			(player1_username = $1 AND player2_username = $2) OR
+			(player1_username = $2 AND player2_username = $1))
+	`, a, b).Scan(&h.Games, &h.WinsA, &h.WinsB, &h.Draws, &moves, &duration,
+		&h.FirstA.Games, &h.FirstA.Wins, &h.FirstB.Games, &h.FirstB.Wins)
+	if err != nil {
+		return h, err
+	}
+
+	h.AverageGame = GameAverages{Moves: moves.Float64, DurationSecs: duration.Float64}
+	if h.Games > 0 {
+		h.FirstWinRate = float64(h.FirstA.Wins+h.FirstB.Wins) / float64(h.Games)
+	}
+	return h, nil
+}
+
+// GetGame returns a stored game with its moves, or nil if there is none.
+func (d *Database) GetGame(gameID string) (*GameRecord, error) {
+	row := d.db.QueryRow(`SELECT `+gameColumns+` FROM games WHERE id = $1`, gameID)
+	g, err := scanGameRecord(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(`
+		SELECT move_num, player_num, column_index, row_index, played_at
+		FROM moves
+		WHERE game_id = $1
+		ORDER BY move_num
+	`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	g.Moves = []MoveRecord{}
+	for rows.Next() {
+		var m MoveRecord
+		if err := rows.Scan(&m.MoveNum, &m.PlayerNum, &m.Column, &m.Row, &m.PlayedAt); err != nil {
+			return nil, err
+		}
+		g.Moves = append(g.Moves, m)
+	}
+	return &g, rows.Err()
+}
+
+// Season is one period of the ranked ladder, covering games that end in
+// [StartsAt, EndsAt).
+type Season struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	StartsAt   time.Time  `json:"startsAt"`
+	EndsAt     time.Time  `json:"endsAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`  // when ratings were reset for it
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"` // when its final standings were stored
+}
+
+// ErrSeasonOverlap is returned when a new season would overlap another.
+var ErrSeasonOverlap = errors.New("season overlaps an existing one")
+
+const seasonColumns = `id, name, starts_at, ends_at, started_at, archived_at`
+
+func scanSeason(scan func(dest ...interface{}) error) (Season, error) {
+	var s Season
+	var started, archived sql.NullTime
+	if err := scan(&s.ID, &s.Name, &s.StartsAt, &s.EndsAt, &started, &archived); err != nil {
+		return s, err
+	}
+	if started.Valid {
+		s.StartedAt = &started.Time
+	}
+	if archived.Valid {
+		s.ArchivedAt = &archived.Time
+	}
+	return s, nil
+}
+
+// CreateSeason adds a season that must not overlap any other.
+func (d *Database) CreateSeason(name string, startsAt, endsAt time.Time) (*Season, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var overlaps bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM seasons WHERE starts_at < $2 AND ends_at > $1)`, startsAt, endsAt).Scan(&overlaps)
+	if err != nil {
+		return nil, err
+	}
+	if overlaps {
+		return nil, ErrSeasonOverlap
+	}
+
+	season := Season{Name: name, StartsAt: startsAt, EndsAt: endsAt}
+	err = tx.QueryRow(`
+		INSERT INTO seasons (name, starts_at, ends_at) VALUES ($1, $2, $3)
+		ON CONFLICT (starts_at) DO NOTHING
+		RETURNING id
+	`, name, startsAt, endsAt).Scan(&season.ID)
+	if err == sql.ErrNoRows {
+		// Created at the same moment by another instance
+		return nil, ErrSeasonOverlap
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &season, tx.Commit()
+}
+
+// ListSeasons returns every season, oldest first.
+func (d *Database) ListSeasons() ([]Season, error) {
+	rows, err := d.db.Query(`SELECT ` + seasonColumns + ` FROM seasons ORDER BY starts_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seasons := []Season{}
+	for rows.Next() {
+		s, err := scanSeason(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+	return seasons, rows.Err()
+}
+
+// GetSeason returns a season, or nil if there is none with that ID.
+func (d *Database) GetSeason(id int) (*Season, error) {
+	s, err := scanSeason(d.db.QueryRow(`SELECT `+seasonColumns+` FROM seasons WHERE id = $1`, id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// StartSeason soft-resets every rating towards DefaultRating, keeping
+// carryover of its distance from it, and clears win streaks. It returns
+// false if the season had already been started, by this or another instance.
+func (d *Database) StartSeason(id int, carryover float64, now time.Time) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE seasons SET started_at = $2 WHERE id = $1 AND started_at IS NULL`, id, now)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	reset := `CAST(ROUND($1 + (rating - $1) * CAST($2 AS FLOAT)) AS INTEGER)`
+	_, err = tx.Exec(`
+		INSERT INTO rating_history (username, game_id, rating, delta, recorded_at)
+		SELECT username, NULL, reset, reset - rating, $3
+		FROM (SELECT username, rating, `+reset+` AS reset FROM players) r
+		WHERE reset <> rating
+	`, DefaultRating, carryover, now)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`UPDATE players SET rating = `+reset+`, current_streak = 0`, DefaultRating, carryover)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ArchiveSeason stores the final standings of an ended season, ranked by
+// wins, with each player's rating at the end of it. It returns false if the
+// season had already been archived or has not ended yet.
+func (d *Database) ArchiveSeason(id int, now time.Time) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var startsAt, endsAt time.Time
+	err = tx.QueryRow(`
+		UPDATE seasons SET archived_at = $2
+		WHERE id = $1 AND archived_at IS NULL AND ends_at <= $2
+		RETURNING starts_at, ends_at
+	`, id, now).Scan(&startsAt, &endsAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO season_standings (season_id, rank, username, games_played, games_won, games_lost, games_drawn, rating)
+		SELECT $1, ROW_NUMBER() OVER (ORDER BY `+leaderboardOrder[SortWins]+`, s.username),
+			s.username, s.played, s.won, s.lost, s.drawn, p.rating
+		FROM (`+gameStatsQuery("status = 'finished' AND end_time >= $2 AND end_time < $3")+`) s
+		JOIN players p ON p.username = s.username
+		WHERE s.username != 'BOT'
+	`, id, startsAt, endsAt)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetSeasonStandings returns a page of an archived season's final standings
+// and how many players it ranked.
+func (d *Database) GetSeasonStandings(id, limit, offset int) ([]LeaderboardEntry, int, error) {
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM season_standings WHERE season_id = $1`, id).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`
+		SELECT rank, username, games_played, games_won, games_lost, games_drawn, rating
+		FROM season_standings
+		WHERE season_id = $1
+		ORDER BY rank
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	standings := []LeaderboardEntry{}
+	for rows.Next() {
+		var entry LeaderboardEntry
+		if err := rows.Scan(&entry.Rank, &entry.Username, &entry.GamesPlayed, &entry.GamesWon, &entry.GamesLost, &entry.GamesDrawn, &entry.Rating); err != nil {
+			return nil, 0, err
+		}
+		if entry.GamesPlayed > 0 {
+			entry.WinRate = float64(entry.GamesWon) / float64(entry.GamesPlayed)
+		}
+		standings = append(standings, entry)
+	}
+	return standings, total, rows.Err()
 }
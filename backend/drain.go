@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// What happens to games still running when the drain deadline passes
+const (
+	DrainPersist    = "persist"    // snapshot them for recovery after the restart
+	DrainAdjudicate = "adjudicate" // end them now according to StaleGamePolicy
+)
+
+// Drain prepares the server to stop. New joins are refused and waiting
+// players sent away, everyone in a game is told a restart is coming, and
+// running games get until timeout to finish. Games still running then are
+// persisted or adjudicated according to DrainPolicy and their clients
+// disconnected. Reconnects keep working throughout.
+func (gs *GameServer) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	gs.mu.Lock()
+	gs.draining = true
+
+	for opts, queue := range gs.waitingPlayers {
+		for _, p := range queue {
+			gs.cluster.Dequeue(p.Username, p.Client.id)
+			sendError(p.Client, ErrCodeServerDraining, "Server is restarting, please join again in a moment")
+		}
+		delete(gs.waitingPlayers, opts)
+	}
+
+	notice := Message{
+		Type: "shutdown_pending",
+		Data: ShutdownPendingPayload{
+			Message:  "Server is restarting soon. Your game can continue until then.",
+			Deadline: deadline.Unix(),
+		},
+	}
+	for _, game := range gs.games {
+		if game.Status == "playing" {
+			gs.sendToParticipants(game, notice)
+		}
+	}
+	live := gs.liveGameCount()
+	gs.mu.Unlock()
+
+	log.Printf("Draining %d live games, waiting up to %v", live, timeout)
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		gs.mu.RLock()
+		live = gs.liveGameCount()
+		gs.mu.RUnlock()
+		if live == 0 {
+			break
+		}
+		<-ticker.C
+	}
+
+	gs.mu.Lock()
+
+	persist := gs.config.DrainPolicy == DrainPersist
+	if _, inMemory := gs.store.(*MemoryStore); persist && inMemory {
+		log.Println("Warning: the memory store does not survive a restart, adjudicating games instead")
+		persist = false
+	}
+
+	now := time.Now()
+	var kicked []*Client
+	for _, game := range gs.games {
+		if game.Status != "playing" {
+			continue
+		}
+
+		var payload ServerRestartingPayload
+		if persist {
+			gs.saveLiveGame(game)
+			payload = ServerRestartingPayload{
+				Message:   "Server is restarting. Reconnect in a moment to continue your game.",
+				Resumable: true,
+			}
+		} else {
+			gs.resolveStaleGame(game, now)
+			payload = ServerRestartingPayload{Message: "Server is restarting. Your game has been ended."}
+		}
+		bye := Message{Type: "server_restarting", Data: payload}
+
+		clients := make([]*Client, 0, 2+len(game.Spectators))
+		for _, p := range []*Player{game.Player1, game.Player2} {
+			if !p.IsBot && p.Connected && p.Client != nil {
+				clients = append(clients, p.Client)
+			}
+		}
+		for spectator := range game.Spectators {
+			clients = append(clients, spectator)
+		}
+		for _, c := range clients {
+			c.Kick(bye)
+		}
+		kicked = append(kicked, clients...)
+	}
+
+	// Players here whose game runs on another instance can carry on through
+	// any other instance
+	gs.routeMu.Lock()
+	for connID := range gs.routes {
+		if s := gs.sessions[connID]; s != nil {
+			s.client.Kick(Message{
+				Type: "server_restarting",
+				Data: ServerRestartingPayload{
+					Message:   "Server is restarting. Reconnect to continue your game.",
+					Resumable: true,
+				},
+			})
+			kicked = append(kicked, s.client)
+		}
+	}
+	gs.routeMu.Unlock()
+	gs.mu.Unlock()
+
+	// Give the goodbyes a chance to be written before the process exits
+	flushed := time.After(gs.config.WriteTimeout)
+	for _, c := range kicked {
+		select {
+		case <-c.Done():
+		case <-flushed:
+			return
+		}
+	}
+}
+
+// Draining reports whether Drain has been called.
+func (gs *GameServer) Draining() bool {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	return gs.draining
+}
+
+// liveGameCount returns the number of games being played. Caller must hold
+// gs.mu.
+func (gs *GameServer) liveGameCount() int {
+	n := 0
+	for _, game := range gs.games {
+		if game.Status == "playing" {
+			n++
+		}
+	}
+	return n
+}
+
+// sendToParticipants queues msg for both players and all spectators of game.
+// Caller must hold gs.mu.
+func (gs *GameServer) sendToParticipants(game *Game, msg Message) {
+	for _, p := range []*Player{game.Player1, game.Player2} {
+		if !p.IsBot && p.Connected && p.Client != nil {
+			p.Client.Send(msg)
+		}
+	}
+	for spectator := range game.Spectators {
+		spectator.Send(msg)
+	}
+}
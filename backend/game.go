@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -15,6 +17,15 @@ const (
 	Player2 = 2
 )
 
+// Reasons MakeMove refuses a move. Callers match them with errors.Is to tell
+// the player why their move was rejected.
+var (
+	ErrGameOver      = errors.New("game is over")
+	ErrNotYourTurn   = errors.New("not your turn")
+	ErrInvalidColumn = errors.New("invalid column")
+	ErrColumnFull    = errors.New("column is full")
+)
+
 type Game struct {
 	ID              string
 	Board           [Rows][Cols]int
@@ -26,16 +37,51 @@ type Game struct {
 	StartTime       time.Time
 	EndTime         time.Time
 	MoveCount       int
+	Moves           []int // columns played, in order
 	LastActivityTime time.Time
+	Options         MatchOptions
+	Spectators      map[*Client]string // client -> spectator name
 }
 
 type Player struct {
-	Username   string
-	PlayerNum  int
-	Conn       *websocket.Conn
-	IsBot      bool
-	Connected  bool
-	LastSeen   time.Time
+	Username      string
+	PlayerNum     int
+	Client        *Client
+	IsBot         bool
+	Connected     bool
+	LastSeen      time.Time
+	QueuedAt      time.Time    // when the player joined their queue
+	Options       MatchOptions // queue the player asked to be matched in
+	BotPolicy     BotPolicy
+	Rating        int           // rating when the player joined
+	BotDifficulty BotDifficulty // only set for bots
+	MutedUsers    map[string]bool // users whose chat this player has muted
+	ResumeToken   string          // secret needed to take this seat over again
+	LastMoveID    string          // request ID of the last move accepted from this player
+	LastMoveNum   int             // move number that request produced
+}
+
+func newResumeToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// checkResumeToken reports whether token grants this player's seat.
+func (p *Player) checkResumeToken(token string) bool {
+	if p == nil || p.ResumeToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(p.ResumeToken), []byte(token)) == 1
+}
+
+func opponentOf(playerNum int) int {
+	if playerNum == Player1 {
+		return Player2
+	}
+	return Player1
 }
 
 func NewGame(gameID string) *Game {
@@ -46,7 +92,36 @@ func NewGame(gameID string) *Game {
 		Status:          "waiting",
 		StartTime:       time.Now(),
 		LastActivityTime: time.Now(),
+		Spectators:      make(map[*Client]string),
+	}
+}
+
+// PlayerByName returns the participant with the given username, or nil.
+func (g *Game) PlayerByName(username string) *Player {
+	if g.Player1 != nil && g.Player1.Username == username {
+		return g.Player1
+	}
+	if g.Player2 != nil && g.Player2.Username == username {
+		return g.Player2
+	}
+	return nil
+}
+
+// Opponent returns the other participant of the game.
+func (g *Game) Opponent(p *Player) *Player {
+	if p == g.Player1 {
+		return g.Player2
+	}
+	return g.Player1
+}
+
+// MovesBy returns how many of the game's moves playerNum made. Player 1
+// always moves first.
+func (g *Game) MovesBy(playerNum int) int {
+	if playerNum == Player1 {
+		return (g.MoveCount + 1) / 2
 	}
+	return g.MoveCount / 2
 }
 
 func (g *Game) MakeMove(col int, playerNum int) error {
@@ -56,15 +131,15 @@ func (g *Game) MakeMove(col int, playerNum int) error {
 	}
 	
 	if g.Status != "playing" {
-		return fmt.Errorf("game not in playing state: %s", g.Status)
+		return fmt.Errorf("%w (status: %s)", ErrGameOver, g.Status)
 	}
 	
 	if g.CurrentTurn != playerNum {
-		return fmt.Errorf("not your turn (current: %d, yours: %d)", g.CurrentTurn, playerNum)
+		return fmt.Errorf("%w (current: %d, yours: %d)", ErrNotYourTurn, g.CurrentTurn, playerNum)
 	}
 	
 	if col < 0 || col >= Cols {
-		return fmt.Errorf("invalid column %d (must be 0-%d)", col, Cols-1)
+		return fmt.Errorf("%w %d (must be 0-%d)", ErrInvalidColumn, col, Cols-1)
 	}
 	
 	if playerNum != Player1 && playerNum != Player2 {
@@ -81,13 +156,15 @@ func (g *Game) MakeMove(col int, playerNum int) error {
 	}
 	
 	if row == -1 {
-		return fmt.Errorf("column is full")
+		return ErrColumnFull
 	}
 	
 	// Place the piece
+	now := time.Now()
 	g.Board[row][col] = playerNum
 	g.MoveCount++
-	g.LastActivityTime = time.Now()
+	g.Moves = append(g.Moves, col)
+	g.LastActivityTime = now
 	
 	// Check for win
 	if g.CheckWin(row, col, playerNum) {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Guest IDs live in their own namespace, which registration refuses.
+const guestPrefix = "guest-"
+
+func newGuestID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return guestPrefix + hex.EncodeToString(b), nil
+}
+
+// handleGuest starts a guest session. Guests that send back the resumeToken
+// from an earlier session get their old guest ID again.
+func handleGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ResumeToken string `json:"resumeToken"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ResumeToken == "" {
+		guestID, err := newGuestID()
+		if err != nil {
+			http.Error(w, "Could not create guest", http.StatusInternalServerError)
+			return
+		}
+		writeSession(w, guestID, true, http.StatusCreated)
+		return
+	}
+
+	claims, err := tokenSigner.VerifyGuestResume(req.ResumeToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	claimed, err := gameServer.store.GuestClaimed(claims.Username)
+	if err != nil {
+		log.Printf("Error checking guest %s: %v", claims.Username, err)
+		http.Error(w, "Could not resume guest", http.StatusInternalServerError)
+		return
+	}
+	if claimed {
+		http.Error(w, "Guest has been upgraded to an account, please log in", http.StatusGone)
+		return
+	}
+	deleted, err := gameServer.store.GuestRevoked(claims.Username)
+	if err != nil {
+		log.Printf("Error checking guest %s: %v", claims.Username, err)
+		http.Error(w, "Could not resume guest", http.StatusInternalServerError)
+		return
+	}
+	if deleted {
+		http.Error(w, "Guest has been deleted", http.StatusGone)
+		return
+	}
+
+	writeSession(w, claims.Username, true, http.StatusOK)
+}
+
+// handleClaimGuest registers the calling guest under a username of their
+// choice, keeping their stats and game history.
+func handleClaimGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := authenticateAccount(w, r)
+	if claims == nil {
+		return
+	}
+	if !claims.Guest {
+		http.Error(w, "Only guests can claim a username", http.StatusForbidden)
+		return
+	}
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := validateCredentials(creds); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Live games and queues are keyed by the guest ID
+	if gameServer.isBusy(claims.Username) {
+		http.Error(w, "Finish your current game before claiming a username", http.StatusConflict)
+		return
+	}
+	// Results still queued for the guest ID would be left behind by the rename
+	if err := gameServer.persist.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Could not create account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := gameServer.store.ClaimGuest(claims.Username, creds.Username, string(hash)); err != nil {
+		if errors.Is(err, ErrAccountExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error claiming %s for guest %s: %v", creds.Username, claims.Username, err)
+		http.Error(w, "Could not create account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Guest %s claimed username %s", claims.Username, creds.Username)
+	writeSession(w, creds.Username, false, http.StatusOK)
+}
+
+// isBusy reports whether username is in a live game or waiting for one.
+func (gs *GameServer) isBusy(username string) bool {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	_, inGame := gs.playerGames[username]
+	return inGame || gs.isWaiting(username)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 100
+
+	profileRecentGames   = 10
+	profileRatingHistory = 50
+	headToHeadRecent     = 10
+)
+
+// PlayerProfile is everything shown on a player's page.
+type PlayerProfile struct {
+	PlayerStats
+	WinRate         float64       `json:"winRate"`
+	FavoriteOpening *int          `json:"favoriteOpening"` // column, null before any stored move
+	AverageGame     GameAverages  `json:"averageGame"`
+	RatingHistory   []RatingPoint `json:"ratingHistory"`
+	RecentGames     []GameRecord  `json:"recentGames"`
+}
+
+// saveMove records the move just played in col for replays. Caller must hold
+// gs.mu.
+func (gs *GameServer) saveMove(game *Game, col, playerNum int) {
+	move := MoveRecord{
+		MoveNum:   game.MoveCount,
+		PlayerNum: playerNum,
+		Column:    col,
+		Row:       landingRow(game, col),
+		PlayedAt:  time.Now(),
+	}
+	if err := gs.persist.SaveMove(game.ID, move); err != nil {
+		log.Printf("Error saving move %d of game %s: %v", move.MoveNum, game.ID, err)
+	}
+}
+
+// gameMoves replays a game's moves into records, so that moves whose saveMove
+// failed are not missing from the stored game. Their times are unknown; they
+// are given the end of the game.
+func gameMoves(game *Game) []MoveRecord {
+	var heights [Cols]int
+	moves := make([]MoveRecord, 0, len(game.Moves))
+	for i, col := range game.Moves {
+		playerNum := Player1
+		if i%2 == 1 {
+			playerNum = Player2
+		}
+		moves = append(moves, MoveRecord{
+			MoveNum:   i + 1,
+			PlayerNum: playerNum,
+			Column:    col,
+			Row:       Rows - 1 - heights[col],
+			PlayedAt:  game.EndTime,
+		})
+		heights[col]++
+	}
+	return moves
+}
+
+// landingRow returns the row of the topmost piece in col, which is where the
+// last move into that column landed.
+func landingRow(game *Game, col int) int {
+	for r := 0; r < Rows; r++ {
+		if game.Board[r][col] != Empty {
+			return r
+		}
+	}
+	return -1
+}
+
+// handlePlayers serves everything under /api/players/:
+//
+//	GET {name}         profile: stats, streaks, rating history, recent games
+//	GET {name}/games   the player's games, newest first
+//	                   ?limit=20&offset=0&result=win|loss|draw&opponent=name
+//	GET {a}/vs/{b}     head-to-head record of a against b
+func handlePlayers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/players/"), "/"), "/")
+	if parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		handlePlayerProfile(w, parts[0])
+	case len(parts) == 2 && parts[1] == "games":
+		handlePlayerGames(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "vs" && parts[2] != "":
+		handleHeadToHead(w, parts[0], parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handlePlayerProfile(w http.ResponseWriter, username string) {
+	profile, err := loadPlayerProfile(gameServer.store, username)
+	if errors.Is(err, ErrPlayerNotFound) {
+		http.Error(w, "Player not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading profile of %s: %v", username, err)
+		http.Error(w, "Could not load profile", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+func loadPlayerProfile(store Store, username string) (*PlayerProfile, error) {
+	stats, err := store.GetPlayerStats(username)
+	if err != nil {
+		return nil, err
+	}
+	profile := &PlayerProfile{PlayerStats: *stats}
+	if stats.GamesPlayed > 0 {
+		profile.WinRate = float64(stats.GamesWon) / float64(stats.GamesPlayed)
+	}
+
+	opening, err := store.GetFavoriteOpening(username)
+	if err != nil {
+		return nil, err
+	}
+	if opening >= 0 {
+		profile.FavoriteOpening = &opening
+	}
+
+	if profile.AverageGame, err = store.GetGameAverages(username); err != nil {
+		return nil, err
+	}
+	if profile.RatingHistory, err = store.GetRatingHistory(username, profileRatingHistory); err != nil {
+		return nil, err
+	}
+	profile.RecentGames, _, err = store.GetPlayerGames(username, GameFilter{Limit: profileRecentGames})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func handlePlayerGames(w http.ResponseWriter, r *http.Request, username string) {
+	query := r.URL.Query()
+	filter := GameFilter{
+		Result:   query.Get("result"),
+		Opponent: query.Get("opponent"),
+		Limit:    defaultHistoryPageSize,
+	}
+	switch filter.Result {
+	case "", "win", "loss", "draw":
+	default:
+		http.Error(w, "result must be win, loss or draw", http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	if filter.Limit, ok = queryInt(w, query.Get("limit"), "limit", filter.Limit, 1, maxHistoryPageSize); !ok {
+		return
+	}
+	if filter.Offset, ok = queryInt(w, query.Get("offset"), "offset", 0, 0, -1); !ok {
+		return
+	}
+
+	games, total, err := gameServer.store.GetPlayerGames(username, filter)
+	if err != nil {
+		log.Printf("Error loading games of %s: %v", username, err)
+		http.Error(w, "Could not load games", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"username": username,
+		"games":    games,
+		"total":    total,
+		"limit":    filter.Limit,
+		"offset":   filter.Offset,
+	})
+}
+
+func handleHeadToHead(w http.ResponseWriter, a, b string) {
+	if a == b {
+		http.Error(w, "A player has no record against themselves", http.StatusBadRequest)
+		return
+	}
+
+	record, err := gameServer.store.GetHeadToHead(a, b)
+	if err != nil {
+		log.Printf("Error loading %s vs %s: %v", a, b, err)
+		http.Error(w, "Could not load head-to-head record", http.StatusInternalServerError)
+		return
+	}
+	recent, _, err := gameServer.store.GetPlayerGames(a, GameFilter{Opponent: b, Limit: headToHeadRecent})
+	if err != nil {
+		log.Printf("Error loading games of %s vs %s: %v", a, b, err)
+		http.Error(w, "Could not load head-to-head record", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"playerA":     a,
+		"playerB":     b,
+		"record":      record,
+		"recentGames": recent,
+	})
+}
+
+// handleGameRecord serves GET /api/games/{id}: the game's metadata and every
+// move played so far, in order.
+func handleGameRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gameID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/games/"), "/")
+	if gameID == "" || strings.Contains(gameID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	game, err := gameServer.store.GetGame(gameID)
+	if err != nil {
+		log.Printf("Error loading game %s: %v", gameID, err)
+		http.Error(w, "Could not load game", http.StatusInternalServerError)
+		return
+	}
+	if game == nil {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, game)
+}
+
+// queryInt parses an optional integer query parameter within [min, max]; a
+// negative max means no upper bound. On a bad value it writes the error and
+// returns false.
+func queryInt(w http.ResponseWriter, value, name string, def, min, max int) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || (max >= 0 && n > max) {
+		if max >= 0 {
+			http.Error(w, name+" must be between "+strconv.Itoa(min)+" and "+strconv.Itoa(max), http.StatusBadRequest)
+		} else {
+			http.Error(w, name+" must be at least "+strconv.Itoa(min), http.StatusBadRequest)
+		}
+		return 0, false
+	}
+	return n, true
+}
@@ -11,8 +11,12 @@ import (
 
 type KafkaProducer struct {
 	writer *kafka.Writer
+	acked  *kafka.Writer // for events that must not be lost
 }
 
+// ackTimeout bounds how long SendEventAcked waits for the broker.
+const ackTimeout = 10 * time.Second
+
 func NewKafkaProducer(brokers []string, topic string) *KafkaProducer {
 	writer := &kafka.Writer{
 		Addr:         kafka.TCP(brokers...),
@@ -22,7 +26,14 @@ func NewKafkaProducer(brokers []string, topic string) *KafkaProducer {
 		Async:        true,
 	}
 
-	return &KafkaProducer{writer: writer}
+	acked := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		RequiredAcks: kafka.RequireAll,
+	}
+
+	return &KafkaProducer{writer: writer, acked: acked}
 }
 
 func (kp *KafkaProducer) SendEvent(event GameEvent) {
@@ -44,12 +55,25 @@ func (kp *KafkaProducer) SendEvent(event GameEvent) {
 	}
 }
 
+// SendEventAcked sends event and waits until the broker has stored it.
+func (kp *KafkaProducer) SendEventAcked(event GameEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+	defer cancel()
+	return kp.acked.WriteMessages(ctx, kafka.Message{Key: []byte(event.GameID), Value: data, Time: time.Now()})
+}
+
 func (kp *KafkaProducer) Close() error {
+	kp.acked.Close()
 	return kp.writer.Close()
 }
 
 type GameEvent struct {
-	EventType string    `json:"eventType"` // "game_start", "move", "game_end"
+	EventType string    `json:"eventType"` // "game_start", "move", "game_end", "player_deleted"
 	GameID    string    `json:"gameId"`
 	Timestamp time.Time `json:"timestamp"`
 	Player1   string    `json:"player1"`
@@ -57,6 +81,7 @@ type GameEvent struct {
 	Player2IsBot bool   `json:"player2IsBot"`
 	Move      *MoveData `json:"move,omitempty"`
 	Result    *GameResult `json:"result,omitempty"`
+	Deletion  *PlayerDeletion `json:"deletion,omitempty"`
 }
 
 type MoveData struct {
@@ -70,3 +95,11 @@ type GameResult struct {
 	TotalMoves    int `json:"totalMoves"`
 	DurationSecs  int `json:"durationSecs"`
 }
+
+// PlayerDeletion tells analytics to replace a deleted player's username with
+// the anonymous ID their records were moved to.
+type PlayerDeletion struct {
+	Username    string    `json:"username"`
+	AnonymousID string    `json:"anonymousId"`
+	DeletedAt   time.Time `json:"-"` // sent as the event's timestamp
+}
@@ -3,21 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	migrate "github.com/yourusername/4-in-a-row-migrate"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
+var upgrader = websocket.Upgrader{}
 
 var gameServer *GameServer
 
@@ -34,18 +36,29 @@ func main() {
 	
 	port := getEnv("PORT", "8080")
 	
-	// Initialize database
+	storeBackend := getEnv("STORE_BACKEND", StorePostgres)
+	sqlitePath := getEnv("SQLITE_PATH", "fourinarow.db")
+	
+	// Initialize the store
 	connStr := "host=" + dbHost + " port=" + dbPort + " user=" + dbUser + 
 		" password=" + dbPassword + " dbname=" + dbName + " sslmode=require"
 	
-	db, err := NewDatabase(connStr)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(storeBackend, connStr, sqlitePath, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	
+	store, err := openStore(storeBackend, connStr, sqlitePath, getEnv("AUTO_MIGRATE", "true") == "true")
 	if err != nil {
-		log.Printf("Warning: Database connection failed: %v", err)
-		log.Println("Continuing without database...")
-		db = nil
+		// Carrying on without it would silently lose every result
+		log.Fatalf("Failed to open the %s store: %v", storeBackend, err)
+	}
+	if storeBackend == StoreMemory {
+		log.Println("Using the in-memory store, games and stats will be lost on restart")
 	} else {
-		log.Println("Database connected successfully")
-		defer db.Close()
+		log.Printf("Store connected successfully (%s)", storeBackend)
 	}
 	
 	// Initialize Kafka producer (optional)
@@ -53,22 +66,50 @@ func main() {
 	if kafkaBroker != "" {
 		kafka = NewKafkaProducer([]string{kafkaBroker}, kafkaTopic)
 		if kafka != nil {
-			defer kafka.Close()
 			log.Println("Kafka producer initialized")
 		}
 	} else {
 		log.Println("Kafka not configured - analytics disabled")
 	}
 	
+	cfg := LoadConfig()
+	tokenSigner = NewTokenSigner(cfg.AuthSecret, cfg.SessionTTL, cfg.GuestResumeTTL)
+	upgrader.CheckOrigin = originChecker(cfg.AllowedOrigins)
+	
+	// Share queues and games with the other instances, if there are any
+	var cluster Cluster = NewMemoryCluster(cfg.InstanceID)
+	if cfg.ClusterBackend == ClusterPostgres {
+		if db, ok := store.(*Database); !ok || db.dialect != StorePostgres {
+			log.Println("Warning: postgres cluster backend needs the postgres store, running as a single instance")
+		} else if pc, err := NewPostgresCluster(connStr, db.db, cfg.InstanceID); err != nil {
+			log.Printf("Warning: joining the cluster failed: %v, running as a single instance", err)
+		} else {
+			cluster = pc
+			log.Printf("Joined cluster as instance %s", cfg.InstanceID)
+		}
+	}
+	
 	// Initialize game server
-	gameServer = NewGameServer(db, kafka)
+	gameServer = NewGameServer(store, kafka, cluster, cfg)
 	log.Println("Game server initialized")
 	
 	// HTTP handlers
 	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/api/auth/register", handleRegister)
+	http.HandleFunc("/api/auth/login", handleLogin)
+	http.HandleFunc("/api/auth/guest", handleGuest)
+	http.HandleFunc("/api/auth/claim", handleClaimGuest)
+	http.HandleFunc("/api/account", handleAccount)
+	http.HandleFunc("/api/account/export", handleAccountExport)
 	http.HandleFunc("/api/leaderboard", handleLeaderboard)
+	http.HandleFunc("/api/players/", handlePlayers)
+	http.HandleFunc("/api/games/", handleGameRecord)
+	http.HandleFunc("/api/seasons", handleSeasons)
+	http.HandleFunc("/api/seasons/", handleSeasons)
 	http.HandleFunc("/api/health", handleHealth)
 	http.HandleFunc("/api/metrics", handleMetrics)
+	http.HandleFunc("/api/protocol/schema", handleProtocolSchema)
+	http.HandleFunc("/api/admin/", requireAdmin(handleAdmin))
 	
 	// CORS middleware
 	handler := enableCORS(http.DefaultServeMux)
@@ -84,15 +125,20 @@ func main() {
 	
 	log.Printf("Server starting on port %s...", port)
 	
-	// Graceful shutdown handling
+	// Graceful shutdown handling. Hijacked WebSocket connections are not
+	// touched by server.Shutdown, so live games are drained first.
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
+		
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		<-sigChan
 		
-		log.Println("Shutdown signal received, gracefully shutting down...")
+		log.Println("Shutdown signal received, draining live games...")
+		gameServer.Drain(cfg.DrainTimeout)
 		
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		
 		if err := server.Shutdown(ctx); err != nil {
@@ -104,30 +150,165 @@ func main() {
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal("Server error:", err)
 	}
+	<-shutdownDone
+	gameServer.persist.Close()
+	cluster.Close()
+	
+	// Flush events queued by the async writer before exiting
+	if kafka != nil {
+		if err := kafka.Close(); err != nil {
+			log.Printf("Error flushing Kafka producer: %v", err)
+		}
+	}
+	store.Close()
+}
+
+// runMigrate runs the migrate subcommand against the Postgres or SQLite
+// database.
+func runMigrate(backend, connStr, sqlitePath string, args []string) error {
+	if backend == StoreMemory {
+		return errors.New("the memory store has no schema to migrate")
+	}
+	db, err := openDatabaseBackend(backend, connStr, sqlitePath, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	
+	migrator, err := db.Migrator()
+	if err != nil {
+		return err
+	}
+	return migrate.RunCommand(migrator, args)
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Reject unauthenticated clients before upgrading
+	claims, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	
+	ip := clientIP(r, gameServer.config.TrustProxy)
+	if err := gameServer.connLimiter.Acquire(ip, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer gameServer.connLimiter.Release(ip)
+	
+	// Both checks fail closed: a store error must not let a revoked or
+	// banned session in
+	revoked, err := sessionRevoked(claims)
+	if err != nil {
+		log.Printf("Error checking session of %s: %v", claims.Username, err)
+		http.Error(w, "Could not check session", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		http.Error(w, ErrRevokedToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	
+	ban, err := gameServer.BanFor(claims.Username)
+	if err != nil {
+		log.Printf("Error checking ban for %s: %v", claims.Username, err)
+		http.Error(w, "Could not check session", http.StatusInternalServerError)
+		return
+	}
+	if ban != nil {
+		http.Error(w, "Banned: "+ban.Reason, http.StatusForbidden)
+		return
+	}
+	
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 	
-	gameServer.HandleConnection(conn)
+	gameServer.HandleConnection(conn, claims.Username)
 }
 
+const (
+	defaultLeaderboardSize     = 10
+	defaultLeaderboardMinGames = 5
+)
+
+// handleLeaderboard serves one page of the leaderboard as an array of ranked
+// entries, with the number of ranked players in X-Total-Count:
+//
+//	?limit=10&page=1 (or offset=0)
+//	&sort=wins|winrate|rating|streak&minGames=5 (winrate only)
+//	&window=all|month|week|season&variant=standard
+//	&around=name (the page centered on that player)
 func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
-	if gameServer.database == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	params := r.URL.Query()
+	q := LeaderboardQuery{
+		Sort:    params.Get("sort"),
+		Window:  params.Get("window"),
+		Variant: params.Get("variant"),
+		Around:  params.Get("around"),
+	}
+	if q.Sort == "" {
+		q.Sort = SortWins
+	}
+	if _, ok := leaderboardOrder[q.Sort]; !ok {
+		http.Error(w, "sort must be wins, winrate, rating or streak", http.StatusBadRequest)
+		return
+	}
+	switch q.Window {
+	case "":
+		q.Window = WindowAll
+	case WindowAll, WindowMonth, WindowWeek:
+	case WindowSeason:
+		season, err := findSeason("current")
+		if err != nil {
+			log.Printf("Error loading current season: %v", err)
+			http.Error(w, "Could not load leaderboard", http.StatusInternalServerError)
+			return
+		}
+		if season == nil {
+			http.Error(w, "No season is running", http.StatusNotFound)
+			return
+		}
+		q.From, q.To = season.StartsAt, season.EndsAt
+	default:
+		http.Error(w, "window must be all, month, week or season", http.StatusBadRequest)
+		return
+	}
+	if q.Variant != "" && !supportedVariants[q.Variant] {
+		http.Error(w, "unknown variant", http.StatusBadRequest)
+		return
+	}
+	
+	var ok bool
+	if q.Limit, ok = queryInt(w, params.Get("limit"), "limit", defaultLeaderboardSize, 1, maxHistoryPageSize); !ok {
+		return
+	}
+	if q.MinGames, ok = queryInt(w, params.Get("minGames"), "minGames", defaultLeaderboardMinGames, 1, -1); !ok {
+		return
+	}
+	page := 1
+	if page, ok = queryInt(w, params.Get("page"), "page", page, 1, -1); !ok {
+		return
+	}
+	if q.Offset, ok = queryInt(w, params.Get("offset"), "offset", (page-1)*q.Limit, 0, -1); !ok {
 		return
 	}
 	
-	leaderboard, err := gameServer.database.GetLeaderboard(10)
+	leaderboard, total, err := gameServer.store.GetLeaderboard(q)
+	if errors.Is(err, ErrPlayerNotFound) {
+		http.Error(w, "Player is not on this leaderboard", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error loading leaderboard: %v", err)
+		http.Error(w, "Could not load leaderboard", http.StatusInternalServerError)
 		return
 	}
 	
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(leaderboard)
 }
@@ -135,9 +316,26 @@ func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
+	// Tell load balancers to stop sending new players here while draining
+	status := "ok"
+	if gameServer.Draining() {
+		status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	
+	// Without a database everything is kept in memory only. Games carry on
+	// while it is unreachable, their writes spilled to disk, so this does not
+	// fail the check
 	dbStatus := "disconnected"
-	if gameServer.database != nil {
+	if _, ok := gameServer.store.(*Database); ok {
 		dbStatus = "connected"
+		if err := gameServer.store.Ping(); err != nil {
+			log.Printf("Health check: database unreachable: %v", err)
+			dbStatus = "unreachable"
+			if status == "ok" {
+				status = "degraded"
+			}
+		}
 	}
 	
 	kafkaStatus := "disabled"
@@ -146,8 +344,9 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "ok",
+		"status":   status,
 		"database": dbStatus,
+		"store":    storeKind(gameServer.store),
 		"kafka":    kafkaStatus,
 		"timestamp": time.Now().Unix(),
 	})
@@ -164,17 +363,71 @@ func handleMetrics(w http.ResponseWriter, r *http.Request) {
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"activeGames":    len(gameServer.games),
-		"waitingPlayers": len(gameServer.waitingPlayers),
-		"totalPlayers":   len(gameServer.playerGames),
+		"activeGames":           len(gameServer.games),
+		"waitingPlayers":        gameServer.waitingCount(),
+		"totalPlayers":          len(gameServer.playerGames),
+		"instance":              gameServer.cluster.InstanceID(),
+		"queues":                gameServer.QueueMetrics(),
+		"persistence":           gameServer.persist.Metrics(),
+		"droppedMessages":       droppedMessages.Load(),
+		"slowClientDisconnects": slowClientDisconnects.Load(),
+		"rejected": map[string]int64{
+			"origin":               rejectedOrigin.Load(),
+			"connsPerIp":           rejectedConnsPerIP.Load(),
+			"connRate":             rejectedConnRate.Load(),
+			"rateLimitedMessages":  rateLimitedMessages.Load(),
+			"rateLimitDisconnects": rateLimitDisconnects.Load(),
+			"oversizedMessages":    oversizedMessages.Load(),
+		},
 	})
 }
 
+// originChecker accepts WebSocket upgrades from the given origins, or only
+// from the server's own origin if there are none. Requests without an Origin
+// header do not come from browsers and are let through.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(allowed) == 0 {
+			if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		rejectedOrigin.Add(1)
+		log.Printf("Rejected WebSocket from origin %s", origin)
+		return false
+	}
+}
+
+// clientIP returns the address a request came from. Behind a trusted proxy
+// that is the first X-Forwarded-For entry.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		origin  string
+		want    bool
+	}{
+		{"no origin header", nil, "game.example", "", true},
+		{"same origin by default", nil, "game.example", "https://game.example", true},
+		{"same origin with port", nil, "localhost:8080", "http://localhost:8080", true},
+		{"other origin by default", nil, "game.example", "https://evil.example", false},
+		{"other port by default", nil, "localhost:8080", "http://localhost:3000", false},
+		{"listed", []string{"http://localhost:3000"}, "localhost:8080", "http://localhost:3000", true},
+		{"listed in other case", []string{"HTTP://LOCALHOST:3000"}, "localhost:8080", "http://localhost:3000", true},
+		{"not listed", []string{"http://localhost:3000"}, "localhost:8080", "https://evil.example", false},
+		{"own origin not listed", []string{"http://localhost:3000"}, "localhost:8080", "http://localhost:8080", false},
+		{"wildcard", []string{"*"}, "game.example", "https://evil.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+"/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := originChecker(tt.allowed)(r); got != tt.want {
+				t.Errorf("originChecker(%v) for %s from %q = %v, want %v", tt.allowed, tt.host, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleHealthReportsDatabase(t *testing.T) {
+	open := func(t *testing.T) *Database {
+		db, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "test.db"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	tests := []struct {
+		name       string
+		store      func(t *testing.T) Store
+		wantStatus string
+		wantDB     string
+	}{
+		{"memory", func(*testing.T) Store { return NewMemoryStore() }, "ok", "disconnected"},
+		{"database up", func(t *testing.T) Store { return open(t) }, "ok", "connected"},
+		{"database down", func(t *testing.T) Store {
+			db := open(t)
+			db.Close()
+			return db
+		}, "degraded", "unreachable"},
+	}
+	defer func(gs *GameServer) { gameServer = gs }(gameServer)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gameServer = &GameServer{store: tt.store(t)}
+			w := httptest.NewRecorder()
+			handleHealth(w, httptest.NewRequest("GET", "/api/health", nil))
+
+			var body map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK || body["status"] != tt.wantStatus || body["database"] != tt.wantDB {
+				t.Errorf("health = %d %v, want 200 with status %s and database %s", w.Code, body, tt.wantStatus, tt.wantDB)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VariantStandard = "standard"
+	Untimed         = "untimed"
+
+	// Bot fallback modes a player can request when joining
+	BotNow   = "now"   // start against a bot straight away
+	BotNever = "never" // humans only, wait indefinitely
+	BotAfter = "after" // bot joins if no human is found in time
+
+	defaultBotWait = 10 * time.Second
+)
+
+var (
+	DefaultBoardSize = fmt.Sprintf("%dx%d", Cols, Rows)
+
+	// Board sizes and variants the game engine can actually play. Queues are
+	// keyed on these so adding a new one only needs an entry here.
+	supportedBoardSizes = map[string]bool{DefaultBoardSize: true}
+	supportedVariants   = map[string]bool{VariantStandard: true}
+)
+
+// MatchOptions describes the kind of game a player asked for. Players are only
+// matched with others whose options are identical, so it doubles as the key of
+// the matchmaking queues.
+type MatchOptions struct {
+	BoardSize   string `json:"boardSize"`
+	Variant     string `json:"variant"`
+	TimeControl string `json:"timeControl"`
+}
+
+// NewMatchOptions fills in defaults for missing fields and validates the rest.
+func NewMatchOptions(boardSize, variant, timeControl string) (MatchOptions, error) {
+	if boardSize == "" {
+		boardSize = DefaultBoardSize
+	}
+	if variant == "" {
+		variant = VariantStandard
+	}
+
+	if !supportedBoardSizes[boardSize] {
+		return MatchOptions{}, fmt.Errorf("unsupported board size %q", boardSize)
+	}
+	if !supportedVariants[variant] {
+		return MatchOptions{}, fmt.Errorf("unsupported variant %q", variant)
+	}
+
+	tc, err := ParseTimeControl(timeControl)
+	if err != nil {
+		return MatchOptions{}, err
+	}
+
+	return MatchOptions{
+		BoardSize:   boardSize,
+		Variant:     variant,
+		TimeControl: tc.String(), // normalized so "" and "untimed" share a queue
+	}, nil
+}
+
+func (o MatchOptions) String() string {
+	return o.BoardSize + "/" + o.Variant + "/" + o.TimeControl
+}
+
+// TimeControl is the per-player time budget a player asks for, with an
+// optional increment per move. It only keys the queues: games are not clocked
+// yet. The zero value means untimed.
+type TimeControl struct {
+	Initial   time.Duration
+	Increment time.Duration
+}
+
+// ParseTimeControl accepts "untimed" or "<minutes>+<increment seconds>",
+// e.g. "3+2".
+func ParseTimeControl(s string) (TimeControl, error) {
+	if s == "" || s == Untimed {
+		return TimeControl{}, nil
+	}
+
+	parts := strings.SplitN(s, "+", 2)
+	if len(parts) != 2 {
+		return TimeControl{}, fmt.Errorf("invalid time control %q (expected minutes+increment)", s)
+	}
+
+	minutes, err := strconv.Atoi(parts[0])
+	if err != nil || minutes < 1 || minutes > 60 {
+		return TimeControl{}, fmt.Errorf("invalid time control %q (minutes must be 1-60)", s)
+	}
+
+	increment, err := strconv.Atoi(parts[1])
+	if err != nil || increment < 0 || increment > 60 {
+		return TimeControl{}, fmt.Errorf("invalid time control %q (increment must be 0-60 seconds)", s)
+	}
+
+	return TimeControl{
+		Initial:   time.Duration(minutes) * time.Minute,
+		Increment: time.Duration(increment) * time.Second,
+	}, nil
+}
+
+func (tc TimeControl) String() string {
+	if tc.Initial == 0 {
+		return Untimed
+	}
+	return fmt.Sprintf("%d+%d", int(tc.Initial/time.Minute), int(tc.Increment/time.Second))
+}
+
+// BotPolicy decides whether and when a waiting player is handed to a bot.
+type BotPolicy struct {
+	Mode  string        `json:"mode"`
+	After time.Duration `json:"-"`
+}
+
+// NewBotPolicy validates a requested policy. An empty mode falls back to
+// defaults, and "after" without a wait uses the default wait.
+func NewBotPolicy(mode string, afterSecs int, defaults BotPolicy, maxWait time.Duration) (BotPolicy, error) {
+	switch mode {
+	case "":
+		return defaults, nil
+	case BotNow, BotNever:
+		return BotPolicy{Mode: mode}, nil
+	case BotAfter:
+		after := time.Duration(afterSecs) * time.Second
+		if afterSecs == 0 {
+			after = defaultBotWait
+			if defaults.Mode == BotAfter {
+				after = defaults.After
+			}
+		}
+		if after <= 0 || after > maxWait {
+			return BotPolicy{}, fmt.Errorf("bot wait must be 1-%d seconds", int(maxWait/time.Second))
+		}
+		return BotPolicy{Mode: BotAfter, After: after}, nil
+	default:
+		return BotPolicy{}, fmt.Errorf("unknown bot policy %q (expected now, never or after)", mode)
+	}
+}
+
+// wantsBot reports whether a player who has waited this long should now get
+// a bot opponent.
+func (p BotPolicy) wantsBot(waited time.Duration) bool {
+	switch p.Mode {
+	case BotNow:
+		return true
+	case BotAfter:
+		return waited >= p.After
+	default:
+		return false
+	}
+}
+
+// queueStats are cumulative counters for one matchmaking queue. They outlive
+// the queue itself, which is dropped from waitingPlayers once empty.
+type queueStats struct {
+	MatchesMade  int
+	BotMatches   int
+	TotalWaitSec float64
+}
+
+type QueueMetrics struct {
+	Queue           string  `json:"queue"`
+	BoardSize       string  `json:"boardSize"`
+	Variant         string  `json:"variant"`
+	TimeControl     string  `json:"timeControl"`
+	Waiting         int     `json:"waiting"`
+	LongestWaitSecs float64 `json:"longestWaitSecs"`
+	MatchesMade     int     `json:"matchesMade"`
+	BotMatches      int     `json:"botMatches"`
+	AvgWaitSecs     float64 `json:"avgWaitSecs"`
+}
+
+// isWaiting reports whether username is already sitting in any queue.
+// Caller must hold gs.mu.
+func (gs *GameServer) isWaiting(username string) bool {
+	for _, queue := range gs.waitingPlayers {
+		for _, wp := range queue {
+			if wp.Username == username {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeWaiting takes username out of whichever queue holds it, but only if
+// it was queued from client, and reports whether it did. Caller must hold
+// gs.mu.
+func (gs *GameServer) removeWaiting(username string, client *Client) bool {
+	for opts, queue := range gs.waitingPlayers {
+		for i, wp := range queue {
+			if wp.Username != username || wp.Client != client {
+				continue
+			}
+			queue = append(queue[:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(gs.waitingPlayers, opts)
+			} else {
+				gs.waitingPlayers[opts] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// waitingCount returns the number of players across all queues.
+// Caller must hold gs.mu.
+func (gs *GameServer) waitingCount() int {
+	total := 0
+	for _, queue := range gs.waitingPlayers {
+		total += len(queue)
+	}
+	return total
+}
+
+// recordMatch updates the queue counters once players leave a queue for a game.
+// Caller must hold gs.mu.
+func (gs *GameServer) recordMatch(opts MatchOptions, withBot bool, players ...*Player) {
+	stats := gs.queueStats[opts]
+	if stats == nil {
+		stats = &queueStats{}
+		gs.queueStats[opts] = stats
+	}
+
+	stats.MatchesMade++
+	if withBot {
+		stats.BotMatches++
+	}
+	for _, p := range players {
+		stats.TotalWaitSec += time.Since(p.QueuedAt).Seconds()
+	}
+}
+
+// QueueMetrics returns a snapshot of every queue that is either non-empty or
+// has made a match since startup. Caller must hold gs.mu.
+func (gs *GameServer) QueueMetrics() []QueueMetrics {
+	keys := make(map[MatchOptions]bool)
+	for opts := range gs.waitingPlayers {
+		keys[opts] = true
+	}
+	for opts := range gs.queueStats {
+		keys[opts] = true
+	}
+
+	now := time.Now()
+	metrics := make([]QueueMetrics, 0, len(keys))
+	for opts := range keys {
+		m := QueueMetrics{
+			Queue:       opts.String(),
+			BoardSize:   opts.BoardSize,
+			Variant:     opts.Variant,
+			TimeControl: opts.TimeControl,
+		}
+
+		queue := gs.waitingPlayers[opts]
+		m.Waiting = len(queue)
+		for _, p := range queue {
+			if wait := now.Sub(p.QueuedAt).Seconds(); wait > m.LongestWaitSecs {
+				m.LongestWaitSecs = wait
+			}
+		}
+
+		if stats := gs.queueStats[opts]; stats != nil {
+			m.MatchesMade = stats.MatchesMade
+			m.BotMatches = stats.BotMatches
+			matchedPlayers := 2*(stats.MatchesMade-stats.BotMatches) + stats.BotMatches
+			if matchedPlayers > 0 {
+				m.AvgWaitSecs = stats.TotalWaitSec / float64(matchedPlayers)
+			}
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Queue < metrics[j].Queue
+	})
+	return metrics
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS cluster_games;
+DROP TABLE IF EXISTS cluster_queue;
+DROP TABLE IF EXISTS cluster_instances;
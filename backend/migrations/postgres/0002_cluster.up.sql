@@ -0,0 +1,29 @@
+-- Shared state of CLUSTER_BACKEND=postgres
+
+CREATE TABLE IF NOT EXISTS cluster_instances (
+	instance_id VARCHAR(255) PRIMARY KEY,
+	last_seen TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS cluster_queue (
+	username VARCHAR(255) PRIMARY KEY,
+	instance_id VARCHAR(255) NOT NULL,
+	conn_id VARCHAR(64) NOT NULL,
+	board_size VARCHAR(20) NOT NULL,
+	variant VARCHAR(50) NOT NULL,
+	time_control VARCHAR(20) NOT NULL,
+	rating INTEGER NOT NULL,
+	bot_mode VARCHAR(10) NOT NULL,
+	bot_after_ms BIGINT NOT NULL,
+	joined_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cluster_queue_options ON cluster_queue(board_size, variant, time_control, joined_at);
+
+CREATE TABLE IF NOT EXISTS cluster_games (
+	game_id VARCHAR(255) PRIMARY KEY,
+	instance_id VARCHAR(255) NOT NULL,
+	player1 VARCHAR(255) NOT NULL,
+	player2 VARCHAR(255) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cluster_games_player1 ON cluster_games(player1);
+CREATE INDEX IF NOT EXISTS idx_cluster_games_player2 ON cluster_games(player2);
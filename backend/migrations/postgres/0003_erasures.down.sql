@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pending_erasures;
+DROP TABLE IF EXISTS deleted_guests;
@@ -0,0 +1,5 @@
+-- Guests claimed as accounts before claiming revoked their sessions
+
+INSERT INTO deleted_guests (guest_id, deleted_at)
+SELECT claimed_from, CURRENT_TIMESTAMP FROM accounts WHERE claimed_from IS NOT NULL
+ON CONFLICT (guest_id) DO NOTHING;
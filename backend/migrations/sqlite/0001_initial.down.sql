@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS bans;
+DROP TABLE IF EXISTS season_standings;
+DROP TABLE IF EXISTS seasons;
+DROP TABLE IF EXISTS moves;
+DROP TABLE IF EXISTS live_games;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS chat_messages;
+DROP TABLE IF EXISTS rating_history;
+DROP TABLE IF EXISTS players;
+DROP TABLE IF EXISTS games;
@@ -0,0 +1,109 @@
+-- The same schema as postgres/0001_initial, for a new SQLite database.
+
+CREATE TABLE games (
+	id VARCHAR(255) PRIMARY KEY,
+	player1_username VARCHAR(255),
+	player2_username VARCHAR(255),
+	winner INTEGER,
+	status VARCHAR(50),
+	start_time TIMESTAMP,
+	end_time TIMESTAMP,
+	move_count INTEGER,
+	duration_seconds INTEGER,
+	board_size VARCHAR(20),
+	variant VARCHAR(50),
+	time_control VARCHAR(20)
+);
+CREATE INDEX idx_games_player1 ON games(player1_username, start_time DESC);
+CREATE INDEX idx_games_player2 ON games(player2_username, start_time DESC);
+CREATE INDEX idx_games_pair ON games(player1_username, player2_username);
+CREATE INDEX idx_games_end_time ON games(end_time);
+
+CREATE TABLE players (
+	username VARCHAR(255) PRIMARY KEY,
+	games_played INTEGER DEFAULT 0,
+	games_won INTEGER DEFAULT 0,
+	games_lost INTEGER DEFAULT 0,
+	games_drawn INTEGER DEFAULT 0,
+	total_moves INTEGER DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	rating INTEGER DEFAULT 1200,
+	current_streak INTEGER DEFAULT 0,
+	best_streak INTEGER DEFAULT 0
+);
+CREATE INDEX idx_players_wins ON players(games_won DESC);
+
+CREATE TABLE rating_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(255) NOT NULL,
+	game_id VARCHAR(255),
+	rating INTEGER NOT NULL,
+	delta INTEGER NOT NULL,
+	recorded_at TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_rating_history_player ON rating_history(username, recorded_at);
+
+CREATE TABLE chat_messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	game_id VARCHAR(255) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	message TEXT NOT NULL,
+	original_message TEXT,
+	flagged BOOLEAN DEFAULT FALSE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_chat_game ON chat_messages(game_id);
+
+CREATE TABLE accounts (
+	username VARCHAR(255) PRIMARY KEY,
+	password_hash VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	claimed_from VARCHAR(255)
+);
+CREATE INDEX idx_accounts_claimed_from ON accounts(claimed_from);
+
+CREATE TABLE live_games (
+	game_id VARCHAR(255) PRIMARY KEY,
+	state BLOB NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	instance_id VARCHAR(255)
+);
+
+CREATE TABLE moves (
+	game_id VARCHAR(255) NOT NULL,
+	move_num INTEGER NOT NULL,
+	player_num INTEGER NOT NULL,
+	column_index INTEGER NOT NULL,
+	row_index INTEGER NOT NULL,
+	played_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (game_id, move_num)
+);
+
+CREATE TABLE seasons (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	starts_at TIMESTAMP NOT NULL UNIQUE,
+	ends_at TIMESTAMP NOT NULL,
+	started_at TIMESTAMP,
+	archived_at TIMESTAMP
+);
+
+CREATE TABLE season_standings (
+	season_id INTEGER NOT NULL REFERENCES seasons(id),
+	rank INTEGER NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	games_played INTEGER NOT NULL,
+	games_won INTEGER NOT NULL,
+	games_lost INTEGER NOT NULL,
+	games_drawn INTEGER NOT NULL,
+	rating INTEGER NOT NULL,
+	PRIMARY KEY (season_id, username)
+);
+CREATE INDEX idx_season_standings_rank ON season_standings(season_id, rank);
+
+CREATE TABLE bans (
+	username VARCHAR(255) PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,13 @@
+-- Account deletion: guest IDs whose sessions are refused, and deletions
+-- the analytics service has yet to be told about
+
+CREATE TABLE IF NOT EXISTS deleted_guests (
+	guest_id VARCHAR(255) PRIMARY KEY,
+	deleted_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pending_erasures (
+	anonymous_id VARCHAR(255) PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
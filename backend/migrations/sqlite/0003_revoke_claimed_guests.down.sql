@@ -0,0 +1 @@
+DELETE FROM deleted_guests WHERE guest_id IN (SELECT claimed_from FROM accounts);
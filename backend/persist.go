@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	persistMaxAttempts    = 5
+	persistRetryDelay     = 100 * time.Millisecond // doubled after every failed attempt
+	persistReplayInterval = 15 * time.Second
+)
+
+// Persistence operations.
+const (
+	opSaveGame       = "save_game"
+	opSaveMove       = "save_move"
+	opSaveLiveGame   = "save_live_game"
+	opDeleteLiveGame = "delete_live_game"
+	opRecordResult   = "record_result"
+	opSaveChat       = "save_chat"
+)
+
+// persistJob is one write waiting for the store. Jobs are spilled to disk as
+// JSON, so they carry copies of what they write rather than live games.
+type persistJob struct {
+	Op         string         `json:"op"`
+	GameID     string         `json:"gameId"`
+	Game       *persistedGame `json:"game,omitempty"`
+	Move       *MoveRecord    `json:"move,omitempty"`
+	Moves      []MoveRecord   `json:"moves,omitempty"`
+	Players    []PlayerResult `json:"players,omitempty"`
+	Chat       *ChatMessage   `json:"chat,omitempty"`
+	InstanceID string         `json:"instanceId,omitempty"`
+	State      []byte         `json:"state,omitempty"`
+	UpdatedAt  time.Time      `json:"updatedAt,omitempty"`
+
+	flushed *sync.WaitGroup // set on the markers queued by Flush
+}
+
+// persistedGame is the part of a game that the games table keeps.
+type persistedGame struct {
+	ID        string       `json:"id"`
+	Player1   string       `json:"player1"`
+	Player2   string       `json:"player2"`
+	Status    string       `json:"status"`
+	Winner    int          `json:"winner"`
+	StartTime time.Time    `json:"startTime"`
+	EndTime   time.Time    `json:"endTime"`
+	MoveCount int          `json:"moveCount"`
+	Options   MatchOptions `json:"options"`
+}
+
+func newPersistedGame(game *Game) *persistedGame {
+	pg := &persistedGame{
+		ID:        game.ID,
+		Status:    game.Status,
+		Winner:    game.Winner,
+		StartTime: game.StartTime,
+		EndTime:   game.EndTime,
+		MoveCount: game.MoveCount,
+		Options:   game.Options,
+	}
+	if game.Player1 != nil {
+		pg.Player1 = game.Player1.Username
+	}
+	if game.Player2 != nil {
+		pg.Player2 = game.Player2.Username
+	}
+	return pg
+}
+
+func (pg *persistedGame) game() *Game {
+	return &Game{
+		ID:        pg.ID,
+		Player1:   &Player{Username: pg.Player1, PlayerNum: Player1},
+		Player2:   &Player{Username: pg.Player2, PlayerNum: Player2},
+		Status:    pg.Status,
+		Winner:    pg.Winner,
+		StartTime: pg.StartTime,
+		EndTime:   pg.EndTime,
+		MoveCount: pg.MoveCount,
+		Options:   pg.Options,
+	}
+}
+
+func (job persistJob) run(store Store) error {
+	switch job.Op {
+	case opSaveGame:
+		return store.SaveGame(job.Game.game())
+	case opSaveMove:
+		return store.SaveMove(job.GameID, *job.Move)
+	case opSaveLiveGame:
+		return store.SaveLiveGame(job.GameID, job.InstanceID, job.State, job.UpdatedAt)
+	case opDeleteLiveGame:
+		return store.DeleteLiveGame(job.GameID)
+	case opRecordResult:
+		return store.RecordGameResult(job.Game.game(), job.Moves, job.Players)
+	case opSaveChat:
+		return store.SaveChatMessage(*job.Chat)
+	}
+	log.Printf("Dropping unknown persistence job %q", job.Op)
+	return nil
+}
+
+// Persister writes games, moves and chat to the store in the background, so
+// that game handlers holding gs.mu never wait on the database. Writes are
+// taken in without ever blocking and handed on in order by a dispatcher to
+// the workers; each game's writes go to the same worker and are applied in
+// order.
+//
+// Failed writes are retried with backoff. When a write still fails the store
+// is taken to be unreachable: from then on every write is appended to a spill
+// file on disk, in order, until the file has been replayed into the store.
+// The same happens when more than backlog writes are waiting, so a slow
+// store cannot make them pile up in memory. At most limit writes are held
+// in memory; past that new writes are refused, and game handlers refuse new
+// games, moves and chat while Backlogged reports true. Whatever is in the
+// file at startup is replayed before games are recovered.
+type Persister struct {
+	store  Store
+	queues []chan persistJob
+	wg     sync.WaitGroup
+
+	pendingMu sync.Mutex
+	pending   []persistJob // taken in but not yet handed to a worker
+	limit     int          // pending writes beyond which writes are refused
+	backlog   int          // pending writes beyond which writes are spilled
+	wake      chan struct{}
+
+	closeMu sync.RWMutex
+	closed  bool // writes after Close go straight to the spill file
+
+	spillMu   sync.Mutex
+	replayMu  sync.Mutex // held for a whole replay, so only one runs at a time
+	spillPath string
+	spilling  atomic.Bool  // writes go to the spill file until it has been replayed
+	spilled   atomic.Int64 // jobs in the spill file; both change only under spillMu
+
+	written    atomic.Int64
+	retries    atomic.Int64
+	overflowed atomic.Int64 // times the backlog grew too long and writes were spilled
+	rejected   atomic.Int64 // writes refused because limit writes were waiting
+	dropped    atomic.Int64 // writes the store rejected even though it was reachable
+	replayed   atomic.Int64
+
+	stop chan struct{}
+}
+
+func NewPersister(store Store, workers, queueSize int, spillPath string) *Persister {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Persister{
+		store:     store,
+		queues:    make([]chan persistJob, workers),
+		limit:     queueSize,
+		backlog:   (queueSize + 1) / 2,
+		wake:      make(chan struct{}, 1),
+		spillPath: spillPath,
+		stop:      make(chan struct{}),
+	}
+
+	// Catch up on writes from before the last shutdown first, so that
+	// recovery sees the store as the previous run left it
+	if n := p.countSpilled(); n > 0 {
+		log.Printf("Replaying %d writes spilled to %s", n, spillPath)
+		p.spilled.Store(int64(n))
+		p.spilling.Store(true)
+		p.replay()
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan persistJob, (queueSize+workers-1)/workers)
+		p.wg.Add(1)
+		go p.worker(p.queues[i])
+	}
+	go p.dispatch()
+	go p.replayLoop()
+	return p
+}
+
+func (p *Persister) SaveGame(game *Game) error {
+	return p.enqueue(persistJob{Op: opSaveGame, GameID: game.ID, Game: newPersistedGame(game)})
+}
+
+func (p *Persister) SaveMove(gameID string, move MoveRecord) error {
+	return p.enqueue(persistJob{Op: opSaveMove, GameID: gameID, Move: &move})
+}
+
+func (p *Persister) SaveLiveGame(gameID, instanceID string, state []byte, updatedAt time.Time) error {
+	return p.enqueue(persistJob{Op: opSaveLiveGame, GameID: gameID, InstanceID: instanceID, State: state, UpdatedAt: updatedAt})
+}
+
+func (p *Persister) DeleteLiveGame(gameID string) error {
+	return p.enqueue(persistJob{Op: opDeleteLiveGame, GameID: gameID})
+}
+
+func (p *Persister) RecordGameResult(game *Game, moves []MoveRecord, players []PlayerResult) error {
+	return p.enqueue(persistJob{Op: opRecordResult, GameID: game.ID, Game: newPersistedGame(game), Moves: moves, Players: players})
+}
+
+func (p *Persister) SaveChatMessage(msg ChatMessage) error {
+	return p.enqueue(persistJob{Op: opSaveChat, GameID: msg.GameID, Chat: &msg})
+}
+
+// enqueue takes job in for the dispatcher. It never waits, as callers may
+// hold gs.mu; once limit writes are waiting it refuses job with
+// errPersistBacklog instead.
+func (p *Persister) enqueue(job persistJob) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+
+	if p.closed {
+		p.spill(job)
+		return nil
+	}
+
+	waiting, ok := p.take(job)
+	if !ok {
+		p.rejected.Add(1)
+		return errPersistBacklog
+	}
+	if waiting > p.backlog && !p.spilling.Load() {
+		p.spillMu.Lock()
+		if !p.spilling.Load() {
+			log.Printf("Warning: %d writes waiting on the store, spilling writes to %s", waiting, p.spillPath)
+			p.overflowed.Add(1)
+			p.spilling.Store(true)
+		}
+		p.spillMu.Unlock()
+	}
+	return nil
+}
+
+// take adds job to the pending writes and returns how many there are. It
+// reports false, leaving job out, if limit writes are already waiting.
+// Caller must hold closeMu for reading.
+func (p *Persister) take(job persistJob) (int, bool) {
+	p.pendingMu.Lock()
+	waiting := len(p.pending)
+	if waiting >= p.limit {
+		p.pendingMu.Unlock()
+		return waiting, false
+	}
+	p.pending = append(p.pending, job)
+	waiting++
+	p.pendingMu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return waiting, true
+}
+
+// Backlogged reports whether more than backlog writes are waiting. Game
+// handlers refuse new games, moves and chat meanwhile, so that the writes
+// they cannot refuse, such as results, still find room.
+func (p *Persister) Backlogged() bool {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	return len(p.pending) > p.backlog
+}
+
+// dispatch hands the pending writes to the workers in the order they came
+// in, waiting for room in their queues. Once the persister is closed it
+// hands on what is left and closes the queues.
+func (p *Persister) dispatch() {
+	for {
+		p.pendingMu.Lock()
+		jobs := p.pending
+		p.pending = nil
+		p.pendingMu.Unlock()
+
+		if len(jobs) == 0 {
+			select {
+			case <-p.wake:
+				continue
+			case <-p.stop:
+			}
+			// Nothing is taken in after stop, but some may have come in
+			// just before it
+			p.pendingMu.Lock()
+			jobs = p.pending
+			p.pending = nil
+			p.pendingMu.Unlock()
+			for _, job := range jobs {
+				p.send(job)
+			}
+			for _, queue := range p.queues {
+				close(queue)
+			}
+			return
+		}
+
+		for _, job := range jobs {
+			p.send(job)
+		}
+	}
+}
+
+// send puts job in its game's queue, or a flush marker in every queue.
+func (p *Persister) send(job persistJob) {
+	if job.flushed != nil {
+		for _, queue := range p.queues {
+			queue <- job
+		}
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(job.GameID))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- job
+}
+
+func (p *Persister) worker(queue chan persistJob) {
+	defer p.wg.Done()
+	for job := range queue {
+		p.process(job)
+	}
+}
+
+// process writes job, retrying with backoff, or spills it.
+func (p *Persister) process(job persistJob) {
+	if job.flushed != nil {
+		job.flushed.Done()
+		return
+	}
+	if p.spillIfSpilling(job) {
+		return
+	}
+
+	delay := persistRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := job.run(p.store)
+		if err == nil {
+			p.written.Add(1)
+			return
+		}
+		if attempt == persistMaxAttempts {
+			if p.store.Ping() == nil {
+				// Reachable but refusing it; retrying will not help
+				log.Printf("Error persisting %s for game %s, dropping it: %v", job.Op, job.GameID, err)
+				p.dropped.Add(1)
+				return
+			}
+			log.Printf("Store unreachable, spilling writes to %s: %v", p.spillPath, err)
+			p.spill(job)
+			return
+		}
+		p.retries.Add(1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// errPersistBacklog is returned by Flush when writes are waiting for the
+// store to come back, and by the writes themselves when too many are waiting.
+var errPersistBacklog = errors.New("writes are waiting for the database, try again later")
+
+// Flush waits until every write queued before it has been processed. It
+// fails while writes are being spilled, as those reach the store only once
+// it is back.
+func (p *Persister) Flush() error {
+	var flushed sync.WaitGroup
+
+	p.closeMu.RLock()
+	if p.closed {
+		p.closeMu.RUnlock()
+		return errPersistBacklog
+	}
+	flushed.Add(len(p.queues))
+	if _, ok := p.take(persistJob{flushed: &flushed}); !ok {
+		p.closeMu.RUnlock()
+		return errPersistBacklog
+	}
+	p.closeMu.RUnlock()
+
+	flushed.Wait()
+	if p.spilling.Load() {
+		return errPersistBacklog
+	}
+	return nil
+}
+
+// spillIfSpilling appends job to the spill file if writes are being spilled,
+// reporting whether it did.
+func (p *Persister) spillIfSpilling(job persistJob) bool {
+	p.spillMu.Lock()
+	defer p.spillMu.Unlock()
+
+	if !p.spilling.Load() {
+		return false
+	}
+	p.spillLocked(job)
+	return true
+}
+
+// spill starts spilling every write, beginning with job.
+func (p *Persister) spill(job persistJob) {
+	p.spillMu.Lock()
+	defer p.spillMu.Unlock()
+
+	p.spilling.Store(true)
+	p.spillLocked(job)
+}
+
+// spillLocked appends job to the spill file. Caller must hold spillMu.
+func (p *Persister) spillLocked(job persistJob) {
+	if err := appendJSONLine(p.spillPath, job); err != nil {
+		log.Printf("Error spilling %s for game %s, it is lost: %v", job.Op, job.GameID, err)
+		return
+	}
+	p.spilled.Add(1)
+}
+
+func appendJSONLine(path string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (p *Persister) countSpilled() int {
+	jobs, err := readSpill(p.spillPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading spill file %s: %v", p.spillPath, err)
+	}
+	return len(jobs)
+}
+
+func readSpill(path string) ([]persistJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []persistJob
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var job persistJob
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+			// A write cut short by a crash can only be the last line
+			log.Printf("Skipping unreadable spilled write: %v", err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, scanner.Err()
+}
+
+// keepSpilled replaces the spill file with jobs. Caller must hold spillMu.
+func (p *Persister) keepSpilled(jobs []persistJob) {
+	tmp := p.spillPath + ".tmp"
+	os.Remove(tmp)
+	for _, job := range jobs {
+		if err := appendJSONLine(tmp, job); err != nil {
+			log.Printf("Error rewriting spill file %s: %v", p.spillPath, err)
+			return
+		}
+	}
+	if err := os.Rename(tmp, p.spillPath); err != nil {
+		log.Printf("Error rewriting spill file %s: %v", p.spillPath, err)
+		return
+	}
+	p.spilled.Store(int64(len(jobs)))
+}
+
+func (p *Persister) replayLoop() {
+	ticker := time.NewTicker(persistReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.replay()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// replay writes the spilled jobs to the store in order. spillMu is only
+// held while reading and rewriting the file, so workers keep spilling behind
+// it meanwhile; once every job, including those, has been written the file
+// is removed and writes go to the store again. If the store is still
+// unreachable it stops, keeping the jobs not yet written for later. After a
+// crash in the middle of a replay some jobs are written twice, which the
+// store tolerates for everything but chat.
+func (p *Persister) replay() {
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+
+	if !p.spilling.Load() {
+		return
+	}
+	if err := p.store.Ping(); err != nil {
+		return
+	}
+
+	done := 0
+	for {
+		p.spillMu.Lock()
+		jobs, err := readSpill(p.spillPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error reading spill file %s: %v", p.spillPath, err)
+			p.spillMu.Unlock()
+			return
+		}
+		if done >= len(jobs) {
+			// Nothing was spilled since the last read
+			if err := os.Remove(p.spillPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing spill file %s: %v", p.spillPath, err)
+				p.spillMu.Unlock()
+				return
+			}
+			log.Printf("Replayed %d spilled writes, writing to the store again", done)
+			p.spilling.Store(false)
+			p.spilled.Store(0)
+			p.spillMu.Unlock()
+			return
+		}
+		p.spillMu.Unlock()
+
+		for _, job := range jobs[done:] {
+			if err := job.run(p.store); err != nil {
+				if p.store.Ping() != nil {
+					log.Printf("Store unreachable again while replaying spilled writes: %v", err)
+					p.keepUnreplayed(done)
+					return
+				}
+				log.Printf("Error replaying %s for game %s, dropping it: %v", job.Op, job.GameID, err)
+				p.dropped.Add(1)
+			} else {
+				p.replayed.Add(1)
+			}
+			done++
+		}
+	}
+}
+
+// keepUnreplayed drops the first done jobs from the spill file, keeping the
+// rest, including any spilled while they were replayed.
+func (p *Persister) keepUnreplayed(done int) {
+	p.spillMu.Lock()
+	defer p.spillMu.Unlock()
+
+	jobs, err := readSpill(p.spillPath)
+	if err != nil {
+		log.Printf("Error reading spill file %s: %v", p.spillPath, err)
+		return
+	}
+	p.keepSpilled(jobs[done:])
+}
+
+// Close writes out everything still queued, spilling what the store does not
+// take, and stops the workers. Writes queued after Close are spilled, to be
+// replayed on the next start.
+func (p *Persister) Close() {
+	p.closeMu.Lock()
+	p.closed = true
+	close(p.stop)
+	p.closeMu.Unlock()
+	p.wg.Wait()
+
+	// Give the spill file one more chance before exiting
+	p.replay()
+}
+
+// Metrics reports the queue depth and what has happened to the writes so
+// far.
+func (p *Persister) Metrics() map[string]interface{} {
+	p.pendingMu.Lock()
+	pending := len(p.pending)
+	p.pendingMu.Unlock()
+
+	depth := pending
+	workers := make([]int, len(p.queues))
+	for i, queue := range p.queues {
+		workers[i] = len(queue)
+		depth += len(queue)
+	}
+
+	return map[string]interface{}{
+		"queued":         depth,
+		"backlog":        p.backlog,
+		"limit":          p.limit,
+		"queuedByWorker": workers,
+		"written":        p.written.Load(),
+		"retries":        p.retries.Load(),
+		"overflowed":     p.overflowed.Load(),
+		"rejected":       p.rejected.Load(),
+		"dropped":        p.dropped.Load(),
+		"spilling":       p.spilling.Load(),
+		"spilled":        p.spilled.Load(),
+		"replayed":       p.replayed.Load(),
+	}
+}
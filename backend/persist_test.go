@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store down")
+
+// recordingStore is a store for the persister that remembers the order of
+// the moves written to it, can be taken down, and can hold writes until
+// released.
+type recordingStore struct {
+	Store
+
+	mu    sync.Mutex
+	down  bool
+	moves map[string][]int // game ID -> move numbers, in the order written
+	chat  []string
+	hold  chan struct{} // writes wait for it to be closed when set
+}
+
+func newRecordingStore() *recordingStore {
+	return &recordingStore{Store: NewMemoryStore(), moves: make(map[string][]int)}
+}
+
+func (s *recordingStore) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *recordingStore) write(f func()) error {
+	s.mu.Lock()
+	hold := s.hold
+	s.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errStoreDown
+	}
+	f()
+	return nil
+}
+
+func (s *recordingStore) SaveMove(gameID string, move MoveRecord) error {
+	return s.write(func() { s.moves[gameID] = append(s.moves[gameID], move.MoveNum) })
+}
+
+func (s *recordingStore) SaveChatMessage(msg ChatMessage) error {
+	return s.write(func() { s.chat = append(s.chat, msg.Text) })
+}
+
+func (s *recordingStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errStoreDown
+	}
+	return nil
+}
+
+func (s *recordingStore) movesOf(gameID string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.moves[gameID]...)
+}
+
+func spillLines(t *testing.T, path string) int {
+	t.Helper()
+	jobs, err := readSpill(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("reading spill file: %v", err)
+	}
+	return len(jobs)
+}
+
+func saveMoves(t *testing.T, p *Persister, gameID string, from, to int) {
+	t.Helper()
+	for n := from; n <= to; n++ {
+		if err := p.SaveMove(gameID, MoveRecord{MoveNum: n}); err != nil {
+			t.Fatalf("SaveMove %d: %v", n, err)
+		}
+	}
+}
+
+func wantMoves(t *testing.T, got []int, from, to int) {
+	t.Helper()
+	if len(got) != to-from+1 {
+		t.Fatalf("got moves %v, want %d..%d", got, from, to)
+	}
+	for i, n := range got {
+		if n != from+i {
+			t.Fatalf("got moves %v, want %d..%d in order", got, from, to)
+		}
+	}
+}
+
+func TestPersisterSpillsWhileStoreDown(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		moves   int
+	}{
+		{"one worker", 1, 3},
+		{"several workers", 4, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newRecordingStore()
+			store.setDown(true)
+			path := filepath.Join(t.TempDir(), "spill.jsonl")
+			p := NewPersister(store, tt.workers, 64, path)
+			defer p.Close()
+
+			saveMoves(t, p, "g1", 1, tt.moves)
+			if err := p.Flush(); !errors.Is(err, errPersistBacklog) {
+				t.Fatalf("Flush with the store down = %v, want errPersistBacklog", err)
+			}
+			if got := spillLines(t, path); got != tt.moves {
+				t.Fatalf("spilled %d writes, want %d", got, tt.moves)
+			}
+			if got := store.movesOf("g1"); len(got) != 0 {
+				t.Fatalf("store got moves %v while down", got)
+			}
+
+			// Writes keep going to the file, behind the spilled ones
+			saveMoves(t, p, "g1", tt.moves+1, tt.moves+1)
+			p.Flush()
+			if got := spillLines(t, path); got != tt.moves+1 {
+				t.Fatalf("spilled %d writes, want %d", got, tt.moves+1)
+			}
+
+			store.setDown(false)
+			p.replay()
+			wantMoves(t, store.movesOf("g1"), 1, tt.moves+1)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("spill file still there after replay: %v", err)
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatalf("Flush after replay: %v", err)
+			}
+		})
+	}
+}
+
+func TestPersisterReplaysSpillAfterRestart(t *testing.T) {
+	tests := []struct {
+		name      string
+		downAgain bool // store still down at the restart
+	}{
+		{"store back", false},
+		{"store still down", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newRecordingStore()
+			store.setDown(true)
+			path := filepath.Join(t.TempDir(), "spill.jsonl")
+
+			p := NewPersister(store, 2, 64, path)
+			saveMoves(t, p, "g1", 1, 3)
+			p.Close()
+			// Written after Close, straight to the file
+			saveMoves(t, p, "g1", 4, 4)
+			if got := spillLines(t, path); got != 4 {
+				t.Fatalf("spilled %d writes before restart, want 4", got)
+			}
+
+			store.setDown(tt.downAgain)
+			p = NewPersister(store, 2, 64, path)
+			defer p.Close()
+
+			if tt.downAgain {
+				if got := spillLines(t, path); got != 4 {
+					t.Fatalf("spill file has %d writes, want all 4 kept", got)
+				}
+				if !p.spilling.Load() {
+					t.Fatal("not spilling with writes left in the file")
+				}
+				store.setDown(false)
+				p.replay()
+			}
+			wantMoves(t, store.movesOf("g1"), 1, 4)
+			if p.spilling.Load() {
+				t.Fatal("still spilling after the file was replayed")
+			}
+		})
+	}
+}
+
+func TestPersisterFlushWaitsForInFlightWrites(t *testing.T) {
+	store := newRecordingStore()
+	store.hold = make(chan struct{})
+	p := NewPersister(store, 2, 64, filepath.Join(t.TempDir(), "spill.jsonl"))
+	defer p.Close()
+
+	saveMoves(t, p, "g1", 1, 2)
+	if err := p.SaveChatMessage(ChatMessage{GameID: "g2", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- p.Flush() }()
+
+	select {
+	case err := <-flushed:
+		t.Fatalf("Flush returned %v with writes still held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.hold)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush did not return once writes went through")
+	}
+	wantMoves(t, store.movesOf("g1"), 1, 2)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.chat) != 1 {
+		t.Fatalf("chat written %d times, want 1", len(store.chat))
+	}
+}
+
+func TestPersisterKeepsEachGamesWritesInOrder(t *testing.T) {
+	for _, workers := range []int{1, 3, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			store := newRecordingStore()
+			p := NewPersister(store, workers, 4096, filepath.Join(t.TempDir(), "spill.jsonl"))
+			defer p.Close()
+
+			const games, moves = 20, 30
+			// Interleave the games, as concurrent games would
+			for n := 1; n <= moves; n++ {
+				for g := 0; g < games; g++ {
+					saveMoves(t, p, fmt.Sprintf("game-%d", g), n, n)
+				}
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			for g := 0; g < games; g++ {
+				wantMoves(t, store.movesOf(fmt.Sprintf("game-%d", g)), 1, moves)
+			}
+		})
+	}
+}
+
+func TestPersisterRefusesWritesPastLimit(t *testing.T) {
+	store := newRecordingStore()
+	store.hold = make(chan struct{})
+	p := NewPersister(store, 1, 4, filepath.Join(t.TempDir(), "spill.jsonl"))
+	defer p.Close()
+	defer close(store.hold)
+
+	// The worker holds one write and its queue takes the next four; only
+	// then do writes wait in memory
+	var err error
+	for n := 1; n <= 20 && err == nil; n++ {
+		err = p.SaveMove("g1", MoveRecord{MoveNum: n})
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(err, errPersistBacklog) {
+		t.Fatalf("SaveMove past the limit = %v, want errPersistBacklog", err)
+	}
+	if !p.Backlogged() {
+		t.Fatal("not backlogged with the queue full")
+	}
+	if got := p.Metrics()["rejected"].(int64); got != 1 {
+		t.Fatalf("rejected = %d, want 1", got)
+	}
+}
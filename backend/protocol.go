@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Versions of the WebSocket protocol this server speaks. Clients list the
+// versions they support in "hello" and get the highest one in common;
+// connections that skip the handshake are assumed to speak ProtocolVersion.
+// Only version 1 exists so far, so every client gets the same payloads and
+// the agreed version is not kept; a version 2 would record it on the Client
+// and choose payloads by it.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Machine-readable codes carried by "error" messages. Message texts are for
+// people and may change; codes are part of the protocol.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeInvalidOptions     = "invalid_options"
+	ErrCodeInvalidUsername    = "invalid_username"
+	ErrCodeNotInGame          = "not_in_game"
+	ErrCodeGameNotFound       = "game_not_found"
+	ErrCodeGameInProgress     = "game_in_progress"
+	ErrCodeInvalidResumeToken = "invalid_resume_token"
+	ErrCodeMessageTooLong     = "message_too_long"
+	ErrCodeMuted              = "muted"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeNotYourTurn        = "not_your_turn"
+	ErrCodeInvalidColumn      = "invalid_column"
+	ErrCodeColumnFull         = "column_full"
+	ErrCodeGameOver           = "game_over"
+	ErrCodeServerDraining     = "server_draining"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeQueueCleared       = "queue_cleared"
+)
+
+// InboundMessage is the envelope of every client message. Data is decoded
+// into the payload type listed for Type in clientMessageTypes. Clients that
+// set RequestID get an "ack" or "rejected" carrying it back.
+type InboundMessage struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Message is the envelope of every server message. Data holds the payload
+// type listed for Type in serverMessageTypes.
+type Message struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// decodePayload unmarshals the data of an inbound message into v. Messages
+// without data decode to the zero payload.
+func decodePayload(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid data: %v", err)
+	}
+	return nil
+}
+
+// ack confirms a successful request, if the client gave it an ID.
+func ack(client *Client, requestID string) {
+	if requestID != "" {
+		client.Send(Message{Type: "ack", Data: AckPayload{RequestID: requestID}})
+	}
+}
+
+// reject answers a failed request: with "rejected" when the client gave it a
+// request ID, otherwise with a plain "error".
+func reject(client *Client, requestID, code, message string) {
+	rejectWith(client, requestID, ErrorPayload{Code: code, Message: message})
+}
+
+func rejectWith(client *Client, requestID string, e ErrorPayload) {
+	if requestID == "" {
+		client.Send(Message{Type: "error", Data: e})
+		return
+	}
+	client.Send(Message{
+		Type: "rejected",
+		Data: RejectedPayload{RequestID: requestID, Code: e.Code, Message: e.Message, GameID: e.GameID},
+	})
+}
+
+func sendError(client *Client, code, message string) {
+	client.Send(Message{
+		Type: "error",
+		Data: ErrorPayload{Code: code, Message: message},
+	})
+}
+
+// moveErrorCode maps the errors of handleMove to rejection codes.
+func moveErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrNotYourTurn):
+		return ErrCodeNotYourTurn
+	case errors.Is(err, ErrInvalidColumn):
+		return ErrCodeInvalidColumn
+	case errors.Is(err, ErrColumnFull):
+		return ErrCodeColumnFull
+	case errors.Is(err, ErrGameOver):
+		return ErrCodeGameOver
+	}
+	return ErrCodeBadRequest
+}
+
+// negotiateVersion picks the highest version both sides speak, or 0 if there
+// is none. A client listing no versions is taken to speak the current one,
+// as if it had skipped hello.
+func negotiateVersion(versions []int) int {
+	if len(versions) == 0 {
+		return ProtocolVersion
+	}
+	best := 0
+	for _, v := range versions {
+		if v >= MinProtocolVersion && v <= ProtocolVersion && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// Client -> server payloads
+
+type HelloPayload struct {
+	Versions []int  `json:"versions"`
+	Client   string `json:"client,omitempty"` // free-form name/version, for logs
+}
+
+type JoinPayload struct {
+	BoardSize   string `json:"boardSize,omitempty"`
+	Variant     string `json:"variant,omitempty"`
+	TimeControl string `json:"timeControl,omitempty"`
+	BotPolicy   string `json:"botPolicy,omitempty"` // "now", "never" or "after"
+	BotAfter    int    `json:"botAfter,omitempty"`  // seconds, with botPolicy "after"
+	ResumeToken string `json:"resumeToken,omitempty"`
+}
+
+type MovePayload struct {
+	Column *int `json:"column"` // a pointer so that column 0 differs from no column
+}
+
+type ReconnectPayload struct {
+	GameID      string `json:"gameId"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+type ChatPayload struct {
+	Text string `json:"text"`
+}
+
+type MutePayload struct {
+	Target string `json:"target"`
+}
+
+type SpectatePayload struct {
+	GameID string `json:"gameId"`
+}
+
+// Server -> client payloads
+
+type WelcomePayload struct {
+	Version  int    `json:"version"`
+	Username string `json:"username"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	GameID  string `json:"gameId,omitempty"`
+}
+
+// AckPayload confirms the request RequestID. For moves, MoveNum is the move
+// it became, and Duplicate is set when the move had already been applied.
+type AckPayload struct {
+	RequestID string `json:"requestId"`
+	MoveNum   int    `json:"moveNum,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// RejectedPayload is an ErrorPayload answering the request RequestID.
+type RejectedPayload struct {
+	RequestID string `json:"requestId"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	GameID    string `json:"gameId,omitempty"`
+}
+
+type WaitingPayload struct {
+	Message      string       `json:"message"`
+	Queue        MatchOptions `json:"queue"`
+	BotPolicy    string       `json:"botPolicy"`
+	BotAfterSecs int          `json:"botAfterSecs"`
+}
+
+// GameState is the board as every participant sees it.
+type GameState struct {
+	Board       [Rows][Cols]int `json:"board"`
+	CurrentTurn int             `json:"currentTurn"`
+	Status      string          `json:"status"`
+	Winner      int             `json:"winner"`
+	WinnerName  string          `json:"winnerName,omitempty"` // once finished, empty on a draw
+	MoveCount   int             `json:"moveCount"`
+	Options     MatchOptions    `json:"options"`
+}
+
+type GameStartPayload struct {
+	GameID        string    `json:"gameId"`
+	PlayerNum     int       `json:"playerNum"`
+	ResumeToken   string    `json:"resumeToken"`
+	Opponent      string    `json:"opponent"`
+	OpponentIsBot bool      `json:"opponentIsBot"`
+	BotDifficulty string    `json:"botDifficulty,omitempty"`
+	GameState     GameState `json:"gameState"`
+}
+
+type GameUpdatePayload struct {
+	GameState GameState `json:"gameState"`
+}
+
+type ReconnectedPayload struct {
+	GameID    string    `json:"gameId"`
+	PlayerNum int       `json:"playerNum"`
+	Opponent  string    `json:"opponent"`
+	GameState GameState `json:"gameState"`
+}
+
+type SpectatingPayload struct {
+	GameID    string    `json:"gameId"`
+	Player1   string    `json:"player1"`
+	Player2   string    `json:"player2"`
+	GameState GameState `json:"gameState"`
+}
+
+type ChatRelayPayload struct {
+	GameID    string `json:"gameId"`
+	From      string `json:"from"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type MuteUpdatedPayload struct {
+	Username string `json:"username"`
+	Muted    bool   `json:"muted"`
+}
+
+type OpponentDisconnectedPayload struct {
+	Opponent  string `json:"opponent"`
+	ForfeitIn int    `json:"forfeitIn"` // seconds
+	ForfeitAt int64  `json:"forfeitAt"` // unix time
+}
+
+type OpponentReconnectedPayload struct {
+	Opponent string `json:"opponent"`
+}
+
+type SessionReplacedPayload struct {
+	GameID  string `json:"gameId"`
+	Message string `json:"message"`
+}
+
+// ShutdownPendingPayload warns players that the server will restart at
+// Deadline (unix time).
+type ShutdownPendingPayload struct {
+	Message  string `json:"message"`
+	Deadline int64  `json:"deadline"`
+}
+
+// ServerRestartingPayload precedes the server closing the connection.
+// Resumable games can be reconnected to once the server is back.
+type ServerRestartingPayload struct {
+	Message   string `json:"message"`
+	Resumable bool   `json:"resumable"`
+}
+
+// NoticePayload is an announcement from the operators.
+type NoticePayload struct {
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// GameAbortedPayload tells participants a game was discarded without a
+// result.
+type GameAbortedPayload struct {
+	GameID string `json:"gameId"`
+	Reason string `json:"reason"`
+}
+
+// KickedPayload precedes the server closing a connection on an operator's
+// request.
+type KickedPayload struct {
+	Reason string `json:"reason"`
+}
+
+// Payload type of every message, used to publish the JSON Schema. Adding a
+// message type means adding it here.
+var clientMessageTypes = map[string]interface{}{
+	"hello":     HelloPayload{},
+	"join":      JoinPayload{},
+	"move":      MovePayload{},
+	"reconnect": ReconnectPayload{},
+	"chat":      ChatPayload{},
+	"mute":      MutePayload{},
+	"unmute":    MutePayload{},
+	"spectate":  SpectatePayload{},
+}
+
+var serverMessageTypes = map[string]interface{}{
+	"welcome":               WelcomePayload{},
+	"error":                 ErrorPayload{},
+	"ack":                   AckPayload{},
+	"rejected":              RejectedPayload{},
+	"waiting":               WaitingPayload{},
+	"game_start":            GameStartPayload{},
+	"game_update":           GameUpdatePayload{},
+	"reconnected":           ReconnectedPayload{},
+	"spectating":            SpectatingPayload{},
+	"chat":                  ChatRelayPayload{},
+	"mute_updated":          MuteUpdatedPayload{},
+	"opponent_disconnected": OpponentDisconnectedPayload{},
+	"opponent_reconnected":  OpponentReconnectedPayload{},
+	"session_replaced":      SessionReplacedPayload{},
+	"shutdown_pending":      ShutdownPendingPayload{},
+	"server_restarting":     ServerRestartingPayload{},
+	"notice":                NoticePayload{},
+	"game_aborted":          GameAbortedPayload{},
+	"kicked":                KickedPayload{},
+}
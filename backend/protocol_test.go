@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []int
+		want     int
+	}{
+		{"no versions", nil, ProtocolVersion},
+		{"empty list", []int{}, ProtocolVersion},
+		{"current", []int{ProtocolVersion}, ProtocolVersion},
+		{"newer ones too", []int{ProtocolVersion, ProtocolVersion + 1, ProtocolVersion + 5}, ProtocolVersion},
+		{"only newer", []int{ProtocolVersion + 1}, 0},
+		{"only older", []int{MinProtocolVersion - 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateVersion(tt.versions); got != tt.want {
+				t.Errorf("negotiateVersion(%v) = %d, want %d", tt.versions, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket allows bursts of up to capacity events, refilled at a steady
+// rate. It is safe for concurrent use.
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+// newTokenBucket allows `capacity` events per `per`, starting full. Both must
+// be positive; limits from the environment are checked when loading Config.
+func newTokenBucket(capacity int, per time.Duration) *tokenBucket {
+	if capacity <= 0 || per <= 0 {
+		panic(fmt.Sprintf("newTokenBucket: %d per %v is not a rate", capacity, per))
+	}
+	return &tokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		rate:     float64(capacity) / per.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	// Callers take now before locking, so it can be behind the last refill
+	if !now.After(b.last) {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// Allow takes a token if one is available.
+func (b *tokenBucket) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Full reports whether the bucket has refilled completely, i.e. it has been
+// idle long enough to be discarded.
+func (b *tokenBucket) Full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// Server-wide counters for refused WebSocket traffic, reported on
+// /api/metrics
+var (
+	rejectedOrigin       atomic.Int64
+	rejectedConnsPerIP   atomic.Int64
+	rejectedConnRate     atomic.Int64
+	rateLimitedMessages  atomic.Int64
+	oversizedMessages    atomic.Int64
+	rateLimitDisconnects atomic.Int64
+)
+
+// connLimiter caps how many WebSockets one IP may hold open and how fast it
+// may open new ones.
+type connLimiter struct {
+	mu       sync.Mutex
+	maxOpen  int // 0 for no limit
+	rate     int // new connections per ratePer, 0 for no limit
+	ratePer  time.Duration
+	open     map[string]int
+	attempts map[string]*tokenBucket
+}
+
+func newConnLimiter(maxOpen, rate int, per time.Duration) *connLimiter {
+	return &connLimiter{
+		maxOpen:  maxOpen,
+		rate:     rate,
+		ratePer:  per,
+		open:     make(map[string]int),
+		attempts: make(map[string]*tokenBucket),
+	}
+}
+
+// Acquire admits a new connection from ip, returning why not if it may not.
+// Admitted connections must be given back with Release.
+func (l *connLimiter) Acquire(ip string, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate > 0 {
+		bucket := l.attempts[ip]
+		if bucket == nil {
+			bucket = newTokenBucket(l.rate, l.ratePer)
+			l.attempts[ip] = bucket
+		}
+		if !bucket.Allow(now) {
+			rejectedConnRate.Add(1)
+			return errTooManyAttempts
+		}
+	}
+
+	if l.maxOpen > 0 && l.open[ip] >= l.maxOpen {
+		rejectedConnsPerIP.Add(1)
+		return errTooManyConns
+	}
+	l.open[ip]++
+	return nil
+}
+
+func (l *connLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+// Prune forgets IPs whose attempt buckets have refilled.
+func (l *connLimiter) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, bucket := range l.attempts {
+		if bucket.Full(now) {
+			delete(l.attempts, ip)
+		}
+	}
+}
+
+var (
+	errTooManyConns    = errors.New("too many connections from this address")
+	errTooManyAttempts = errors.New("connecting too often from this address")
+)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		capacity int
+		per      time.Duration
+		at       []time.Duration // when Allow is called, from start
+		want     []bool
+	}{
+		{"burst up to capacity", 3, time.Second, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills one token per per/capacity", 2, time.Second, []time.Duration{0, 0, 0, 499 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond}, []bool{true, true, false, false, true, false}},
+		{"refills no further than capacity", 2, time.Second, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+		{"one per minute", 1, time.Minute, []time.Duration{0, 30 * time.Second, time.Minute}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.capacity, tt.per)
+			b.last = start
+			for i, at := range tt.at {
+				if got := b.Allow(start.Add(at)); got != tt.want[i] {
+					t.Fatalf("Allow #%d at %v = %v, want %v", i+1, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, time.Second)
+	b.last = start
+	if !b.Full(start) {
+		t.Fatal("new bucket not full")
+	}
+	b.Allow(start)
+	if b.Full(start.Add(100 * time.Millisecond)) {
+		t.Fatal("full before refilling")
+	}
+	if !b.Full(start.Add(500 * time.Millisecond)) {
+		t.Fatal("not full after refilling")
+	}
+}
+
+func TestNewTokenBucketRejectsNonRates(t *testing.T) {
+	tests := []struct {
+		capacity int
+		per      time.Duration
+	}{
+		{0, time.Second},
+		{-1, time.Second},
+		{5, 0},
+		{5, -time.Second},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("newTokenBucket(%d, %v) did not panic", tt.capacity, tt.per)
+				}
+			}()
+			newTokenBucket(tt.capacity, tt.per)
+		}()
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	now := time.Now()
+	l := newConnLimiter(2, 3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire("1.2.3.4", now); err != nil {
+			t.Fatalf("Acquire #%d: %v", i+1, err)
+		}
+	}
+	if err := l.Acquire("1.2.3.4", now); !errors.Is(err, errTooManyConns) {
+		t.Fatalf("third open connection = %v, want errTooManyConns", err)
+	}
+	if err := l.Acquire("5.6.7.8", now); err != nil {
+		t.Fatalf("other address: %v", err)
+	}
+
+	// The refused attempt used up the rate too
+	l.Release("1.2.3.4")
+	if err := l.Acquire("1.2.3.4", now); !errors.Is(err, errTooManyAttempts) {
+		t.Fatalf("fourth attempt in a minute = %v, want errTooManyAttempts", err)
+	}
+	if err := l.Acquire("1.2.3.4", now.Add(21*time.Second)); err != nil {
+		t.Fatalf("after the rate refilled: %v", err)
+	}
+
+	l.Release("1.2.3.4")
+	l.Release("1.2.3.4")
+	l.Release("5.6.7.8")
+	l.Prune(now.Add(time.Hour))
+	if len(l.open) != 0 || len(l.attempts) != 0 {
+		t.Fatalf("limiter still tracks %d open and %d attempting addresses", len(l.open), len(l.attempts))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	DefaultRating = 1200
+	eloK          = 32
+)
+
+// eloDelta returns the rating change for a player rated `rating` who scored
+// `score` (1 win, 0.5 draw, 0 loss) against an opponent rated `opponent`.
+func eloDelta(rating, opponent int, score float64) int {
+	expected := 1 / (1 + math.Pow(10, float64(opponent-rating)/400))
+	return int(math.Round(eloK * (score - expected)))
+}
+
+// playerRating is the rating a participant brings into a game; bots use the
+// nominal rating of their difficulty level.
+func playerRating(p *Player) int {
+	if p.IsBot {
+		return p.BotDifficulty.Rating
+	}
+	return p.Rating
+}
+
+// playerResults works out how a finished game counts for each of its human
+// players, including their Elo changes.
+func playerResults(game *Game) []PlayerResult {
+	score := 0.5
+	if game.Winner == Player1 {
+		score = 1
+	} else if game.Winner == Player2 {
+		score = 0
+	}
+
+	rating1, rating2 := playerRating(game.Player1), playerRating(game.Player2)
+
+	var results []PlayerResult
+	if !game.Player1.IsBot {
+		results = append(results, PlayerResult{
+			Username:    game.Player1.Username,
+			Won:         game.Winner == Player1,
+			Drawn:       game.Winner == 0,
+			Moves:       game.MovesBy(Player1),
+			RatingDelta: eloDelta(rating1, rating2, score),
+		})
+	}
+	if !game.Player2.IsBot {
+		results = append(results, PlayerResult{
+			Username:    game.Player2.Username,
+			Won:         game.Winner == Player2,
+			Drawn:       game.Winner == 0,
+			Moves:       game.MovesBy(Player2),
+			RatingDelta: eloDelta(rating2, rating1, 1-score),
+		})
+	}
+	return results
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// What happens to a game nobody returns to, either after a restart or because
+// both players dropped
+const (
+	StaleGameDraw    = "draw"    // finish as a draw, stats and ratings updated
+	StaleGameForfeit = "forfeit" // the player to move loses
+	StaleGameAbort   = "abort"   // discard the game without a result
+)
+
+// liveGameSnapshot is what is persisted of an in-progress game after every
+// move, enough to carry on after a restart.
+type liveGameSnapshot struct {
+	ID          string            `json:"id"`
+	Board       [Rows][Cols]int   `json:"board"`
+	Moves       []int             `json:"moves"`
+	CurrentTurn int               `json:"currentTurn"`
+	MoveCount   int               `json:"moveCount"`
+	StartTime   time.Time         `json:"startTime"`
+	Options     MatchOptions      `json:"options"`
+	Players     [2]playerSnapshot `json:"players"`
+}
+
+type playerSnapshot struct {
+	Username      string `json:"username"`
+	IsBot         bool   `json:"isBot,omitempty"`
+	Rating        int    `json:"rating"`
+	BotDifficulty string `json:"botDifficulty,omitempty"`
+	ResumeToken   string `json:"resumeToken,omitempty"`
+	LastMoveID    string `json:"lastMoveId,omitempty"`
+	LastMoveNum   int    `json:"lastMoveNum,omitempty"`
+}
+
+func snapshotGame(game *Game) liveGameSnapshot {
+	snap := liveGameSnapshot{
+		ID:          game.ID,
+		Board:       game.Board,
+		Moves:       game.Moves,
+		CurrentTurn: game.CurrentTurn,
+		MoveCount:   game.MoveCount,
+		StartTime:   game.StartTime,
+		Options:     game.Options,
+	}
+	for i, p := range []*Player{game.Player1, game.Player2} {
+		snap.Players[i] = playerSnapshot{
+			Username:      p.Username,
+			IsBot:         p.IsBot,
+			Rating:        p.Rating,
+			BotDifficulty: p.BotDifficulty.Name,
+			ResumeToken:   p.ResumeToken,
+			LastMoveID:    p.LastMoveID,
+			LastMoveNum:   p.LastMoveNum,
+		}
+	}
+	return snap
+}
+
+// restoreGame rebuilds a game from its snapshot. Humans start out
+// disconnected.
+func restoreGame(snap liveGameSnapshot, now time.Time) (*Game, error) {
+	game := NewGame(snap.ID)
+	game.Board = snap.Board
+	game.Moves = snap.Moves
+	game.CurrentTurn = snap.CurrentTurn
+	game.MoveCount = snap.MoveCount
+	game.Status = "playing"
+	game.StartTime = snap.StartTime
+	game.LastActivityTime = now
+	game.Options = snap.Options
+
+	players := make([]*Player, 2)
+	for i, ps := range snap.Players {
+		if ps.Username == "" {
+			return nil, fmt.Errorf("player %d missing", i+1)
+		}
+		players[i] = &Player{
+			Username:    ps.Username,
+			PlayerNum:   i + 1,
+			IsBot:       ps.IsBot,
+			Connected:   ps.IsBot,
+			LastSeen:    now,
+			Options:     snap.Options,
+			Rating:      ps.Rating,
+			MutedUsers:  make(map[string]bool),
+			ResumeToken: ps.ResumeToken,
+			LastMoveID:  ps.LastMoveID,
+			LastMoveNum: ps.LastMoveNum,
+		}
+		if ps.IsBot {
+			players[i].BotDifficulty = botDifficultyByName(ps.BotDifficulty)
+		}
+	}
+	game.Player1, game.Player2 = players[0], players[1]
+
+	return game, nil
+}
+
+// saveLiveGame persists the current state of an in-progress game. Caller must
+// hold gs.mu.
+func (gs *GameServer) saveLiveGame(game *Game) {
+	state, err := json.Marshal(snapshotGame(game))
+	if err != nil {
+		log.Printf("Error encoding game %s: %v", game.ID, err)
+		return
+	}
+	if err := gs.persist.SaveLiveGame(game.ID, gs.cluster.InstanceID(), state, time.Now()); err != nil {
+		log.Printf("Error saving live game %s: %v", game.ID, err)
+	}
+}
+
+// recoverGames reloads the games that were in progress when the server last
+// stopped. Players get the usual forfeit timeout to reconnect; games that
+// were already idle for longer than RecoveryMaxAge are resolved right away.
+// In a cluster each instance recovers only the games it owned.
+func (gs *GameServer) recoverGames() {
+	owner := ""
+	if gs.config.ClusterBackend != ClusterMemory {
+		owner = gs.cluster.InstanceID()
+	}
+	records, err := gs.store.LoadLiveGames(owner)
+	if err != nil {
+		log.Printf("Error loading live games: %v", err)
+		return
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	now := time.Now()
+	recovered, stale, discarded := 0, 0, 0
+	for _, rec := range records {
+		var snap liveGameSnapshot
+		var game *Game
+		err := json.Unmarshal(rec.State, &snap)
+		if err == nil {
+			game, err = restoreGame(snap, now)
+		}
+		if err != nil {
+			log.Printf("Discarding unreadable live game %s: %v", rec.GameID, err)
+			if err := gs.persist.DeleteLiveGame(rec.GameID); err != nil {
+				log.Printf("Error deleting live game %s: %v", rec.GameID, err)
+			}
+			discarded++
+			continue
+		}
+
+		gs.games[game.ID] = game
+		if err := gs.cluster.RegisterGame(game.ID, game.Player1.Username, game.Player2.Username); err != nil {
+			log.Printf("Error registering game %s: %v", game.ID, err)
+		}
+		for _, p := range []*Player{game.Player1, game.Player2} {
+			if !p.IsBot {
+				gs.playerGames[p.Username] = game.ID
+			}
+		}
+
+		if now.Sub(rec.UpdatedAt) > gs.config.RecoveryMaxAge {
+			gs.resolveStaleGame(game, now)
+			stale++
+			continue
+		}
+		recovered++
+
+		if game.Player2.IsBot && game.CurrentTurn == Player2 {
+			go func(game *Game) {
+				bot := NewBot(Player2, game.Player2.BotDifficulty)
+				bot.MakeMoveWithDelay(game, gs)
+			}(game)
+		}
+	}
+
+	log.Printf("Recovered %d in-progress games, resolved %d stale ones, discarded %d unreadable ones", recovered, stale, discarded)
+}
+
+// abortGame discards a game without recording a result; its history row is
+// kept, marked aborted. Caller must hold gs.mu.
+func (gs *GameServer) abortGame(game *Game) {
+	delete(gs.playerGames, game.Player1.Username)
+	delete(gs.playerGames, game.Player2.Username)
+	delete(gs.games, game.ID)
+	game.Status = "aborted"
+	game.Winner = 0
+	game.EndTime = time.Now()
+	if err := gs.persist.SaveGame(game); err != nil {
+		log.Printf("Error saving aborted game %s: %v", game.ID, err)
+	}
+	if err := gs.persist.DeleteLiveGame(game.ID); err != nil {
+		log.Printf("Error deleting live game %s: %v", game.ID, err)
+	}
+	gs.cluster.UnregisterGame(game.ID)
+}
+
+// abandoned reports whether both players of a human game have been gone
+// longer than the forfeit timeout, so that forfeiting either would be
+// arbitrary.
+func (gs *GameServer) abandoned(game *Game, now time.Time) bool {
+	if game.Player2.IsBot {
+		return false
+	}
+	gone := func(p *Player) bool {
+		return !p.Connected && now.Sub(p.LastSeen) > gs.config.ForfeitTimeout
+	}
+	return gone(game.Player1) && gone(game.Player2)
+}
+
+// resolveStaleGame ends a game nobody is playing according to the configured
+// StaleGamePolicy. Caller must hold gs.mu.
+func (gs *GameServer) resolveStaleGame(game *Game, now time.Time) {
+	log.Printf("Resolving stale game %s (%s vs %s) by %s", game.ID, game.Player1.Username, game.Player2.Username, gs.config.StaleGamePolicy)
+
+	if gs.config.StaleGamePolicy == StaleGameAbort {
+		gs.abortGame(game)
+		return
+	}
+
+	game.Winner = 0
+	if gs.config.StaleGamePolicy == StaleGameForfeit {
+		game.Winner = opponentOf(game.CurrentTurn)
+	}
+	game.Status = "finished"
+	game.EndTime = now
+	gs.broadcastGameState(game)
+	gs.handleGameEnd(game)
+	delete(gs.games, game.ID)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// session is the server's view of one connection. Local sessions belong to a
+// WebSocket on this instance; remote ones stand in for a connection on
+// another instance whose messages about a game owned here are relayed to us.
+type session struct {
+	client     *Client
+	identity   string // authenticated username
+	username   string // set once the player joins or reconnects
+	spectating string // gameID this connection is watching
+	remote     string // instance holding the connection, "" if local
+}
+
+// addSession registers a local connection so that other instances can reach
+// it. Caller must not hold gs.routeMu.
+func (gs *GameServer) addSession(s *session) {
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	gs.sessions[s.client.id] = s
+}
+
+// localSession returns the local connection with the given ID, if still open.
+func (gs *GameServer) localSession(connID string) *session {
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	return gs.sessions[connID]
+}
+
+// remoteSession returns the stand-in for connection connID on instance, creating
+// it on first use.
+func (gs *GameServer) remoteSession(instance, connID, username string) *session {
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	if s := gs.remoteSessions[connID]; s != nil {
+		return s
+	}
+
+	self := gs.cluster.InstanceID()
+	client := newRelayClient(connID, func(kind string, data []byte) {
+		err := gs.cluster.Send(instance, ClusterMessage{Kind: kind, From: self, ConnID: connID, Data: data})
+		if err != nil {
+			log.Printf("Error relaying to %s on %s: %v", connID, instance, err)
+		}
+	})
+	client.remote = instance
+
+	s := &session{client: client, identity: username, remote: instance}
+	gs.remoteSessions[connID] = s
+	return s
+}
+
+// endSession cleans up after a connection has gone, whether it was local or
+// remote. Instances a local connection was relayed to are told as well.
+func (gs *GameServer) endSession(s *session) {
+	if s.username != "" {
+		gs.handleDisconnect(s.username, s.client)
+	}
+	if s.spectating != "" {
+		gs.removeSpectator(s.client, s.spectating)
+	}
+
+	gs.routeMu.Lock()
+	var peers map[string]bool
+	if s.remote == "" {
+		peers = gs.peers[s.client.id]
+		delete(gs.sessions, s.client.id)
+		delete(gs.routes, s.client.id)
+		delete(gs.peers, s.client.id)
+	} else {
+		delete(gs.remoteSessions, s.client.id)
+	}
+	gs.routeMu.Unlock()
+
+	s.client.Close()
+	for instance := range peers {
+		gs.sendCluster(instance, ClusterMessage{Kind: clusterClosed, ConnID: s.client.id, Username: s.identity})
+	}
+}
+
+// touchPeers tells every instance a local connection was relayed to that it
+// is still alive.
+func (gs *GameServer) touchPeers(s *session) {
+	gs.routeMu.Lock()
+	peers := make([]string, 0, len(gs.peers[s.client.id]))
+	for instance := range gs.peers[s.client.id] {
+		peers = append(peers, instance)
+	}
+	gs.routeMu.Unlock()
+
+	for _, instance := range peers {
+		gs.sendCluster(instance, ClusterMessage{Kind: clusterTouch, ConnID: s.client.id, Username: s.identity})
+	}
+}
+
+// setRoute sends the game messages of a local connection to owner from now on.
+func (gs *GameServer) setRoute(connID, owner string) {
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+
+	gs.routes[connID] = owner
+	gs.addPeer(connID, owner)
+}
+
+// addPeer records that connID's messages went to instance. Caller must hold
+// gs.routeMu.
+func (gs *GameServer) addPeer(connID, instance string) {
+	if gs.peers[connID] == nil {
+		gs.peers[connID] = make(map[string]bool)
+	}
+	gs.peers[connID][instance] = true
+}
+
+// gameRoute returns the instance owning the game of a local session, or ""
+// when the game is here or there is none.
+func (gs *GameServer) gameRoute(s *session) string {
+	if s.remote != "" {
+		return ""
+	}
+
+	gs.mu.RLock()
+	_, local := gs.playerGames[s.username]
+	gs.mu.RUnlock()
+	if local {
+		return ""
+	}
+
+	gs.routeMu.Lock()
+	defer gs.routeMu.Unlock()
+	return gs.routes[s.client.id]
+}
+
+// gameOwner looks up which other instance owns gameID, or the game username
+// is playing when gameID is empty. It returns "" for games owned here and
+// for remote sessions, which are never relayed further.
+func (gs *GameServer) gameOwner(s *session, gameID, username string) (string, string) {
+	if s.remote != "" || (gameID == "" && username == "") {
+		return "", gameID
+	}
+
+	gs.mu.RLock()
+	if gameID == "" {
+		gameID = gs.playerGames[username]
+	}
+	_, local := gs.games[gameID]
+	gs.mu.RUnlock()
+	if local {
+		return "", gameID
+	}
+
+	var owner string
+	var err error
+	if gameID != "" {
+		owner, err = gs.cluster.GameOwner(gameID)
+	} else {
+		gameID, owner, err = gs.cluster.PlayerGame(username)
+	}
+	if err != nil {
+		log.Printf("Error looking up game owner: %v", err)
+		return "", gameID
+	}
+	if owner == gs.cluster.InstanceID() {
+		return "", gameID
+	}
+	return owner, gameID
+}
+
+// forward relays a message from a local session to owner. It returns false,
+// leaving the message to be handled here, when owner is empty.
+func (gs *GameServer) forward(s *session, owner string, msg InboundMessage) bool {
+	if owner == "" {
+		return false
+	}
+
+	data, err := json.Marshal(msg)
+	if err == nil {
+		gs.routeMu.Lock()
+		gs.addPeer(s.client.id, owner)
+		gs.routeMu.Unlock()
+		err = gs.sendCluster(owner, ClusterMessage{Kind: clusterInbound, ConnID: s.client.id, Username: s.identity, Data: data})
+	}
+	if err != nil {
+		reject(s.client, msg.RequestID, ErrCodeUnavailable, "The server running this game cannot be reached")
+	}
+	return true
+}
+
+func (gs *GameServer) sendCluster(instance string, msg ClusterMessage) error {
+	msg.From = gs.cluster.InstanceID()
+	err := gs.cluster.Send(instance, msg)
+	if err != nil {
+		log.Printf("Error sending %s to %s: %v", msg.Kind, instance, err)
+	}
+	return err
+}
+
+// notifyMatched tells the instance holding a remote player's connection that
+// they left the queue for gameID, which is owned here.
+func (gs *GameServer) notifyMatched(p *Player, gameID string) {
+	if p.Client == nil || p.Client.remote == "" {
+		return
+	}
+	gs.sendCluster(p.Client.remote, ClusterMessage{
+		Kind:     clusterMatched,
+		ConnID:   p.Client.id,
+		Username: p.Username,
+		GameID:   gameID,
+	})
+}
+
+// handleClusterMessage acts on a message from another instance.
+func (gs *GameServer) handleClusterMessage(msg ClusterMessage) {
+	switch msg.Kind {
+	case clusterDeliver, clusterKick, clusterMatched:
+		s := gs.localSession(msg.ConnID)
+		if s == nil {
+			// The connection has gone since; make sure the sender knows
+			if msg.Kind != clusterKick {
+				gs.sendCluster(msg.From, ClusterMessage{Kind: clusterClosed, ConnID: msg.ConnID, Username: msg.Username})
+			}
+			return
+		}
+		switch msg.Kind {
+		case clusterDeliver:
+			s.client.sendRaw(msg.Data, "relayed")
+		case clusterKick:
+			s.client.kickRaw(msg.Data, "relayed")
+		case clusterMatched:
+			gs.setRoute(msg.ConnID, msg.From)
+			gs.mu.Lock()
+			gs.removeWaiting(msg.Username, s.client)
+			gs.mu.Unlock()
+		}
+	case clusterInbound:
+		var in InboundMessage
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			log.Printf("Bad relayed message from %s: %v", msg.From, err)
+			return
+		}
+		gs.dispatch(gs.remoteSession(msg.From, msg.ConnID, msg.Username), in)
+	case clusterTouch:
+		gs.routeMu.Lock()
+		s := gs.remoteSessions[msg.ConnID]
+		gs.routeMu.Unlock()
+		if s != nil && s.username != "" {
+			gs.touchPlayer(s.username, s.client)
+		}
+	case clusterClosed:
+		gs.routeMu.Lock()
+		s := gs.remoteSessions[msg.ConnID]
+		gs.routeMu.Unlock()
+		if s != nil {
+			gs.endSession(s)
+		}
+	case clusterNotice:
+		var notice NoticePayload
+		if err := json.Unmarshal(msg.Data, &notice); err != nil {
+			log.Printf("Bad notice from %s: %v", msg.From, err)
+			return
+		}
+		gs.broadcast(notice)
+	case clusterKickUser:
+		var reason string
+		if err := json.Unmarshal(msg.Data, &reason); err != nil {
+			log.Printf("Bad kick from %s: %v", msg.From, err)
+			return
+		}
+		gs.kickUser(msg.Username, reason)
+	case clusterClearQueue:
+		gs.clearQueue()
+	default:
+		log.Printf("Unknown cluster message %q from %s", msg.Kind, msg.From)
+	}
+}
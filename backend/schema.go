@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	schemaOnce sync.Once
+	schemaJSON []byte
+)
+
+// handleProtocolSchema serves the JSON Schema of the WebSocket protocol,
+// generated from the payload types so it cannot drift from the code.
+func handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	schemaOnce.Do(func() {
+		schemaJSON, _ = json.MarshalIndent(protocolSchema(), "", "  ")
+	})
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schemaJSON)
+}
+
+func protocolSchema() map[string]interface{} {
+	defs := make(map[string]interface{})
+
+	envelopes := func(types map[string]interface{}, inbound bool) []interface{} {
+		names := make([]string, 0, len(types))
+		for name := range types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var variants []interface{}
+		for _, name := range names {
+			properties := map[string]interface{}{
+				"type": map[string]interface{}{"const": name},
+				"data": typeSchema(reflect.TypeOf(types[name]), defs),
+			}
+			if inbound {
+				properties["requestId"] = map[string]interface{}{"type": "string"}
+			}
+			variants = append(variants, map[string]interface{}{
+				"type":       "object",
+				"required":   []string{"type", "data"},
+				"properties": properties,
+			})
+		}
+		return variants
+	}
+
+	defs["ClientMessage"] = map[string]interface{}{"oneOf": envelopes(clientMessageTypes, true)}
+	defs["ServerMessage"] = map[string]interface{}{"oneOf": envelopes(serverMessageTypes, false)}
+
+	return map[string]interface{}{
+		"$schema":         "https://json-schema.org/draft/2020-12/schema",
+		"title":           "Four in a Row WebSocket protocol",
+		"protocolVersion": ProtocolVersion,
+		"minVersion":      MinProtocolVersion,
+		"oneOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/ClientMessage"},
+			map[string]interface{}{"$ref": "#/$defs/ServerMessage"},
+		},
+		"$defs": defs,
+	}
+}
+
+// typeSchema describes t, adding named structs to defs and referring to them.
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), defs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":     "array",
+			"items":    typeSchema(t.Elem(), defs),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // placeholder in case the type refers to itself
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema follows encoding/json: fields are named by their json tag and
+// those without omitempty are required.
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = typeSchema(field.Type, defs)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const seasonCheckInterval = time.Minute
+
+// currentSeason returns the season covering now, or nil between seasons.
+func currentSeason(seasons []Season, now time.Time) *Season {
+	for i := range seasons {
+		if !now.Before(seasons[i].StartsAt) && now.Before(seasons[i].EndsAt) {
+			return &seasons[i]
+		}
+	}
+	return nil
+}
+
+func (gs *GameServer) seasonLoop() {
+	gs.checkSeasons(time.Now())
+
+	ticker := time.NewTicker(seasonCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		gs.checkSeasons(now)
+	}
+}
+
+// checkSeasons archives seasons that have ended and starts the one that has
+// begun, in that order, so that archived standings carry the final ratings
+// rather than the reset ones. With SeasonLength set it first schedules the
+// next season whenever none is running or planned. Every instance runs this;
+// the store makes sure each step happens once.
+func (gs *GameServer) checkSeasons(now time.Time) {
+	seasons, err := gs.store.ListSeasons()
+	if err != nil {
+		log.Printf("Error loading seasons: %v", err)
+		return
+	}
+
+	if gs.config.SeasonLength > 0 {
+		var last *Season
+		if len(seasons) > 0 {
+			last = &seasons[len(seasons)-1]
+		}
+		if last == nil || !now.Before(last.EndsAt) {
+			// Continue right after the last season unless the ladder has
+			// been idle for longer than a whole season
+			start := now.UTC().Truncate(24 * time.Hour)
+			if last != nil && now.Sub(last.EndsAt) < gs.config.SeasonLength {
+				start = last.EndsAt
+			}
+			name := "Season " + strconv.Itoa(len(seasons)+1)
+			season, err := gs.store.CreateSeason(name, start, start.Add(gs.config.SeasonLength))
+			switch {
+			case err == nil:
+				log.Printf("Scheduled %s from %s to %s", season.Name, season.StartsAt.Format(time.RFC3339), season.EndsAt.Format(time.RFC3339))
+				seasons = append(seasons, *season)
+			case !errors.Is(err, ErrSeasonOverlap):
+				log.Printf("Error scheduling the next season: %v", err)
+			}
+		}
+	}
+
+	for _, season := range seasons {
+		if season.ArchivedAt == nil && !now.Before(season.EndsAt) {
+			archived, err := gs.store.ArchiveSeason(season.ID, now)
+			if err != nil {
+				log.Printf("Error archiving season %d: %v", season.ID, err)
+				return
+			}
+			if archived {
+				log.Printf("Archived final standings of %s", season.Name)
+			}
+			continue
+		}
+		if season.StartedAt == nil && !now.Before(season.StartsAt) && now.Before(season.EndsAt) {
+			started, err := gs.store.StartSeason(season.ID, gs.config.SeasonCarryover, now)
+			if err != nil {
+				log.Printf("Error starting season %d: %v", season.ID, err)
+				return
+			}
+			if started {
+				log.Printf("Started %s, ratings soft-reset keeping %.0f%%", season.Name, gs.config.SeasonCarryover*100)
+			}
+		}
+	}
+}
+
+// handleSeasons serves everything under /api/seasons:
+//
+//	GET                       every season, oldest first
+//	GET {id}/leaderboard      final standings of an archived season, or the
+//	                          live standings of a running one
+//	                          ?limit=10&page=1 (or offset=0)&sort= (live only)
+//
+// {id} may be "current" for the season running now.
+func handleSeasons(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/seasons"), "/")
+	if path == "" {
+		seasons, err := gameServer.store.ListSeasons()
+		if err != nil {
+			log.Printf("Error loading seasons: %v", err)
+			http.Error(w, "Could not load seasons", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, seasons)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "leaderboard" {
+		http.NotFound(w, r)
+		return
+	}
+
+	season, err := findSeason(parts[0])
+	if err != nil {
+		log.Printf("Error loading season %s: %v", parts[0], err)
+		http.Error(w, "Could not load season", http.StatusInternalServerError)
+		return
+	}
+	if season == nil {
+		http.Error(w, "Season not found", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	limit, ok := queryInt(w, params.Get("limit"), "limit", defaultLeaderboardSize, 1, maxHistoryPageSize)
+	if !ok {
+		return
+	}
+	page, ok := queryInt(w, params.Get("page"), "page", 1, 1, -1)
+	if !ok {
+		return
+	}
+	offset, ok := queryInt(w, params.Get("offset"), "offset", (page-1)*limit, 0, -1)
+	if !ok {
+		return
+	}
+
+	var standings []LeaderboardEntry
+	var total int
+	if season.ArchivedAt != nil {
+		standings, total, err = gameServer.store.GetSeasonStandings(season.ID, limit, offset)
+	} else {
+		sort := params.Get("sort")
+		if sort == "" {
+			sort = SortWins
+		}
+		if _, ok := leaderboardOrder[sort]; !ok {
+			http.Error(w, "sort must be wins, winrate, rating or streak", http.StatusBadRequest)
+			return
+		}
+		standings, total, err = gameServer.store.GetLeaderboard(LeaderboardQuery{
+			Sort:     sort,
+			MinGames: defaultLeaderboardMinGames,
+			From:     season.StartsAt,
+			To:       season.EndsAt,
+			Limit:    limit,
+			Offset:   offset,
+		})
+	}
+	if err != nil {
+		log.Printf("Error loading standings of season %d: %v", season.ID, err)
+		http.Error(w, "Could not load standings", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"season":    season,
+		"final":     season.ArchivedAt != nil,
+		"standings": standings,
+		"total":     total,
+	})
+}
+
+// findSeason looks a season up by ID, or "current" for the running one.
+func findSeason(id string) (*Season, error) {
+	if id == "current" {
+		seasons, err := gameServer.store.ListSeasons()
+		if err != nil {
+			return nil, err
+		}
+		return currentSeason(seasons, time.Now()), nil
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, nil
+	}
+	return gameServer.store.GetSeason(n)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -11,75 +14,275 @@ import (
 
 type GameServer struct {
 	games          map[string]*Game
-	waitingPlayers []*Player
+	waitingPlayers map[MatchOptions][]*Player // one queue per board size/variant/time control
+	queueStats     map[MatchOptions]*queueStats
 	playerGames    map[string]string // username -> gameID
 	mu             sync.RWMutex
-	database       *Database
+	store          Store
+	persist        *Persister // writes to store made while playing
 	kafka          *KafkaProducer
+	cluster        Cluster
+	config         Config
+	chatFilter     ChatFilter
+	chatLimiters   map[string]*tokenBucket // username -> chat rate limit
+	mutedUsers     map[string]time.Time    // username -> muted until
+	draining       bool                    // shutting down, no new games
+	connLimiter    *connLimiter
+	
+	// Connections, by client ID. routeMu is taken after mu, never before.
+	routeMu        sync.Mutex
+	sessions       map[string]*session         // local connections
+	remoteSessions map[string]*session         // connections on other instances playing or watching here
+	routes         map[string]string           // local connection -> instance owning its game
+	peers          map[string]map[string]bool  // local connection -> instances it was relayed to
 }
 
-func NewGameServer(db *Database, kafka *KafkaProducer) *GameServer {
+func NewGameServer(store Store, kafka *KafkaProducer, cluster Cluster, cfg Config) *GameServer {
 	gs := &GameServer{
-		games:       make(map[string]*Game),
-		playerGames: make(map[string]string),
-		database:    db,
-		kafka:       kafka,
+		games:          make(map[string]*Game),
+		waitingPlayers: make(map[MatchOptions][]*Player),
+		queueStats:     make(map[MatchOptions]*queueStats),
+		playerGames:    make(map[string]string),
+		store:          store,
+		persist:        NewPersister(store, cfg.PersistWorkers, cfg.PersistQueueSize, cfg.PersistSpillPath),
+		kafka:          kafka,
+		cluster:        cluster,
+		config:         cfg,
+		chatFilter:     NewWordListFilter(cfg.ChatBlockedWords),
+		chatLimiters:   make(map[string]*tokenBucket),
+		mutedUsers:     make(map[string]time.Time),
+		connLimiter:    newConnLimiter(cfg.MaxConnsPerIP, cfg.ConnRatePerIP, time.Minute),
+		sessions:       make(map[string]*session),
+		remoteSessions: make(map[string]*session),
+		routes:         make(map[string]string),
+		peers:          make(map[string]map[string]bool),
 	}
 	
+	// Pick up games interrupted by the last shutdown before serving anyone
+	gs.recoverGames()
+	gs.cluster.Listen(gs.handleClusterMessage)
+	
 	// Start background tasks
 	go gs.matchmakingLoop()
 	go gs.cleanupLoop()
+	go gs.seasonLoop()
+	go gs.erasureLoop()
 	
 	return gs
 }
 
-func (gs *GameServer) HandleConnection(conn *websocket.Conn) {
-	defer conn.Close()
+// HandleConnection serves one authenticated WebSocket. identity is the
+// username from the session token; clients cannot act as anyone else.
+func (gs *GameServer) HandleConnection(conn *websocket.Conn, identity string) {
+	client := NewClient(conn, gs.config)
+	s := &session{client: client, identity: identity}
+	gs.addSession(s)
+	
+	// Oversized messages fail the read below and close the connection
+	if gs.config.MaxMessageBytes > 0 {
+		conn.SetReadLimit(gs.config.MaxMessageBytes)
+	}
+	var limiter *tokenBucket
+	if gs.config.MessageRateLimit > 0 {
+		limiter = newTokenBucket(gs.config.MessageRateLimit, gs.config.MessageRateWindow)
+	}
+	strikes := 0 // messages refused in a row
 	
-	var username string
+	// The writer pings every PingInterval; a client that neither answers nor
+	// sends anything within PongTimeout is treated as gone
+	conn.SetReadDeadline(time.Now().Add(gs.config.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(gs.config.PongTimeout))
+		if s.username != "" {
+			gs.touchPlayer(s.username, client)
+		}
+		gs.touchPeers(s)
+		return nil
+	})
 	
 	for {
-		var msg Message
-		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("Error reading message: %v", err)
-			if username != "" {
-				gs.handleDisconnect(username)
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				oversizedMessages.Add(1)
 			}
+			log.Printf("Error reading message: %v", err)
+			gs.endSession(s)
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(gs.config.PongTimeout))
+		
+		var msg InboundMessage
+		parseErr := json.Unmarshal(data, &msg)
+		
+		// A client that keeps sending after being told to slow down is cut off
+		if limiter != nil && !limiter.Allow(time.Now()) {
+			rateLimitedMessages.Add(1)
+			strikes++
+			if strikes == gs.config.MessageRateLimit {
+				rateLimitDisconnects.Add(1)
+				log.Printf("Disconnecting %s for flooding", identity)
+				client.Kick(Message{
+					Type: "error",
+					Data: ErrorPayload{Code: ErrCodeRateLimited, Message: "Too many messages"},
+				})
+			}
+			if strikes >= gs.config.MessageRateLimit {
+				continue // already on the way out
+			}
+			reject(client, msg.RequestID, ErrCodeRateLimited, "You are sending messages too fast")
+			continue
+		}
+		strikes = 0
 		
-		switch msg.Type {
-		case "join":
-			username = msg.Username
-			gs.handleJoin(conn, username)
-		case "move":
-			gs.handleMoveRequest(username, msg.Column)
-		case "reconnect":
-			username = msg.Username
-			gs.handleReconnect(conn, username)
+		if parseErr != nil {
+			sendError(client, ErrCodeBadRequest, "Message is not valid JSON")
+			continue
 		}
+		gs.dispatch(s, msg)
 	}
 }
 
-func (gs *GameServer) handleJoin(conn *websocket.Conn, username string) {
+// dispatch handles one client message. Messages about a game owned by another
+// instance are relayed there, and arrive back at dispatch on that instance
+// with a remote session.
+func (gs *GameServer) dispatch(s *session, msg InboundMessage) {
+	client := s.client
+	
+	switch msg.Type {
+	case "hello":
+		var p HelloPayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		version := negotiateVersion(p.Versions)
+		if version == 0 {
+			client.Kick(Message{
+				Type: "error",
+				Data: ErrorPayload{
+					Code:    ErrCodeUnsupportedVersion,
+					Message: fmt.Sprintf("Server supports protocol versions %d-%d", MinProtocolVersion, ProtocolVersion),
+				},
+			})
+			return
+		}
+		client.Send(Message{Type: "welcome", Data: WelcomePayload{Version: version, Username: s.identity}})
+	case "join":
+		var p JoinPayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		s.username = s.identity
+		opts, err := NewMatchOptions(p.BoardSize, p.Variant, p.TimeControl)
+		if err != nil {
+			reject(client, msg.RequestID, ErrCodeInvalidOptions, err.Error())
+			return
+		}
+		policy, err := NewBotPolicy(p.BotPolicy, p.BotAfter, gs.config.DefaultBotPolicy, gs.config.MaxBotWait)
+		if err != nil {
+			reject(client, msg.RequestID, ErrCodeInvalidOptions, err.Error())
+			return
+		}
+		// A game in progress on another instance is resumed there
+		if owner, gameID := gs.gameOwner(s, "", s.username); owner != "" && gameID != "" {
+			if p.ResumeToken == "" {
+				rejectWith(client, msg.RequestID, ErrorPayload{
+					Code:    ErrCodeGameInProgress,
+					Message: "You already have a game in progress. Reconnect with its resume token.",
+					GameID:  gameID,
+				})
+				return
+			}
+			data, _ := json.Marshal(ReconnectPayload{GameID: gameID, ResumeToken: p.ResumeToken})
+			gs.setRoute(client.id, owner)
+			gs.forward(s, owner, InboundMessage{Type: "reconnect", RequestID: msg.RequestID, Data: data})
+			return
+		}
+		gs.handleJoin(client, msg.RequestID, s.username, opts, policy, gs.lookupRating(s.username), p.ResumeToken)
+	case "move":
+		var p MovePayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if p.Column == nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, "column is required")
+			return
+		}
+		if gs.forward(s, gs.gameRoute(s), msg) {
+			return
+		}
+		gs.handleMoveRequest(client, s.username, msg.RequestID, *p.Column)
+	case "reconnect":
+		var p ReconnectPayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		s.username = s.identity
+		if owner, _ := gs.gameOwner(s, p.GameID, s.username); owner != "" {
+			gs.setRoute(client.id, owner)
+			gs.forward(s, owner, msg)
+			return
+		}
+		gs.handleReconnect(client, msg.RequestID, s.username, p.GameID, p.ResumeToken)
+	case "chat":
+		var p ChatPayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if gs.forward(s, gs.gameRoute(s), msg) {
+			return
+		}
+		gs.handleChat(client, msg.RequestID, s.username, p.Text)
+	case "mute", "unmute":
+		var p MutePayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if gs.forward(s, gs.gameRoute(s), msg) {
+			return
+		}
+		gs.handleMute(client, msg.RequestID, s.username, p.Target, msg.Type == "mute")
+	case "spectate":
+		var p SpectatePayload
+		if err := decodePayload(msg.Data, &p); err != nil {
+			reject(client, msg.RequestID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if s.spectating != "" {
+			gs.removeSpectator(client, s.spectating)
+			s.spectating = ""
+		}
+		if owner, _ := gs.gameOwner(s, p.GameID, ""); owner != "" {
+			gs.forward(s, owner, msg)
+			return
+		}
+		if gs.handleSpectate(client, msg.RequestID, s.identity, p.GameID) {
+			s.spectating = p.GameID
+		}
+	default:
+		reject(client, msg.RequestID, ErrCodeUnknownType, fmt.Sprintf("Unknown message type %q", msg.Type))
+	}
+}
+
+func (gs *GameServer) handleJoin(client *Client, requestID, username string, opts MatchOptions, policy BotPolicy, rating int, resumeToken string) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
 	
 	// Validate username
 	if username == "" || len(username) > 50 {
-		conn.WriteJSON(Message{
-			Type: "error",
-			Data: map[string]interface{}{"message": "Invalid username. Must be 1-50 characters."},
-		})
+		reject(client, requestID, ErrCodeInvalidUsername, "Invalid username. Must be 1-50 characters.")
 		return
 	}
 	
 	// Sanitize username (basic validation)
 	if !isValidUsername(username) {
-		conn.WriteJSON(Message{
-			Type: "error",
-			Data: map[string]interface{}{"message": "Invalid username. Only alphanumeric and basic characters allowed."},
-		})
+		reject(client, requestID, ErrCodeInvalidUsername, "Invalid username. Only alphanumeric and basic characters allowed.")
 		return
 	}
 	
@@ -87,40 +290,83 @@ func (gs *GameServer) handleJoin(conn *websocket.Conn, username string) {
 	if gameID, exists := gs.playerGames[username]; exists {
 		game := gs.games[gameID]
 		if game != nil && game.Status == "playing" {
-			// Reconnect to existing game
-			gs.reconnectPlayer(game, username, conn)
+			// Only the holder of the seat's resume token may take it over
+			player := game.PlayerByName(username)
+			if !player.checkResumeToken(resumeToken) {
+				rejectWith(client, requestID, ErrorPayload{
+					Code:    ErrCodeGameInProgress,
+					Message: "You already have a game in progress. Reconnect with its resume token.",
+					GameID:  game.ID,
+				})
+				return
+			}
+			gs.reconnectPlayer(game, username, client)
+			ack(client, requestID)
 			return
 		}
 		// Clean up stale entry
 		delete(gs.playerGames, username)
 	}
 	
+	if gs.draining {
+		reject(client, requestID, ErrCodeServerDraining, "Server is restarting, please join again in a moment")
+		return
+	}
+	
+	// Games already running come first while the store catches up
+	if gs.persist.Backlogged() {
+		reject(client, requestID, ErrCodeUnavailable, "Server is busy, please join again in a moment")
+		return
+	}
+	
 	// Check if already waiting
-	for _, wp := range gs.waitingPlayers {
-		if wp.Username == username {
-			log.Printf("Player %s already waiting", username)
-			return
-		}
+	if gs.isWaiting(username) {
+		log.Printf("Player %s already waiting", username)
+		ack(client, requestID)
+		return
 	}
 	
+	now := time.Now()
 	player := &Player{
-		Username:  username,
-		Conn:      conn,
-		Connected: true,
-		LastSeen:  time.Now(),
+		Username:   username,
+		Client:     client,
+		Connected:  true,
+		LastSeen:   now,
+		QueuedAt:   now,
+		Options:    opts,
+		BotPolicy:  policy,
+		Rating:     rating,
+		MutedUsers: make(map[string]bool),
 	}
 	
-	gs.waitingPlayers = append(gs.waitingPlayers, player)
+	gs.waitingPlayers[opts] = append(gs.waitingPlayers[opts], player)
+	
+	// Players on every instance are matched from the shared queue
+	if err := gs.cluster.Enqueue(QueueEntry{
+		Username:   username,
+		InstanceID: gs.cluster.InstanceID(),
+		ConnID:     client.id,
+		Options:    opts,
+		Rating:     rating,
+		BotPolicy:  policy,
+		JoinedAt:   player.QueuedAt,
+	}); err != nil {
+		log.Printf("Error queueing %s: %v", username, err)
+	}
 	
 	// Send waiting message
-	if err := conn.WriteJSON(Message{
+	if err := client.Send(Message{
 		Type: "waiting",
-		Data: map[string]interface{}{
-			"message": "Waiting for opponent...",
+		Data: WaitingPayload{
+			Message:      "Waiting for opponent...",
+			Queue:        opts,
+			BotPolicy:    policy.Mode,
+			BotAfterSecs: int(policy.After / time.Second),
 		},
 	}); err != nil {
 		log.Printf("Error sending waiting message: %v", err)
 	}
+	ack(client, requestID)
 }
 
 func (gs *GameServer) matchmakingLoop() {
@@ -128,50 +374,192 @@ func (gs *GameServer) matchmakingLoop() {
 	defer ticker.Stop()
 	
 	for range ticker.C {
-		gs.mu.Lock()
+		// Every instance matches the queues its own players wait in
+		gs.mu.RLock()
+		queues := make([]MatchOptions, 0, len(gs.waitingPlayers))
+		for opts := range gs.waitingPlayers {
+			queues = append(queues, opts)
+		}
+		gs.mu.RUnlock()
 		
-		if len(gs.waitingPlayers) >= 2 {
-			// Match two players
-			p1 := gs.waitingPlayers[0]
-			p2 := gs.waitingPlayers[1]
-			gs.waitingPlayers = gs.waitingPlayers[2:]
-			
+		for _, opts := range queues {
+			gs.matchQueue(opts)
+		}
+	}
+}
+
+// matchQueue pairs the players waiting for opts across the cluster. Only
+// pairings with at least one player connected here are made here, and each
+// is claimed from the shared queue first so no player ends up in two games.
+func (gs *GameServer) matchQueue(opts MatchOptions) {
+	entries, err := gs.cluster.Waiting(opts)
+	if err != nil {
+		log.Printf("Error reading queue %s: %v", opts, err)
+		return
+	}
+	
+	self := gs.cluster.InstanceID()
+	local := func(e QueueEntry) bool { return e.InstanceID == self }
+	
+	type pairing struct {
+		a, b *QueueEntry // b is nil for a bot game
+	}
+	var pairings []pairing
+	
+	// Players who asked for a bot straight away never pair with humans
+	var humans []QueueEntry
+	for i := range entries {
+		e := &entries[i]
+		if e.BotPolicy.Mode != BotNow {
+			humans = append(humans, *e)
+		} else if local(*e) {
+			pairings = append(pairings, pairing{a: e})
+		}
+	}
+	
+	for len(humans) >= 2 {
+		a, b := humans[0], humans[1]
+		humans = humans[2:]
+		if local(a) || local(b) {
+			pairings = append(pairings, pairing{a: &a, b: &b})
+		}
+	}
+	
+	// Hand a lone player to a bot once their policy allows it
+	if len(humans) == 1 && local(humans[0]) && humans[0].BotPolicy.wantsBot(time.Since(humans[0].JoinedAt)) {
+		pairings = append(pairings, pairing{a: &humans[0]})
+	}
+	
+	type match struct {
+		p1, p2  *Player
+		withBot bool
+	}
+	var matches []match
+	
+	for _, pr := range pairings {
+		claimed := []QueueEntry{*pr.a}
+		if pr.b != nil {
+			claimed = append(claimed, *pr.b)
+		}
+		usernames := make([]string, len(claimed))
+		for i, e := range claimed {
+			usernames[i] = e.Username
+		}
+		
+		ok, err := gs.cluster.Claim(usernames...)
+		if err != nil {
+			log.Printf("Error claiming %v: %v", usernames, err)
+			continue
+		}
+		if !ok {
+			continue // matched elsewhere or gone; the next round sees the new queue
+		}
+		
+		gs.mu.Lock()
+		var gone bool
+		for _, e := range claimed {
+			if local(e) && gs.queuedPlayer(e) == nil {
+				gone = true
+			}
+		}
+		if gone {
+			// A local player left between reading the queue and claiming it;
+			// the others go back in
 			gs.mu.Unlock()
-			gs.createGame(p1, p2, false)
-			gs.mu.Lock()
-		} else if len(gs.waitingPlayers) == 1 {
-			// Check if player has been waiting for 10 seconds
-			player := gs.waitingPlayers[0]
-			if time.Since(player.LastSeen) > 10*time.Second {
-				gs.waitingPlayers = gs.waitingPlayers[1:]
-				gs.mu.Unlock()
-				
-				// Create bot player
-				botPlayer := &Player{
-					Username:  "BOT",
-					IsBot:     true,
-					Connected: true,
+			for _, e := range claimed {
+				if !local(e) || gs.isQueued(e) {
+					gs.cluster.Enqueue(e)
 				}
-				gs.createGame(player, botPlayer, true)
-				gs.mu.Lock()
+			}
+			continue
+		}
+		
+		players := make([]*Player, len(claimed))
+		for i, e := range claimed {
+			if local(e) {
+				players[i] = gs.queuedPlayer(e)
+				gs.removeWaiting(e.Username, players[i].Client)
+				continue
+			}
+			rs := gs.remoteSession(e.InstanceID, e.ConnID, e.Username)
+			rs.username = e.Username
+			players[i] = &Player{
+				Username:   e.Username,
+				Client:     rs.client,
+				Connected:  true,
+				LastSeen:   e.JoinedAt,
+				QueuedAt:   e.JoinedAt,
+				Options:    e.Options,
+				BotPolicy:  e.BotPolicy,
+				Rating:     e.Rating,
+				MutedUsers: make(map[string]bool),
 			}
 		}
 		
+		m := match{p1: players[0]}
+		if len(players) == 2 {
+			m.p2 = players[1]
+			gs.recordMatch(opts, false, m.p1, m.p2)
+		} else {
+			// Create bot player at a level close to the player's rating
+			m.withBot = true
+			m.p2 = &Player{
+				Username:      "BOT",
+				IsBot:         true,
+				Connected:     true,
+				Options:       opts,
+				BotDifficulty: botDifficultyFor(m.p1.Rating),
+			}
+			gs.recordMatch(opts, true, m.p1)
+		}
 		gs.mu.Unlock()
+		
+		matches = append(matches, m)
+	}
+	
+	for _, m := range matches {
+		gs.createGame(m.p1, m.p2, m.withBot)
 	}
 }
 
+// queuedPlayer returns the local player of e if they are still waiting.
+// Caller must hold gs.mu.
+func (gs *GameServer) queuedPlayer(e QueueEntry) *Player {
+	for _, p := range gs.waitingPlayers[e.Options] {
+		if p.Username == e.Username && p.Client.id == e.ConnID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (gs *GameServer) isQueued(e QueueEntry) bool {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	
+	return gs.queuedPlayer(e) != nil
+}
+
 func (gs *GameServer) createGame(p1, p2 *Player, withBot bool) {
 	gameID := uuid.New().String()
 	game := NewGame(gameID)
 	
 	p1.PlayerNum = Player1
 	p2.PlayerNum = Player2
+	p1.ResumeToken = newResumeToken()
+	if !withBot {
+		p2.ResumeToken = newResumeToken()
+	}
 	
 	game.Player1 = p1
 	game.Player2 = p2
 	game.Status = "playing"
 	game.StartTime = time.Now()
+	game.Options = p1.Options
+	
+	if err := gs.cluster.RegisterGame(gameID, p1.Username, p2.Username); err != nil {
+		log.Printf("Error registering game %s: %v", gameID, err)
+	}
 	
 	gs.mu.Lock()
 	gs.games[gameID] = game
@@ -179,33 +567,52 @@ func (gs *GameServer) createGame(p1, p2 *Player, withBot bool) {
 	if !withBot {
 		gs.playerGames[p2.Username] = gameID
 	}
+	gs.saveLiveGame(game)
+	// Listed in the players' history from the start, with its moves filled
+	// in as they are played
+	if err := gs.persist.SaveGame(game); err != nil {
+		log.Printf("Error saving game %s: %v", gameID, err)
+	}
+	
+	// From here on, players connected elsewhere are kept alive by relayed
+	// pongs rather than by this instance's own reader
+	for _, p := range []*Player{p1, p2} {
+		p.LastSeen = game.StartTime
+	}
 	gs.mu.Unlock()
 	
+	// The instance holding a remote player's connection learns where their
+	// game is before game_start reaches it
+	gs.notifyMatched(p1, gameID)
+	gs.notifyMatched(p2, gameID)
+	
 	// Send game start messages
 	gameState := gs.getGameState(game)
 	
-	if p1.Conn != nil {
-		p1.Conn.WriteJSON(Message{
+	if p1.Client != nil {
+		p1.Client.Send(Message{
 			Type: "game_start",
-			Data: map[string]interface{}{
-				"gameId":      gameID,
-				"playerNum":   Player1,
-				"opponent":    p2.Username,
-				"opponentIsBot": withBot,
-				"gameState":   gameState,
+			Data: GameStartPayload{
+				GameID:        gameID,
+				PlayerNum:     Player1,
+				ResumeToken:   p1.ResumeToken,
+				Opponent:      p2.Username,
+				OpponentIsBot: withBot,
+				BotDifficulty: p2.BotDifficulty.Name,
+				GameState:     gameState,
 			},
 		})
 	}
 	
-	if !withBot && p2.Conn != nil {
-		p2.Conn.WriteJSON(Message{
+	if !withBot && p2.Client != nil {
+		p2.Client.Send(Message{
 			Type: "game_start",
-			Data: map[string]interface{}{
-				"gameId":      gameID,
-				"playerNum":   Player2,
-				"opponent":    p1.Username,
-				"opponentIsBot": false,
-				"gameState":   gameState,
+			Data: GameStartPayload{
+				GameID:      gameID,
+				PlayerNum:   Player2,
+				ResumeToken: p2.ResumeToken,
+				Opponent:    p1.Username,
+				GameState:   gameState,
 			},
 		})
 	}
@@ -225,23 +632,23 @@ func (gs *GameServer) createGame(p1, p2 *Player, withBot bool) {
 	// If playing with bot, bot makes first move if it's bot's turn
 	if withBot && game.CurrentTurn == Player2 {
 		go func() {
-			bot := NewBot(Player2)
+			bot := NewBot(Player2, p2.BotDifficulty)
 			bot.MakeMoveWithDelay(game, gs)
 		}()
 	}
 }
 
-func (gs *GameServer) handleMoveRequest(username string, col int) {
+// handleMoveRequest plays a move for username and answers the request.
+// Resubmitting the request ID of the player's last accepted move, as clients
+// do when unsure whether it arrived before a reconnect, is acknowledged again
+// without playing anything.
+func (gs *GameServer) handleMoveRequest(client *Client, username, requestID string, col int) {
 	gs.mu.RLock()
-	gameID, exists := gs.playerGames[username]
-	if !exists {
-		gs.mu.RUnlock()
-		return
-	}
-	game := gs.games[gameID]
+	game := gs.games[gs.playerGames[username]]
 	gs.mu.RUnlock()
 	
 	if game == nil {
+		reject(client, requestID, ErrCodeNotInGame, "You are not in a game")
 		return
 	}
 	
@@ -252,35 +659,58 @@ func (gs *GameServer) handleMoveRequest(username string, col int) {
 		playerNum = Player2
 	}
 	
-	gs.handleMove(game, col, playerNum)
+	// Players wait for the store to catch up; bot moves and results, which
+	// cannot be refused, still get through
+	if gs.persist.Backlogged() {
+		reject(client, requestID, ErrCodeUnavailable, "Server is busy saving games, please retry the move")
+		return
+	}
+	
+	moveNum, err := gs.handleMove(game, col, playerNum, requestID)
+	switch {
+	case errors.Is(err, errDuplicateMove):
+		client.Send(Message{Type: "ack", Data: AckPayload{RequestID: requestID, MoveNum: moveNum, Duplicate: true}})
+	case err != nil:
+		reject(client, requestID, moveErrorCode(err), err.Error())
+	case requestID != "":
+		client.Send(Message{Type: "ack", Data: AckPayload{RequestID: requestID, MoveNum: moveNum}})
+	}
 }
 
-func (gs *GameServer) handleMove(game *Game, col int, playerNum int) {
+// errDuplicateMove is returned by handleMove for a request it already played.
+var errDuplicateMove = errors.New("duplicate move request")
+
+// handleMove plays col for playerNum and returns the resulting move number.
+// requestID may be empty; bots never set one.
+func (gs *GameServer) handleMove(game *Game, col int, playerNum int, requestID string) (int, error) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
 	
 	// Validate game state
 	if game == nil {
-		log.Printf("Error: Game is nil")
-		return
+		return 0, fmt.Errorf("game is nil")
 	}
 	
-	if game.Status != "playing" {
-		log.Printf("Error: Game not in playing state, status: %s", game.Status)
-		return
+	player := game.Player1
+	if playerNum == Player2 {
+		player = game.Player2
+	}
+	if requestID != "" && requestID == player.LastMoveID {
+		return player.LastMoveNum, errDuplicateMove
 	}
 	
-	// Validate column range
-	if col < 0 || col >= Cols {
-		log.Printf("Error: Invalid column %d, must be 0-%d", col, Cols-1)
-		return
+	if game.Status != "playing" {
+		return 0, fmt.Errorf("%w (status: %s)", ErrGameOver, game.Status)
 	}
 	
 	err := game.MakeMove(col, playerNum)
 	if err != nil {
 		log.Printf("Invalid move: %v", err)
-		return
+		return 0, err
 	}
+	player.LastMoveID = requestID
+	player.LastMoveNum = game.MoveCount
+	gs.saveMove(game, col, playerNum)
 	
 	// Send Kafka event
 	if gs.kafka != nil {
@@ -299,96 +729,71 @@ func (gs *GameServer) handleMove(game *Game, col int, playerNum int) {
 		})
 	}
 	
+	gs.broadcastGameState(game)
+	
+	// Handle game end
+	if game.Status == "finished" {
+		gs.handleGameEnd(game)
+	} else {
+		gs.saveLiveGame(game)
+		
+		// Bot's turn
+		if game.Player2.IsBot && game.CurrentTurn == Player2 {
+			go func() {
+				bot := NewBot(Player2, game.Player2.BotDifficulty)
+				bot.MakeMoveWithDelay(game, gs)
+			}()
+		}
+	}
+	
+	return game.MoveCount, nil
+}
+
+// broadcastGameState sends the current board to both players, adding the
+// winner's name once the game is over.
+func (gs *GameServer) broadcastGameState(game *Game) {
 	// Broadcast game state with winner info
 	gameState := gs.getGameState(game)
 	
 	// Add winner username if game is finished
 	if game.Status == "finished" {
 		if game.Winner == Player1 {
-			gameState["winnerName"] = game.Player1.Username
+			gameState.WinnerName = game.Player1.Username
 		} else if game.Winner == Player2 {
-			gameState["winnerName"] = game.Player2.Username
-		} else {
-			gameState["winnerName"] = ""
+			gameState.WinnerName = game.Player2.Username
 		}
 	}
 	
 	msg := Message{
 		Type: "game_update",
-		Data: map[string]interface{}{
-			"gameState": gameState,
-		},
+		Data: GameUpdatePayload{GameState: gameState},
 	}
 	
-	// Safe WebSocket writes with error handling
-	if game.Player1.Conn != nil && game.Player1.Connected {
-		if err := game.Player1.Conn.WriteJSON(msg); err != nil {
+	// Queue for each player; a client that had to be dropped is marked
+	// disconnected by its reader once the connection closes
+	if game.Player1.Client != nil && game.Player1.Connected {
+		if err := game.Player1.Client.Send(msg); err != nil {
 			log.Printf("Error writing to Player1: %v", err)
-			game.Player1.Connected = false
 		}
 	}
-	if game.Player2.Conn != nil && game.Player2.Connected && !game.Player2.IsBot {
-		if err := game.Player2.Conn.WriteJSON(msg); err != nil {
+	if game.Player2.Client != nil && game.Player2.Connected && !game.Player2.IsBot {
+		if err := game.Player2.Client.Send(msg); err != nil {
 			log.Printf("Error writing to Player2: %v", err)
-			game.Player2.Connected = false
 		}
 	}
-	
-	// Handle game end
-	if game.Status == "finished" {
-		gs.handleGameEnd(game)
-	} else if game.Player2.IsBot && game.CurrentTurn == Player2 {
-		// Bot's turn - ensure game is still valid
-		if game.Status == "playing" {
-			go func() {
-				bot := NewBot(Player2)
-				bot.MakeMoveWithDelay(game, gs)
-			}()
-		}
+	for spectator := range game.Spectators {
+		spectator.Send(msg)
 	}
 }
 
 func (gs *GameServer) handleGameEnd(game *Game) {
-	// Save to database
-	if gs.database != nil {
-		gs.database.SaveGame(game)
-		
-		// Update player stats
-		if game.Winner == 0 {
-			// Draw - log for debugging
-			log.Printf("Game ended in draw: %s vs %s", game.Player1.Username, game.Player2.Username)
-			if !game.Player1.IsBot {
-				err := gs.database.UpdatePlayerStats(game.Player1.Username, false, true)
-				if err != nil {
-					log.Printf("Error updating Player1 draw stats: %v", err)
-				} else {
-					log.Printf("Updated draw stats for Player1: %s", game.Player1.Username)
-				}
-			}
-			if !game.Player2.IsBot {
-				err := gs.database.UpdatePlayerStats(game.Player2.Username, false, true)
-				if err != nil {
-					log.Printf("Error updating Player2 draw stats: %v", err)
-				} else {
-					log.Printf("Updated draw stats for Player2: %s", game.Player2.Username)
-				}
-			}
-		} else {
-			// Someone won
-			winner := game.Player1
-			loser := game.Player2
-			if game.Winner == Player2 {
-				winner = game.Player2
-				loser = game.Player1
-			}
-			
-			if !winner.IsBot {
-				gs.database.UpdatePlayerStats(winner.Username, true, false)
-			}
-			if !loser.IsBot {
-				gs.database.UpdatePlayerStats(loser.Username, false, false)
-			}
-		}
+	if game.Winner == 0 {
+		log.Printf("Game ended in draw: %s vs %s", game.Player1.Username, game.Player2.Username)
+	}
+	
+	// Save the game, its moves and both players' stats and ratings together
+	if err := gs.persist.RecordGameResult(game, gameMoves(game), playerResults(game)); err != nil {
+		log.Printf("Error recording result of game %s: %v", game.ID, err)
 	}
 	
 	// Send Kafka event
@@ -409,6 +814,10 @@ func (gs *GameServer) handleGameEnd(game *Game) {
 		})
 	}
 	
+	if err := gs.cluster.UnregisterGame(game.ID); err != nil {
+		log.Printf("Error unregistering game %s: %v", game.ID, err)
+	}
+	
 	// Clean up
 	delete(gs.playerGames, game.Player1.Username)
 	if !game.Player2.IsBot {
@@ -416,10 +825,26 @@ func (gs *GameServer) handleGameEnd(game *Game) {
 	}
 }
 
-func (gs *GameServer) handleDisconnect(username string) {
+// lookupRating returns the player's stored rating, or the default for new
+// players and when the store fails.
+func (gs *GameServer) lookupRating(username string) int {
+	rating, err := gs.store.GetRating(username)
+	if err != nil {
+		log.Printf("Error loading rating for %s: %v", username, err)
+		return DefaultRating
+	}
+	return rating
+}
+
+func (gs *GameServer) handleDisconnect(username string, client *Client) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
 	
+	// Nobody is left to play a match found for this connection
+	if gs.removeWaiting(username, client) {
+		gs.cluster.Dequeue(username, client.id)
+	}
+	
 	gameID, exists := gs.playerGames[username]
 	if !exists {
 		return
@@ -430,36 +855,87 @@ func (gs *GameServer) handleDisconnect(username string) {
 		return
 	}
 	
-	// Mark player as disconnected
-	if game.Player1.Username == username {
-		game.Player1.Connected = false
-		game.Player1.LastSeen = time.Now()
-	} else if game.Player2.Username == username {
-		game.Player2.Connected = false
-		game.Player2.LastSeen = time.Now()
+	// Ignore connections the player has already replaced
+	player := game.PlayerByName(username)
+	if player == nil || player.Client != client {
+		return
 	}
+	
+	gs.markDisconnected(game, player, time.Now())
+}
+
+// markDisconnected starts the forfeit timeout of player and tells their
+// opponent. Caller must hold gs.mu.
+func (gs *GameServer) markDisconnected(game *Game, player *Player, now time.Time) {
+	player.Connected = false
+	player.LastSeen = now
+	
+	gs.sendToOpponent(game, player, Message{
+		Type: "opponent_disconnected",
+		Data: OpponentDisconnectedPayload{
+			Opponent:  player.Username,
+			ForfeitIn: int(gs.config.ForfeitTimeout / time.Second),
+			ForfeitAt: now.Add(gs.config.ForfeitTimeout).Unix(),
+		},
+	})
 }
 
-func (gs *GameServer) handleReconnect(conn *websocket.Conn, username string) {
+// touchPlayer records that username's current connection is still alive.
+func (gs *GameServer) touchPlayer(username string, client *Client) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
 	
-	gameID, exists := gs.playerGames[username]
-	if !exists {
-		conn.WriteJSON(Message{Type: "error", Data: map[string]interface{}{"message": "No active game found"}})
+	game := gs.games[gs.playerGames[username]]
+	if game == nil {
 		return
 	}
 	
-	game := gs.games[gameID]
+	if player := game.PlayerByName(username); player != nil && player.Client == client {
+		player.LastSeen = time.Now()
+	}
+}
+
+// sendToOpponent queues msg for the human opponent of player, if connected.
+// Caller must hold gs.mu.
+func (gs *GameServer) sendToOpponent(game *Game, player *Player, msg Message) {
+	opponent := game.Opponent(player)
+	if opponent == nil || opponent.IsBot || !opponent.Connected || opponent.Client == nil {
+		return
+	}
+	if err := opponent.Client.Send(msg); err != nil {
+		log.Printf("Error notifying %s: %v", opponent.Username, err)
+	}
+}
+
+// handleReconnect resumes username's seat in gameID. The resume token handed
+// out in game_start is required, so knowing a username is not enough.
+func (gs *GameServer) handleReconnect(client *Client, requestID, username, gameID, resumeToken string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	
+	activeGameID, exists := gs.playerGames[username]
+	if !exists || (gameID != "" && gameID != activeGameID) {
+		reject(client, requestID, ErrCodeNotInGame, "No active game found")
+		return
+	}
+	
+	game := gs.games[activeGameID]
 	if game == nil {
-		conn.WriteJSON(Message{Type: "error", Data: map[string]interface{}{"message": "Game not found"}})
+		reject(client, requestID, ErrCodeGameNotFound, "Game not found")
+		return
+	}
+	
+	player := game.PlayerByName(username)
+	if player == nil || !player.checkResumeToken(resumeToken) {
+		reject(client, requestID, ErrCodeInvalidResumeToken, "Invalid resume token")
 		return
 	}
 	
-	gs.reconnectPlayer(game, username, conn)
+	gs.reconnectPlayer(game, username, client)
+	ack(client, requestID)
 }
 
-func (gs *GameServer) reconnectPlayer(game *Game, username string, conn *websocket.Conn) {
+func (gs *GameServer) reconnectPlayer(game *Game, username string, client *Client) {
 	var player *Player
 	if game.Player1.Username == username {
 		player = game.Player1
@@ -471,18 +947,39 @@ func (gs *GameServer) reconnectPlayer(game *Game, username string, conn *websock
 		return
 	}
 	
-	player.Conn = conn
+	// Resuming from another device: tell the old connection why it is being
+	// closed, then let it go
+	if player.Client != nil && player.Client != client {
+		player.Client.Kick(Message{
+			Type: "session_replaced",
+			Data: SessionReplacedPayload{
+				GameID:  game.ID,
+				Message: "This game was resumed from another connection.",
+			},
+		})
+	}
+	
+	wasDisconnected := !player.Connected
+	player.Client = client
 	player.Connected = true
 	player.LastSeen = time.Now()
 	
+	if wasDisconnected {
+		gs.sendToOpponent(game, player, Message{
+			Type: "opponent_reconnected",
+			Data: OpponentReconnectedPayload{Opponent: username},
+		})
+	}
+	
 	// Send current game state
 	gameState := gs.getGameState(game)
-	conn.WriteJSON(Message{
+	client.Send(Message{
 		Type: "reconnected",
-		Data: map[string]interface{}{
-			"gameId":    game.ID,
-			"playerNum": player.PlayerNum,
-			"gameState": gameState,
+		Data: ReconnectedPayload{
+			GameID:    game.ID,
+			PlayerNum: player.PlayerNum,
+			Opponent:  game.Opponent(player).Username,
+			GameState: gameState,
 		},
 	})
 }
@@ -494,24 +991,43 @@ func (gs *GameServer) cleanupLoop() {
 	for range ticker.C {
 		gs.mu.Lock()
 		
+		gs.pruneChatLimiters(time.Now())
+		gs.connLimiter.Prune(time.Now())
+		
 		for gameID, game := range gs.games {
 			if game.Status != "playing" {
 				continue
 			}
 			
-			// Check for disconnected players beyond 30 seconds
 			now := time.Now()
 			
-			if !game.Player1.Connected && now.Sub(game.Player1.LastSeen) > 30*time.Second {
+			// Relayed players whose instance stopped reporting them alive
+			for _, p := range []*Player{game.Player1, game.Player2} {
+				if p.Connected && p.Client != nil && p.Client.remote != "" && now.Sub(p.LastSeen) > gs.config.PongTimeout {
+					gs.markDisconnected(game, p, now)
+				}
+			}
+			
+			// Nobody came back, e.g. to a game recovered after a restart
+			if gs.abandoned(game, now) {
+				gs.resolveStaleGame(game, now)
+				continue
+			}
+			
+			// Check for players disconnected beyond the forfeit timeout
+			forfeit := gs.config.ForfeitTimeout
+			if !game.Player1.Connected && now.Sub(game.Player1.LastSeen) > forfeit {
 				game.Status = "finished"
 				game.Winner = Player2
 				game.EndTime = now
+				gs.broadcastGameState(game)
 				gs.handleGameEnd(game)
 				delete(gs.games, gameID)
-			} else if !game.Player2.Connected && now.Sub(game.Player2.LastSeen) > 30*time.Second {
+			} else if !game.Player2.Connected && now.Sub(game.Player2.LastSeen) > forfeit {
 				game.Status = "finished"
 				game.Winner = Player1
 				game.EndTime = now
+				gs.broadcastGameState(game)
 				gs.handleGameEnd(game)
 				delete(gs.games, gameID)
 			}
@@ -521,21 +1037,17 @@ func (gs *GameServer) cleanupLoop() {
 	}
 }
 
-func (gs *GameServer) getGameState(game *Game) map[string]interface{} {
-	return map[string]interface{}{
-		"board":       game.Board,
-		"currentTurn": game.CurrentTurn,
-		"status":      game.Status,
-		"winner":      game.Winner,
-		"moveCount":   game.MoveCount,
+func (gs *GameServer) getGameState(game *Game) GameState {
+	state := GameState{
+		Board:       game.Board,
+		CurrentTurn: game.CurrentTurn,
+		Status:      game.Status,
+		Winner:      game.Winner,
+		MoveCount:   game.MoveCount,
+		Options:     game.Options,
 	}
-}
-
-type Message struct {
-	Type     string                 `json:"type"`
-	Username string                 `json:"username,omitempty"`
-	Column   int                    `json:"column,omitempty"`
-	Data     map[string]interface{} `json:"data,omitempty"`
+	
+	return state
 }
 
 // Validate username contains only safe characters
@@ -0,0 +1,37 @@
+package main
+
+// handleSpectate subscribes client to the updates of a live game. It returns
+// whether the subscription succeeded.
+func (gs *GameServer) handleSpectate(client *Client, requestID, username, gameID string) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	game := gs.games[gameID]
+	if game == nil || game.Status != "playing" {
+		reject(client, requestID, ErrCodeGameNotFound, "Game not found")
+		return false
+	}
+
+	game.Spectators[client] = username
+
+	client.Send(Message{
+		Type: "spectating",
+		Data: SpectatingPayload{
+			GameID:    game.ID,
+			Player1:   game.Player1.Username,
+			Player2:   game.Player2.Username,
+			GameState: gs.getGameState(game),
+		},
+	})
+	ack(client, requestID)
+	return true
+}
+
+func (gs *GameServer) removeSpectator(client *Client, gameID string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if game := gs.games[gameID]; game != nil {
+		delete(game.Spectators, client)
+	}
+}
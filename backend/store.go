@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage backends, chosen with STORE_BACKEND.
+const (
+	StorePostgres = "postgres"
+	StoreSQLite   = "sqlite"
+	StoreMemory   = "memory"
+)
+
+// Store keeps everything the server remembers beyond a single game: game
+// records, players and their ratings, leaderboards and seasons, accounts and
+// bans. Database implements it on Postgres or SQLite and MemoryStore in
+// process memory.
+type Store interface {
+	// Games
+	SaveGame(game *Game) error
+	RecordGameResult(game *Game, moves []MoveRecord, players []PlayerResult) error
+	SaveMove(gameID string, move MoveRecord) error
+	SaveChatMessage(msg ChatMessage) error
+	GetGame(gameID string) (*GameRecord, error)
+	GetPlayerGames(username string, f GameFilter) ([]GameRecord, int, error)
+	GetHeadToHead(a, b string) (HeadToHead, error)
+
+	// Games in progress, for crash recovery
+	SaveLiveGame(gameID, instanceID string, state []byte, updatedAt time.Time) error
+	DeleteLiveGame(gameID string) error
+	LoadLiveGames(instanceID string) ([]LiveGame, error)
+
+	// Players
+	GetPlayerStats(username string) (*PlayerStats, error)
+	GetRating(username string) (int, error)
+	GetRatingHistory(username string, limit int) ([]RatingPoint, error)
+	GetFavoriteOpening(username string) (int, error)
+	GetGameAverages(username string) (GameAverages, error)
+
+	// Leaderboards and seasons
+	GetLeaderboard(q LeaderboardQuery) ([]LeaderboardEntry, int, error)
+	CreateSeason(name string, startsAt, endsAt time.Time) (*Season, error)
+	ListSeasons() ([]Season, error)
+	GetSeason(id int) (*Season, error)
+	StartSeason(id int, carryover float64, now time.Time) (bool, error)
+	ArchiveSeason(id int, now time.Time) (bool, error)
+	GetSeasonStandings(id, limit, offset int) ([]LeaderboardEntry, int, error)
+
+	// Accounts
+	CreateAccount(username, passwordHash string) error
+	GetPasswordHash(username string) (string, error)
+	ClaimGuest(guestID, username, passwordHash string) error
+	GuestClaimed(guestID string) (bool, error)
+	GetAccount(username string) (*Account, error)
+
+	// Personal data
+	ExportPlayerData(username string) (*PlayerData, error)
+	DeletePlayerData(username, anonymousID string, notifyAnalytics bool) (bool, error)
+	GuestRevoked(guestID string) (bool, error) // deleted, or claimed as an account
+	PendingErasures() ([]PlayerDeletion, error)
+	DeletePendingErasure(anonymousID string) error
+
+	// Moderation
+	SaveBan(ban Ban) error
+	DeleteBan(username string) (bool, error)
+	GetBan(username string, now time.Time) (*Ban, error)
+	ListBans(now time.Time) ([]Ban, error)
+
+	Ping() error // reports whether the store can be reached
+	Close() error
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// openStore connects to the store selected by backend. For Postgres and
+// SQLite, migrate brings the schema up to date first.
+func openStore(backend, connStr, sqlitePath string, migrate bool) (Store, error) {
+	if backend == StoreMemory {
+		return NewMemoryStore(), nil
+	}
+	db, err := openDatabaseBackend(backend, connStr, sqlitePath, migrate)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDatabaseBackend connects to the Postgres or SQLite database.
+func openDatabaseBackend(backend, connStr, sqlitePath string, migrate bool) (*Database, error) {
+	switch backend {
+	case StorePostgres:
+		return NewDatabase(connStr, migrate)
+	case StoreSQLite:
+		return NewSQLiteDatabase(sqlitePath, migrate)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q (expected %s, %s or %s)", backend, StorePostgres, StoreSQLite, StoreMemory)
+	}
+}
+
+// storeKind names the backend behind store.
+func storeKind(store Store) string {
+	if db, ok := store.(*Database); ok {
+		return db.dialect
+	}
+	return StoreMemory
+}
@@ -0,0 +1,955 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in process memory. It needs
+// no setup, which suits local development and tests, but forgets it all on
+// restart and cannot be shared between instances.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	games         map[string]*GameRecord // without moves
+	moves         map[string][]MoveRecord
+	chat          []ChatMessage
+	liveGames     map[string]memoryLiveGame
+	players       map[string]*PlayerStats
+	ratingHistory []memoryRatingPoint // oldest first
+	seasons       []Season
+	standings     map[int][]LeaderboardEntry
+	accounts      map[string]memoryAccount
+	bans          map[string]Ban
+	revokedGuests map[string]bool
+	erasures      []PlayerDeletion // not yet sent to analytics
+}
+
+type memoryLiveGame struct {
+	LiveGame
+	instanceID string
+}
+
+type memoryRatingPoint struct {
+	RatingPoint
+	username string
+}
+
+type memoryAccount struct {
+	passwordHash string
+	claimedFrom  string
+	createdAt    time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		games:         make(map[string]*GameRecord),
+		moves:         make(map[string][]MoveRecord),
+		liveGames:     make(map[string]memoryLiveGame),
+		players:       make(map[string]*PlayerStats),
+		standings:     make(map[int][]LeaderboardEntry),
+		accounts:      make(map[string]memoryAccount),
+		bans:          make(map[string]Ban),
+		revokedGuests: make(map[string]bool),
+	}
+}
+
+func (m *MemoryStore) SaveGame(game *Game) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.saveGame(game)
+	return nil
+}
+
+// saveGame stores game unless it has finished already. Caller must hold
+// m.mu.
+func (m *MemoryStore) saveGame(game *Game) {
+	rec, ok := m.games[game.ID]
+	if ok && rec.Status == "finished" {
+		return
+	}
+	if !ok {
+		rec = &GameRecord{ID: game.ID, StartTime: game.StartTime, Options: game.Options}
+		if game.Player1 != nil {
+			rec.Player1 = game.Player1.Username
+		}
+		if game.Player2 != nil {
+			rec.Player2 = game.Player2.Username
+		}
+		m.games[game.ID] = rec
+	}
+
+	rec.Winner = game.Winner
+	rec.Status = game.Status
+	rec.EndTime = nil
+	rec.DurationSecs = 0
+	if !game.EndTime.IsZero() {
+		end := game.EndTime
+		rec.EndTime = &end
+		rec.DurationSecs = int(game.EndTime.Sub(game.StartTime).Seconds())
+	}
+	rec.MoveCount = game.MoveCount
+}
+
+// RecordGameResult applies everything at once under the lock, so readers
+// never see half of it.
+func (m *MemoryStore) RecordGameResult(game *Game, moves []MoveRecord, players []PlayerResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.games[game.ID]; ok && rec.Status == "finished" {
+		return nil
+	}
+	m.saveGame(game)
+	for _, move := range moves {
+		m.saveMove(game.ID, move)
+	}
+	for _, p := range players {
+		m.updatePlayerStats(p.Username, p.Won, p.Drawn, p.Moves)
+		m.updateRating(p.Username, game.ID, p.RatingDelta)
+	}
+	delete(m.liveGames, game.ID)
+	return nil
+}
+
+func (m *MemoryStore) SaveMove(gameID string, move MoveRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.saveMove(gameID, move)
+	return nil
+}
+
+// saveMove stores move unless one with its number is stored already. Caller
+// must hold m.mu.
+func (m *MemoryStore) saveMove(gameID string, move MoveRecord) {
+	for _, saved := range m.moves[gameID] {
+		if saved.MoveNum == move.MoveNum {
+			return
+		}
+	}
+	m.moves[gameID] = append(m.moves[gameID], move)
+}
+
+func (m *MemoryStore) SaveChatMessage(msg ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.chat = append(m.chat, msg)
+	return nil
+}
+
+// record returns a copy of a stored game as the Database would load it.
+func (m *MemoryStore) record(rec *GameRecord) GameRecord {
+	g := *rec
+	if g.Status == "finished" {
+		switch g.Winner {
+		case Player1:
+			g.WinnerName = g.Player1
+		case Player2:
+			g.WinnerName = g.Player2
+		}
+	}
+	return g
+}
+
+func (m *MemoryStore) GetGame(gameID string) (*GameRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.games[gameID]
+	if !ok {
+		return nil, nil
+	}
+	g := m.record(rec)
+	g.Moves = append([]MoveRecord{}, m.moves[gameID]...)
+	sort.Slice(g.Moves, func(i, j int) bool { return g.Moves[i].MoveNum < g.Moves[j].MoveNum })
+	return &g, nil
+}
+
+// playerWon reports whether username won a finished game.
+func playerWon(g *GameRecord, username string) bool {
+	return (g.Player1 == username && g.Winner == Player1) || (g.Player2 == username && g.Winner == Player2)
+}
+
+func (m *MemoryStore) GetPlayerGames(username string, f GameFilter) ([]GameRecord, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matching []*GameRecord
+	for _, g := range m.games {
+		if g.Player1 != username && g.Player2 != username {
+			continue
+		}
+		if f.Opponent != "" && !(g.Player1 == username && g.Player2 == f.Opponent) && !(g.Player2 == username && g.Player1 == f.Opponent) {
+			continue
+		}
+		finished := g.Status == "finished"
+		switch f.Result {
+		case "win":
+			if !finished || !playerWon(g, username) {
+				continue
+			}
+		case "loss":
+			if !finished || g.Winner == 0 || playerWon(g, username) {
+				continue
+			}
+		case "draw":
+			if !finished || g.Winner != 0 {
+				continue
+			}
+		}
+		matching = append(matching, g)
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if !matching[i].StartTime.Equal(matching[j].StartTime) {
+			return matching[i].StartTime.After(matching[j].StartTime)
+		}
+		return matching[i].ID < matching[j].ID
+	})
+
+	games := []GameRecord{}
+	for i := f.Offset; i < len(matching) && i < f.Offset+f.Limit; i++ {
+		games = append(games, m.record(matching[i]))
+	}
+	return games, len(matching), nil
+}
+
+func (m *MemoryStore) GetHeadToHead(a, b string) (HeadToHead, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var h HeadToHead
+	var moves, duration int
+	for _, g := range m.games {
+		if g.Status != "finished" || !(g.Player1 == a && g.Player2 == b) && !(g.Player1 == b && g.Player2 == a) {
+			continue
+		}
+		h.Games++
+		switch {
+		case g.Winner == 0:
+			h.Draws++
+		case playerWon(g, a):
+			h.WinsA++
+		default:
+			h.WinsB++
+		}
+		moves += g.MoveCount
+		duration += g.DurationSecs
+
+		first := &h.FirstB
+		if g.Player1 == a {
+			first = &h.FirstA
+		}
+		first.Games++
+		if g.Winner == Player1 {
+			first.Wins++
+		}
+	}
+
+	if h.Games > 0 {
+		h.AverageGame = GameAverages{Moves: float64(moves) / float64(h.Games), DurationSecs: float64(duration) / float64(h.Games)}
+		h.FirstWinRate = float64(h.FirstA.Wins+h.FirstB.Wins) / float64(h.Games)
+	}
+	return h, nil
+}
+
+func (m *MemoryStore) SaveLiveGame(gameID, instanceID string, state []byte, updatedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.liveGames[gameID] = memoryLiveGame{
+		LiveGame:   LiveGame{GameID: gameID, State: append([]byte(nil), state...), UpdatedAt: updatedAt},
+		instanceID: instanceID,
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteLiveGame(gameID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.liveGames, gameID)
+	return nil
+}
+
+func (m *MemoryStore) LoadLiveGames(instanceID string) ([]LiveGame, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var games []LiveGame
+	for _, g := range m.liveGames {
+		if instanceID == "" || g.instanceID == instanceID || g.instanceID == "" {
+			games = append(games, g.LiveGame)
+		}
+	}
+	return games, nil
+}
+
+// updatePlayerStats counts a finished game towards the player's stats.
+// Caller must hold m.mu.
+func (m *MemoryStore) updatePlayerStats(username string, won bool, drawn bool, moves int) {
+	p, ok := m.players[username]
+	if !ok {
+		p = &PlayerStats{Username: username, Rating: DefaultRating, CreatedAt: time.Now()}
+		m.players[username] = p
+	}
+
+	p.GamesPlayed++
+	p.TotalMoves += moves
+	switch {
+	case drawn:
+		p.GamesDrawn++
+		p.CurrentStreak = 0
+	case won:
+		p.GamesWon++
+		p.CurrentStreak++
+		if p.CurrentStreak > p.BestStreak {
+			p.BestStreak = p.CurrentStreak
+		}
+	default:
+		p.GamesLost++
+		p.CurrentStreak = 0
+	}
+}
+
+func (m *MemoryStore) GetPlayerStats(username string) (*PlayerStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.players[username]
+	if !ok {
+		return nil, ErrPlayerNotFound
+	}
+	stats := *p
+	return &stats, nil
+}
+
+func (m *MemoryStore) GetRating(username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.players[username]; ok {
+		return p.Rating, nil
+	}
+	return DefaultRating, nil
+}
+
+// updateRating applies a rating change from gameID to an existing player and
+// records it in their history. Caller must hold m.mu.
+func (m *MemoryStore) updateRating(username, gameID string, delta int) {
+	p, ok := m.players[username]
+	if !ok {
+		return
+	}
+	p.Rating += delta
+	m.ratingHistory = append(m.ratingHistory, memoryRatingPoint{
+		RatingPoint: RatingPoint{GameID: gameID, Rating: p.Rating, Delta: delta, RecordedAt: time.Now()},
+		username:    username,
+	})
+}
+
+func (m *MemoryStore) GetRatingHistory(username string, limit int) ([]RatingPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := []RatingPoint{}
+	for _, p := range m.ratingHistory {
+		if p.username == username {
+			history = append(history, p.RatingPoint)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].RecordedAt.Before(history[j].RecordedAt) })
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return history, nil
+}
+
+func (m *MemoryStore) GetFavoriteOpening(username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[int]int)
+	for gameID, moves := range m.moves {
+		g, ok := m.games[gameID]
+		if !ok {
+			continue
+		}
+		for _, move := range moves {
+			if move.MoveNum <= 2 && ((g.Player1 == username && move.PlayerNum == Player1) || (g.Player2 == username && move.PlayerNum == Player2)) {
+				counts[move.Column]++
+			}
+		}
+	}
+
+	favorite := -1
+	for col, n := range counts {
+		if favorite < 0 || n > counts[favorite] || (n == counts[favorite] && col < favorite) {
+			favorite = col
+		}
+	}
+	return favorite, nil
+}
+
+func (m *MemoryStore) GetGameAverages(username string) (GameAverages, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var avg GameAverages
+	n := 0
+	for _, g := range m.games {
+		if g.Status == "finished" && (g.Player1 == username || g.Player2 == username) {
+			avg.Moves += float64(g.MoveCount)
+			avg.DurationSecs += float64(g.DurationSecs)
+			n++
+		}
+	}
+	if n > 0 {
+		avg.Moves /= float64(n)
+		avg.DurationSecs /= float64(n)
+	}
+	return avg, nil
+}
+
+// gameStats sums up each player's results over the finished games that ended
+// in [from, to) and, unless variant is empty, were played in that variant.
+// A zero from or to leaves that end open. Caller must hold m.mu.
+func (m *MemoryStore) gameStats(from, to time.Time, variant string) map[string]*LeaderboardEntry {
+	stats := make(map[string]*LeaderboardEntry)
+	count := func(username string, won, lost bool) {
+		s, ok := stats[username]
+		if !ok {
+			s = &LeaderboardEntry{Username: username}
+			stats[username] = s
+		}
+		s.GamesPlayed++
+		switch {
+		case won:
+			s.GamesWon++
+		case lost:
+			s.GamesLost++
+		default:
+			s.GamesDrawn++
+		}
+	}
+
+	for _, g := range m.games {
+		if g.Status != "finished" || g.EndTime == nil {
+			continue
+		}
+		if (!from.IsZero() && g.EndTime.Before(from)) || (!to.IsZero() && !g.EndTime.Before(to)) {
+			continue
+		}
+		if variant != "" {
+			played := g.Options.Variant
+			if played == "" {
+				played = VariantStandard
+			}
+			if played != variant {
+				continue
+			}
+		}
+		count(g.Player1, g.Winner == Player1, g.Winner == Player2)
+		count(g.Player2, g.Winner == Player2, g.Winner == Player1)
+	}
+	return stats
+}
+
+// rank orders stats by sort, the way leaderboardOrder does for the Database,
+// and numbers them from 1. Players without a players row and BOT are left
+// out. Caller must hold m.mu.
+func (m *MemoryStore) rank(stats map[string]*LeaderboardEntry, sortKey string, minGames int) []LeaderboardEntry {
+	var ranked []LeaderboardEntry
+	for username, s := range stats {
+		p, ok := m.players[username]
+		if !ok || username == "BOT" || s.GamesPlayed < minGames {
+			continue
+		}
+		entry := *s
+		entry.Rating, entry.CurrentStreak, entry.BestStreak = p.Rating, p.CurrentStreak, p.BestStreak
+		entry.WinRate = float64(entry.GamesWon) / float64(entry.GamesPlayed)
+		ranked = append(ranked, entry)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		var keys [][2]float64
+		switch sortKey {
+		case SortWins:
+			keys = [][2]float64{{float64(a.GamesWon), float64(b.GamesWon)}, {a.WinRate, b.WinRate}, {float64(a.GamesPlayed), float64(b.GamesPlayed)}}
+		case SortWinRate:
+			keys = [][2]float64{{a.WinRate, b.WinRate}, {float64(a.GamesWon), float64(b.GamesWon)}}
+		case SortRating:
+			keys = [][2]float64{{float64(a.Rating), float64(b.Rating)}, {float64(a.GamesWon), float64(b.GamesWon)}}
+		case SortStreak:
+			keys = [][2]float64{{float64(a.CurrentStreak), float64(b.CurrentStreak)}, {float64(a.BestStreak), float64(b.BestStreak)}, {float64(a.GamesWon), float64(b.GamesWon)}}
+		}
+		for _, k := range keys {
+			if k[0] != k[1] {
+				return k[0] > k[1]
+			}
+		}
+		return a.Username < b.Username
+	})
+
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+	}
+	return ranked
+}
+
+func (m *MemoryStore) GetLeaderboard(q LeaderboardQuery) ([]LeaderboardEntry, int, error) {
+	if _, ok := leaderboardOrder[q.Sort]; !ok {
+		return nil, 0, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from, to := q.From, q.To
+	if from.IsZero() && to.IsZero() {
+		switch q.Window {
+		case WindowMonth:
+			from = time.Now().AddDate(0, 0, -30)
+		case WindowWeek:
+			from = time.Now().AddDate(0, 0, -7)
+		}
+	}
+
+	var stats map[string]*LeaderboardEntry
+	if !from.IsZero() || !to.IsZero() || q.Variant != "" {
+		stats = m.gameStats(from, to, q.Variant)
+	} else {
+		stats = make(map[string]*LeaderboardEntry)
+		for username, p := range m.players {
+			stats[username] = &LeaderboardEntry{Username: username, GamesPlayed: p.GamesPlayed,
+				GamesWon: p.GamesWon, GamesLost: p.GamesLost, GamesDrawn: p.GamesDrawn}
+		}
+	}
+
+	minGames := 1
+	if q.Sort == SortWinRate && q.MinGames > 1 {
+		minGames = q.MinGames
+	}
+	ranked := m.rank(stats, q.Sort, minGames)
+
+	start := q.Offset
+	if q.Around != "" {
+		center := 0
+		for _, entry := range ranked {
+			if entry.Username == q.Around {
+				center = entry.Rank
+			}
+		}
+		if center == 0 {
+			return nil, len(ranked), ErrPlayerNotFound
+		}
+		start = aroundOffset(center, q.Limit, len(ranked))
+	}
+
+	leaderboard := []LeaderboardEntry{}
+	for i := start; i < start+q.Limit && i < len(ranked); i++ {
+		leaderboard = append(leaderboard, ranked[i])
+	}
+	return leaderboard, len(ranked), nil
+}
+
+func (m *MemoryStore) CreateSeason(name string, startsAt, endsAt time.Time) (*Season, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.seasons {
+		if s.StartsAt.Before(endsAt) && s.EndsAt.After(startsAt) || s.StartsAt.Equal(startsAt) {
+			return nil, ErrSeasonOverlap
+		}
+	}
+
+	season := Season{ID: len(m.seasons) + 1, Name: name, StartsAt: startsAt, EndsAt: endsAt}
+	m.seasons = append(m.seasons, season)
+	return &season, nil
+}
+
+func (m *MemoryStore) ListSeasons() ([]Season, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seasons := append([]Season{}, m.seasons...)
+	sort.Slice(seasons, func(i, j int) bool { return seasons[i].StartsAt.Before(seasons[j].StartsAt) })
+	return seasons, nil
+}
+
+// season returns the stored season with id, or nil. Caller must hold m.mu.
+func (m *MemoryStore) season(id int) *Season {
+	if id < 1 || id > len(m.seasons) {
+		return nil
+	}
+	return &m.seasons[id-1]
+}
+
+func (m *MemoryStore) GetSeason(id int) (*Season, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.season(id)
+	if s == nil {
+		return nil, nil
+	}
+	season := *s
+	return &season, nil
+}
+
+func (m *MemoryStore) StartSeason(id int, carryover float64, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.season(id)
+	if s == nil || s.StartedAt != nil {
+		return false, nil
+	}
+	started := now
+	s.StartedAt = &started
+
+	for username, p := range m.players {
+		reset := int(math.Round(DefaultRating + float64(p.Rating-DefaultRating)*carryover))
+		if reset != p.Rating {
+			m.ratingHistory = append(m.ratingHistory, memoryRatingPoint{
+				RatingPoint: RatingPoint{Rating: reset, Delta: reset - p.Rating, RecordedAt: now},
+				username:    username,
+			})
+		}
+		p.Rating = reset
+		p.CurrentStreak = 0
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) ArchiveSeason(id int, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.season(id)
+	if s == nil || s.ArchivedAt != nil || s.EndsAt.After(now) {
+		return false, nil
+	}
+	archived := now
+	s.ArchivedAt = &archived
+
+	standings := m.rank(m.gameStats(s.StartsAt, s.EndsAt, ""), SortWins, 1)
+	for i := range standings {
+		standings[i].CurrentStreak, standings[i].BestStreak = 0, 0
+	}
+	m.standings[id] = standings
+	return true, nil
+}
+
+func (m *MemoryStore) GetSeasonStandings(id, limit, offset int) ([]LeaderboardEntry, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := m.standings[id]
+	standings := []LeaderboardEntry{}
+	for i := offset; i < offset+limit && i < len(all); i++ {
+		standings = append(standings, all[i])
+	}
+	return standings, len(all), nil
+}
+
+func (m *MemoryStore) CreateAccount(username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[username]; ok {
+		return ErrAccountExists
+	}
+	m.accounts[username] = memoryAccount{passwordHash: passwordHash, createdAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryStore) GetPasswordHash(username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[username]
+	if !ok {
+		return "", ErrAccountNotFound
+	}
+	return account.passwordHash, nil
+}
+
+func (m *MemoryStore) ClaimGuest(guestID, username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[username]; ok {
+		return ErrAccountExists
+	}
+	// A name with history of its own belongs to someone else
+	if _, ok := m.players[username]; ok {
+		return ErrAccountExists
+	}
+	m.accounts[username] = memoryAccount{passwordHash: passwordHash, claimedFrom: guestID, createdAt: time.Now()}
+	m.revokedGuests[guestID] = true
+
+	if p, ok := m.players[guestID]; ok {
+		p.Username = username
+		m.players[username] = p
+		delete(m.players, guestID)
+	}
+	for _, g := range m.games {
+		if g.Player1 == guestID {
+			g.Player1 = username
+		}
+		if g.Player2 == guestID {
+			g.Player2 = username
+		}
+	}
+	for i := range m.chat {
+		if m.chat[i].Username == guestID {
+			m.chat[i].Username = username
+		}
+	}
+	for i := range m.ratingHistory {
+		if m.ratingHistory[i].username == guestID {
+			m.ratingHistory[i].username = username
+		}
+	}
+	for _, standings := range m.standings {
+		for i := range standings {
+			if standings[i].Username == guestID {
+				standings[i].Username = username
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GuestClaimed(guestID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, account := range m.accounts {
+		if account.claimedFrom == guestID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) GetAccount(username string) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[username]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return &Account{Username: username, CreatedAt: account.createdAt, ClaimedFrom: account.claimedFrom}, nil
+}
+
+func (m *MemoryStore) ExportPlayerData(username string) (*PlayerData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := &PlayerData{
+		Username:        username,
+		RatingHistory:   []RatingPoint{},
+		SeasonStandings: []SeasonStanding{},
+		Games:           []GameRecord{},
+		Chat:            []ChatMessage{},
+	}
+	if account, ok := m.accounts[username]; ok {
+		data.Account = &Account{Username: username, CreatedAt: account.createdAt, ClaimedFrom: account.claimedFrom}
+	}
+	if p, ok := m.players[username]; ok {
+		stats := *p
+		data.Stats = &stats
+	}
+	if ban, ok := m.bans[username]; ok {
+		data.Ban = &ban
+	}
+
+	for _, p := range m.ratingHistory {
+		if p.username == username {
+			data.RatingHistory = append(data.RatingHistory, p.RatingPoint)
+		}
+	}
+	sort.SliceStable(data.RatingHistory, func(i, j int) bool {
+		return data.RatingHistory[i].RecordedAt.Before(data.RatingHistory[j].RecordedAt)
+	})
+
+	for id, standings := range m.standings {
+		for _, entry := range standings {
+			if entry.Username == username {
+				data.SeasonStandings = append(data.SeasonStandings, SeasonStanding{SeasonID: id, LeaderboardEntry: entry})
+			}
+		}
+	}
+	sort.Slice(data.SeasonStandings, func(i, j int) bool { return data.SeasonStandings[i].SeasonID < data.SeasonStandings[j].SeasonID })
+
+	for id, rec := range m.games {
+		if rec.Player1 != username && rec.Player2 != username {
+			continue
+		}
+		g := m.record(rec)
+		if moves := m.moves[id]; len(moves) > 0 {
+			g.Moves = append([]MoveRecord{}, moves...)
+			sort.Slice(g.Moves, func(i, j int) bool { return g.Moves[i].MoveNum < g.Moves[j].MoveNum })
+		}
+		data.Games = append(data.Games, g)
+	}
+	sort.Slice(data.Games, func(i, j int) bool {
+		if !data.Games[i].StartTime.Equal(data.Games[j].StartTime) {
+			return data.Games[i].StartTime.Before(data.Games[j].StartTime)
+		}
+		return data.Games[i].ID < data.Games[j].ID
+	})
+
+	for _, msg := range m.chat {
+		if msg.Username == username {
+			data.Chat = append(data.Chat, msg)
+		}
+	}
+	return data, nil
+}
+
+func (m *MemoryStore) DeletePlayerData(username, anonymousID string, notifyAnalytics bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, found := m.accounts[username]
+	delete(m.accounts, username)
+	if _, ok := m.bans[username]; ok {
+		found = true
+		delete(m.bans, username)
+	}
+	chat := m.chat[:0]
+	for _, msg := range m.chat {
+		if msg.Username == username {
+			found = true
+			continue
+		}
+		chat = append(chat, msg)
+	}
+	m.chat = chat
+
+	if p, ok := m.players[username]; ok {
+		found = true
+		p.Username = anonymousID
+		m.players[anonymousID] = p
+		delete(m.players, username)
+	}
+	for _, g := range m.games {
+		if g.Player1 == username {
+			found = true
+			g.Player1 = anonymousID
+		}
+		if g.Player2 == username {
+			found = true
+			g.Player2 = anonymousID
+		}
+	}
+	for i := range m.ratingHistory {
+		if m.ratingHistory[i].username == username {
+			m.ratingHistory[i].username = anonymousID
+		}
+	}
+	for _, standings := range m.standings {
+		for i := range standings {
+			if standings[i].Username == username {
+				found = true
+				standings[i].Username = anonymousID
+			}
+		}
+	}
+
+	if strings.HasPrefix(username, guestPrefix) {
+		m.revokedGuests[username] = true
+	}
+	if found && notifyAnalytics {
+		m.erasures = append(m.erasures, PlayerDeletion{Username: username, AnonymousID: anonymousID, DeletedAt: time.Now()})
+	}
+	return found, nil
+}
+
+func (m *MemoryStore) GuestRevoked(guestID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.revokedGuests[guestID], nil
+}
+
+func (m *MemoryStore) PendingErasures() ([]PlayerDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]PlayerDeletion(nil), m.erasures...), nil
+}
+
+func (m *MemoryStore) DeletePendingErasure(anonymousID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.erasures {
+		if e.AnonymousID == anonymousID {
+			m.erasures = append(m.erasures[:i], m.erasures[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveBan(ban Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bans[ban.Username] = ban
+	return nil
+}
+
+func (m *MemoryStore) DeleteBan(username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.bans[username]
+	delete(m.bans, username)
+	return ok, nil
+}
+
+func (m *MemoryStore) GetBan(username string, now time.Time) (*Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ban, ok := m.bans[username]
+	if !ok || !ban.activeAt(now) {
+		return nil, nil
+	}
+	return &ban, nil
+}
+
+func (m *MemoryStore) ListBans(now time.Time) ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bans []Ban
+	for _, ban := range m.bans {
+		if ban.activeAt(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.After(bans[j].CreatedAt) })
+	return bans, nil
+}
+
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// testStores opens every store that runs without a server: SQLite in a
+// temporary file and MemoryStore.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "test.db"), true)
+	if err != nil {
+		t.Fatalf("opening SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Store{
+		StoreSQLite: db,
+		StoreMemory: NewMemoryStore(),
+	}
+}
+
+// finishedGame is a game player1 won against player2 in three moves.
+func finishedGame(id, player1, player2 string) (*Game, []MoveRecord, []PlayerResult) {
+	start := time.Now().Add(-time.Minute)
+	game := &Game{
+		ID:        id,
+		Player1:   &Player{Username: player1, PlayerNum: Player1},
+		Player2:   &Player{Username: player2, PlayerNum: Player2},
+		Status:    "finished",
+		Winner:    Player1,
+		StartTime: start,
+		EndTime:   start.Add(30 * time.Second),
+		MoveCount: 3,
+		Options:   MatchOptions{BoardSize: DefaultBoardSize, Variant: VariantStandard, TimeControl: Untimed},
+	}
+	moves := []MoveRecord{
+		{MoveNum: 1, PlayerNum: Player1, Column: 3, Row: 5, PlayedAt: start},
+		{MoveNum: 2, PlayerNum: Player2, Column: 2, Row: 5, PlayedAt: start.Add(time.Second)},
+		{MoveNum: 3, PlayerNum: Player1, Column: 3, Row: 4, PlayedAt: start.Add(2 * time.Second)},
+	}
+	players := []PlayerResult{
+		{Username: player1, Won: true, Moves: 2, RatingDelta: 16},
+		{Username: player2, Moves: 1, RatingDelta: -16},
+	}
+	return game, moves, players
+}
+
+type wantStats struct {
+	played, won, lost int
+	rating            int
+	history           int // rating history entries
+}
+
+func checkStats(t *testing.T, store Store, username string, want wantStats) {
+	t.Helper()
+	stats, err := store.GetPlayerStats(username)
+	if err != nil {
+		t.Fatalf("GetPlayerStats(%s): %v", username, err)
+	}
+	got := wantStats{played: stats.GamesPlayed, won: stats.GamesWon, lost: stats.GamesLost, rating: stats.Rating}
+	history, err := store.GetRatingHistory(username, 100)
+	if err != nil {
+		t.Fatalf("GetRatingHistory(%s): %v", username, err)
+	}
+	got.history = len(history)
+	if got != want {
+		t.Errorf("%s: got %+v, want %+v", username, got, want)
+	}
+}
+
+func TestRecordGameResultCountsAGameOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordings int
+		concurrent bool
+	}{
+		{"once", 1, false},
+		{"twice", 2, false},
+		{"replayed after a failure", 5, false},
+		{"concurrently", 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for kind, store := range testStores(t) {
+				t.Run(kind, func(t *testing.T) {
+					game, moves, players := finishedGame("g1", "alice", "bob")
+
+					var wg sync.WaitGroup
+					errs := make(chan error, tt.recordings)
+					for i := 0; i < tt.recordings; i++ {
+						record := func() { errs <- store.RecordGameResult(game, moves, players) }
+						if tt.concurrent {
+							wg.Add(1)
+							go func() { defer wg.Done(); record() }()
+						} else {
+							record()
+						}
+					}
+					wg.Wait()
+					close(errs)
+					for err := range errs {
+						if err != nil {
+							t.Fatalf("RecordGameResult: %v", err)
+						}
+					}
+
+					checkStats(t, store, "alice", wantStats{played: 1, won: 1, rating: DefaultRating + 16, history: 1})
+					checkStats(t, store, "bob", wantStats{played: 1, lost: 1, rating: DefaultRating - 16, history: 1})
+
+					rec, err := store.GetGame("g1")
+					if err != nil {
+						t.Fatalf("GetGame: %v", err)
+					}
+					if rec.Status != "finished" || len(rec.Moves) != len(moves) {
+						t.Errorf("stored game has status %q and %d moves, want finished with %d", rec.Status, len(rec.Moves), len(moves))
+					}
+				})
+			}
+		})
+	}
+}
+
+// Games ending together with the players in either seat must all count.
+func TestRecordGameResultConcurrentGamesOfTheSamePlayers(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			const games = 10
+			var wg sync.WaitGroup
+			errs := make(chan error, games)
+			for i := 0; i < games; i++ {
+				p1, p2 := "alice", "bob"
+				if i%2 == 1 {
+					p1, p2 = p2, p1
+				}
+				game, moves, players := finishedGame(fmt.Sprintf("g%d", i), p1, p2)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- store.RecordGameResult(game, moves, players)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("RecordGameResult: %v", err)
+				}
+			}
+
+			checkStats(t, store, "alice", wantStats{played: games, won: games / 2, lost: games / 2, rating: DefaultRating, history: games})
+			checkStats(t, store, "bob", wantStats{played: games, won: games / 2, lost: games / 2, rating: DefaultRating, history: games})
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"wrapped serialization failure", fmt.Errorf("saving game: %w", &pq.Error{Code: "40001"}), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"other error", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimGuestRevokesGuest(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			guest, other := guestPrefix+"claimed", guestPrefix+"other"
+			if err := store.ClaimGuest(guest, "alice", "hash"); err != nil {
+				t.Fatalf("ClaimGuest: %v", err)
+			}
+			for id, want := range map[string]bool{guest: true, other: false} {
+				revoked, err := store.GuestRevoked(id)
+				if err != nil {
+					t.Fatalf("GuestRevoked(%s): %v", id, err)
+				}
+				if revoked != want {
+					t.Errorf("GuestRevoked(%s) = %v, want %v", id, revoked, want)
+				}
+			}
+		})
+	}
+}
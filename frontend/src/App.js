@@ -5,9 +5,24 @@ import Leaderboard from './Leaderboard';
 
 const WS_URL = process.env.REACT_APP_WS_URL || 'ws://localhost:8080/ws';
 const API_URL = process.env.REACT_APP_API_URL || 'http://localhost:8080/api';
+const GUEST_RESUME_KEY = 'guestResumeToken';
+const ACTIVE_GAME_KEY = 'activeGame';
+const PROTOCOL_VERSIONS = [1];
+const RESUME_FAILED_CODES = ['not_in_game', 'game_not_found', 'invalid_resume_token'];
+const RECONNECT_DELAY_MS = 2000;
+
+const loadActiveGame = () => {
+  try {
+    return JSON.parse(localStorage.getItem(ACTIVE_GAME_KEY));
+  } catch {
+    return null;
+  }
+};
 
 function App() {
   const [username, setUsername] = useState('');
+  const [password, setPassword] = useState('');
+  const [token, setToken] = useState(null);
   const [gameState, setGameState] = useState(null);
   const [playerNum, setPlayerNum] = useState(null);
   const [opponent, setOpponent] = useState('');
@@ -15,6 +30,11 @@ function App() {
   const [connected, setConnected] = useState(false);
   const [showLeaderboard, setShowLeaderboard] = useState(false);
   const ws = useRef(null);
+  const joinName = useRef('');
+  const resuming = useRef(false);
+  const pendingMove = useRef(null);
+  const nextRequestId = useRef(1);
+  const replaced = useRef(false);
 
   useEffect(() => {
     return () => {
@@ -24,17 +44,30 @@ function App() {
     };
   }, []);
 
-  const connectWebSocket = () => {
-    ws.current = new WebSocket(WS_URL);
+  // Every client message is an envelope of a type and its payload
+  const send = (type, data, requestId) => {
+    ws.current.send(JSON.stringify({ type, requestId, data }));
+  };
+
+  const connectWebSocket = (sessionToken, name) => {
+    ws.current = new WebSocket(`${WS_URL}?token=${encodeURIComponent(sessionToken)}`);
+
+    joinName.current = name;
 
     ws.current.onopen = () => {
       setConnected(true);
       console.log('WebSocket connected');
-      // Send join message immediately after connection opens
-      if (username.trim()) {
-        ws.current.send(JSON.stringify({ type: 'join', username: username }));
-        console.log('Join message sent:', username);
+      send('hello', { versions: PROTOCOL_VERSIONS, client: 'web' });
+      // Resume an unfinished game if we hold its token, otherwise join
+      const saved = loadActiveGame();
+      if (saved && saved.username === name) {
+        resuming.current = true;
+        send('reconnect', { gameId: saved.gameId, resumeToken: saved.resumeToken });
+        console.log('Reconnect message sent:', saved.gameId);
+        return;
       }
+      send('join', {});
+      console.log('Join message sent:', name);
     };
 
     ws.current.onmessage = (event) => {
@@ -50,6 +83,12 @@ function App() {
     ws.current.onclose = () => {
       setConnected(false);
       console.log('WebSocket disconnected');
+      // Keep trying to get back into an unfinished game, e.g. while the
+      // server restarts; it picks up in-progress games again
+      if (loadActiveGame() && !replaced.current) {
+        setMessage('Connection lost, reconnecting...');
+        setTimeout(() => connectWebSocket(sessionToken, name), RECONNECT_DELAY_MS);
+      }
     };
   };
 
@@ -57,11 +96,31 @@ function App() {
     console.log('Received:', msg);
 
     switch (msg.type) {
-      case 'waiting':
-        setMessage('Waiting for opponent... (Bot will join in 10s if no player found)');
+      case 'welcome':
+        console.log('Protocol version:', msg.data.version);
         break;
 
+      case 'waiting': {
+        const { botPolicy, botAfterSecs } = msg.data || {};
+        if (botPolicy === 'never') {
+          setMessage('Waiting for opponent...');
+        } else if (botPolicy === 'now') {
+          setMessage('Starting a game against the bot...');
+        } else {
+          setMessage(`Waiting for opponent... (Bot will join in ${botAfterSecs || 10}s if no player found)`);
+        }
+        break;
+      }
+
       case 'game_start':
+        localStorage.setItem(
+          ACTIVE_GAME_KEY,
+          JSON.stringify({
+            username: joinName.current,
+            gameId: msg.data.gameId,
+            resumeToken: msg.data.resumeToken,
+          })
+        );
         setPlayerNum(msg.data.playerNum);
         setOpponent(msg.data.opponent);
         setGameState(msg.data.gameState);
@@ -75,6 +134,7 @@ function App() {
       case 'game_update':
         setGameState(msg.data.gameState);
         if (msg.data.gameState.status === 'finished') {
+          localStorage.removeItem(ACTIVE_GAME_KEY);
           const winner = msg.data.gameState.winner;
           const winnerName = msg.data.gameState.winnerName || '';
           if (winner === 0) {
@@ -102,12 +162,80 @@ function App() {
         break;
 
       case 'reconnected':
+        resuming.current = false;
         setPlayerNum(msg.data.playerNum);
+        setOpponent(msg.data.opponent);
         setGameState(msg.data.gameState);
         setMessage('Reconnected to game!');
+        // The server acks a move it already played instead of playing it twice
+        if (pendingMove.current) {
+          send('move', { column: pendingMove.current.column }, pendingMove.current.requestId);
+        }
+        break;
+
+      case 'ack':
+        if (pendingMove.current && pendingMove.current.requestId === msg.data.requestId) {
+          pendingMove.current = null;
+        }
+        break;
+
+      case 'rejected':
+        if (pendingMove.current && pendingMove.current.requestId === msg.data.requestId) {
+          pendingMove.current = null;
+        }
+        setMessage(msg.data.message);
+        break;
+
+      case 'opponent_disconnected':
+        setMessage(
+          `${msg.data.opponent} disconnected. They forfeit in ${msg.data.forfeitIn}s unless they reconnect.`
+        );
+        break;
+
+      case 'opponent_reconnected':
+        setMessage(`${msg.data.opponent} reconnected.`);
+        break;
+
+      case 'shutdown_pending':
+        setMessage(msg.data.message);
+        break;
+
+      case 'server_restarting':
+        // Resumable games are picked up again by the reconnect loop
+        if (!msg.data.resumable) {
+          localStorage.removeItem(ACTIVE_GAME_KEY);
+        }
+        setMessage(msg.data.message);
+        break;
+
+      case 'session_replaced':
+        replaced.current = true;
+        setMessage(msg.data.message);
+        break;
+
+      case 'notice':
+        setMessage(`📢 ${msg.data.message}`);
+        break;
+
+      case 'game_aborted':
+        localStorage.removeItem(ACTIVE_GAME_KEY);
+        setMessage(`Game cancelled by the server${msg.data.reason ? `: ${msg.data.reason}` : ''}`);
+        break;
+
+      case 'kicked':
+        // Do not reconnect after being removed by an operator
+        replaced.current = true;
+        setMessage(msg.data.reason || 'You were disconnected by the server.');
         break;
 
       case 'error':
+        if (resuming.current && RESUME_FAILED_CODES.includes(msg.data.code)) {
+          // The saved game is over or the token is stale: join a new one
+          resuming.current = false;
+          localStorage.removeItem(ACTIVE_GAME_KEY);
+          send('join', {});
+          break;
+        }
         setMessage(msg.data.message || 'An error occurred');
         break;
 
@@ -116,14 +244,70 @@ function App() {
     }
   };
 
-  const handleJoin = () => {
+  const authenticate = async (mode) => {
+    const response = await fetch(`${API_URL}/auth/${mode}`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ username: username.trim(), password }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()).trim() || 'Authentication failed');
+    }
+    const session = await response.json();
+    setToken(session.token);
+    return session.token;
+  };
+
+  const handleJoin = async (mode = 'login') => {
     if (!username.trim()) {
       setMessage('Please enter a username');
       return;
     }
+    if (!token && !password) {
+      setMessage('Please enter a password');
+      return;
+    }
+
+    try {
+      setMessage(mode === 'register' ? 'Creating account...' : 'Logging in...');
+      const sessionToken = token || (await authenticate(mode));
+      setMessage('Connecting...');
+      connectWebSocket(sessionToken, username.trim());
+    } catch (err) {
+      setMessage(err.message);
+    }
+  };
+
+  const requestGuestSession = (resumeToken) =>
+    fetch(`${API_URL}/auth/guest`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(resumeToken ? { resumeToken } : {}),
+    });
+
+  const handleGuest = async () => {
+    try {
+      setMessage('Starting guest session...');
+      const resumeToken = localStorage.getItem(GUEST_RESUME_KEY);
+      let response = await requestGuestSession(resumeToken);
+      if (!response.ok && resumeToken) {
+        // Expired or upgraded guest: start over as a new guest
+        localStorage.removeItem(GUEST_RESUME_KEY);
+        response = await requestGuestSession(null);
+      }
+      if (!response.ok) {
+        throw new Error((await response.text()).trim() || 'Could not start guest session');
+      }
 
-    setMessage('Connecting...');
-    connectWebSocket();
+      const session = await response.json();
+      localStorage.setItem(GUEST_RESUME_KEY, session.resumeToken);
+      setUsername(session.username);
+      setToken(session.token);
+      setMessage('Connecting...');
+      connectWebSocket(session.token, session.username);
+    } catch (err) {
+      setMessage(err.message);
+    }
   };
 
   const handleMove = (col) => {
@@ -137,7 +321,9 @@ function App() {
     }
 
     if (ws.current && ws.current.readyState === WebSocket.OPEN) {
-      ws.current.send(JSON.stringify({ type: 'move', column: col }));
+      const requestId = `move-${Date.now()}-${nextRequestId.current++}`;
+      pendingMove.current = { requestId, column: col };
+      send('move', { column: col }, requestId);
     }
   };
 
@@ -145,12 +331,17 @@ function App() {
     if (ws.current) {
       ws.current.close();
     }
+    localStorage.removeItem(ACTIVE_GAME_KEY);
+    pendingMove.current = null;
+    replaced.current = false;
     setGameState(null);
     setPlayerNum(null);
     setOpponent('');
     setMessage('');
     setConnected(false);
     setUsername('');
+    setPassword('');
+    setToken(null);
   };
 
   if (showLeaderboard) {
@@ -172,11 +363,24 @@ function App() {
               placeholder="Enter your username"
               value={username}
               onChange={(e) => setUsername(e.target.value)}
+              disabled={connected || !!token}
+            />
+            <input
+              type="password"
+              placeholder="Password"
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
               onKeyPress={(e) => e.key === 'Enter' && handleJoin()}
-              disabled={connected}
+              disabled={connected || !!token}
             />
-            <button onClick={handleJoin} disabled={connected || !username.trim()}>
-              {connected ? 'Connecting...' : 'Join Game'}
+            <button onClick={() => handleJoin('login')} disabled={connected || !username.trim()}>
+              {connected ? 'Connecting...' : 'Log In & Play'}
+            </button>
+            <button onClick={() => handleJoin('register')} disabled={connected || !!token || !username.trim()} className="secondary">
+              Register
+            </button>
+            <button onClick={handleGuest} disabled={connected} className="secondary">
+              Play as Guest
             </button>
             <button onClick={() => setShowLeaderboard(true)} className="secondary">
               View Leaderboard
@@ -79,7 +79,7 @@ function Leaderboard({ apiUrl, onBack }) {
                 : '0.0';
               return (
                 <tr key={entry.username}>
-                  <td className="rank">{index + 1}</td>
+                  <td className="rank">{entry.rank || index + 1}</td>
                   <td className="player-name">{entry.username}</td>
                   <td className="wins">{entry.gamesWon}</td>
                   <td className="losses">{entry.gamesLost}</td>
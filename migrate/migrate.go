@@ -0,0 +1,283 @@
+// Package migrate applies the versioned schema migrations embedded in the
+// backend and analytics binaries and records them in a schema_migrations
+// table.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationLockID is taken with pg_advisory_xact_lock while a migration runs,
+// so that instances starting together apply each migration once.
+const migrationLockID = 0x34696e61 // "4ina"
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change, read from NNNN_name.up.sql and
+// the optional NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies migrations in version order and records them in the
+// schema_migrations table.
+type Migrator struct {
+	db           *sql.DB
+	migrations   []Migration
+	advisoryLock bool // serialize instances with a Postgres advisory lock
+}
+
+// New reads the migrations in the top directory of files. advisoryLock is
+// for Postgres only.
+func New(db *sql.DB, files fs.FS, advisoryLock bool) (*Migrator, error) {
+	migrations, err := loadMigrations(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, advisoryLock: advisoryLock}, nil
+}
+
+func loadMigrations(files fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationFileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(files, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	rows, err := m.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration, oldest first.
+func (m *Migrator) Status() ([]Status, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, len(m.migrations))
+	for i, mig := range m.migrations {
+		status[i].Migration = mig
+		if at, ok := applied[mig.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+	return status, nil
+}
+
+// Up applies every pending migration up to and including target, or all of
+// them when target is 0, and returns how many it applied.
+func (m *Migrator) Up(target int) (int, error) {
+	if err := m.ensureTable(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, mig := range m.migrations {
+		if target > 0 && mig.Version > target {
+			break
+		}
+		done, err := m.run(mig, true)
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// how many it reverted.
+func (m *Migrator) Down(steps int) (int, error) {
+	status, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(status) - 1; i >= 0 && count < steps; i-- {
+		if status[i].AppliedAt == nil {
+			continue
+		}
+		mig := status[i].Migration
+		if mig.Down == "" {
+			return count, fmt.Errorf("migration %d_%s cannot be reverted", mig.Version, mig.Name)
+		}
+		done, err := m.run(mig, false)
+		if err != nil {
+			return count, fmt.Errorf("reverting %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// run applies or reverts one migration in a transaction, unless another
+// instance got there first.
+func (m *Migrator) run(mig Migration, up bool) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if m.advisoryLock {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return false, err
+		}
+	}
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)`, mig.Version).Scan(&applied); err != nil {
+		return false, err
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.Exec(mig.Up); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, mig.Version, mig.Name, time.Now())
+	} else {
+		if _, err := tx.Exec(mig.Down); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RunCommand implements the migrate subcommand of both services:
+//
+//	migrate up [version]   apply pending migrations, up to version if given
+//	migrate down [steps]   revert the last applied migration, or the last steps
+//	migrate status         list migrations and when they were applied
+func RunCommand(m *Migrator, args []string) error {
+	if len(args) == 0 {
+		args = []string{"up"}
+	}
+	n := 0
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return fmt.Errorf("%s: expected a positive number, got %q", args[0], args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := m.Up(n)
+		fmt.Printf("Applied %d migration(s)\n", count)
+		return err
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		count, err := m.Down(n)
+		fmt.Printf("Reverted %d migration(s)\n", count)
+		return err
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-30s  %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down or status)", args[0])
+	}
+}
@@ -0,0 +1,264 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func file(body string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(body)}
+}
+
+// testFiles creates a table per migration, so that what has been applied
+// can be seen in the schema.
+var testFiles = fstest.MapFS{
+	"0001_players.up.sql":   file(`CREATE TABLE players (name TEXT)`),
+	"0001_players.down.sql": file(`DROP TABLE players`),
+	"0002_games.up.sql":     file(`CREATE TABLE games (id TEXT)`),
+	"0002_games.down.sql":   file(`DROP TABLE games`),
+	"0010_ratings.up.sql":   file(`CREATE TABLE ratings (name TEXT, rating INTEGER)`),
+	"0010_ratings.down.sql": file(`DROP TABLE ratings`),
+}
+
+func newTestMigrator(t *testing.T, db *sql.DB, files fstest.MapFS) *Migrator {
+	t.Helper()
+	m, err := New(db, files, false)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return m
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+// appliedVersions lists the versions Status reports as applied.
+func appliedVersions(t *testing.T, m *Migrator) []int {
+	t.Helper()
+	status, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	var versions []int
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr string
+	}{
+		{name: "sorted by version", files: testFiles, want: []int{1, 2, 10}},
+		{name: "down is optional", files: fstest.MapFS{"0001_a.up.sql": file("SELECT 1")}, want: []int{1}},
+		{name: "bad file name", files: fstest.MapFS{"init.sql": file("SELECT 1")}, wantErr: "name must look like"},
+		{name: "no up script", files: fstest.MapFS{"0001_a.down.sql": file("SELECT 1")}, wantErr: "has no up script"},
+		{
+			name: "two names for one version",
+			files: fstest.MapFS{
+				"0001_a.up.sql": file("SELECT 1"),
+				"0001_b.up.sql": file("SELECT 1"),
+			},
+			wantErr: "is named both",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMigrations error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadMigrations: %v", err)
+			}
+			var versions []int
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			if !equalInts(versions, tt.want) {
+				t.Fatalf("versions %v, want %v", versions, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	tests := []struct {
+		name        string
+		up          int // target for Up, 0 for all
+		down        int // steps for Down afterwards, 0 to skip
+		wantUp      int
+		wantDown    int
+		wantApplied []int
+		wantTables  map[string]bool
+	}{
+		{
+			name: "all", wantUp: 3, wantApplied: []int{1, 2, 10},
+			wantTables: map[string]bool{"players": true, "games": true, "ratings": true},
+		},
+		{
+			name: "up to a version", up: 2, wantUp: 2, wantApplied: []int{1, 2},
+			wantTables: map[string]bool{"players": true, "games": true, "ratings": false},
+		},
+		{
+			name: "down one", down: 1, wantUp: 3, wantDown: 1, wantApplied: []int{1, 2},
+			wantTables: map[string]bool{"players": true, "games": true, "ratings": false},
+		},
+		{
+			name: "down more than applied", up: 2, down: 5, wantUp: 2, wantDown: 2, wantApplied: nil,
+			wantTables: map[string]bool{"players": false, "games": false, "ratings": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			m := newTestMigrator(t, db, testFiles)
+
+			applied, err := m.Up(tt.up)
+			if err != nil || applied != tt.wantUp {
+				t.Fatalf("Up(%d) = %d, %v, want %d", tt.up, applied, err, tt.wantUp)
+			}
+			if tt.down > 0 {
+				reverted, err := m.Down(tt.down)
+				if err != nil || reverted != tt.wantDown {
+					t.Fatalf("Down(%d) = %d, %v, want %d", tt.down, reverted, err, tt.wantDown)
+				}
+			}
+
+			if got := appliedVersions(t, m); !equalInts(got, tt.wantApplied) {
+				t.Errorf("applied %v, want %v", got, tt.wantApplied)
+			}
+			for table, want := range tt.wantTables {
+				if got := tableExists(t, db, table); got != want {
+					t.Errorf("table %s exists = %v, want %v", table, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpSkipsAppliedMigrations(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := newTestMigrator(t, db, testFiles).Up(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance, or the next start, with the same migrations and
+	// then with a new one added. Re-running 0001 or 0002 would fail, as
+	// their tables exist.
+	for _, want := range []int{1, 0} {
+		applied, err := newTestMigrator(t, db, testFiles).Up(0)
+		if err != nil || applied != want {
+			t.Fatalf("Up = %d, %v, want %d", applied, err, want)
+		}
+	}
+	if got := appliedVersions(t, newTestMigrator(t, db, testFiles)); !equalInts(got, []int{1, 2, 10}) {
+		t.Fatalf("applied %v, want [1 2 10]", got)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	db := openTestDB(t)
+	files := fstest.MapFS{
+		"0001_players.up.sql": file(`CREATE TABLE players (name TEXT)`),
+		"0002_broken.up.sql":  file(`CREATE TABLE half (id TEXT); CREATE TABLE nonsense (`),
+	}
+	m := newTestMigrator(t, db, files)
+
+	applied, err := m.Up(0)
+	if err == nil || !strings.Contains(err.Error(), "2_broken") {
+		t.Fatalf("Up error = %v, want one naming 2_broken", err)
+	}
+	if applied != 1 {
+		t.Fatalf("Up applied %d, want 1", applied)
+	}
+	if got := appliedVersions(t, m); !equalInts(got, []int{1}) {
+		t.Fatalf("applied %v, want [1]", got)
+	}
+	if tableExists(t, db, "half") {
+		t.Fatal("part of the failed migration was kept")
+	}
+}
+
+func TestDownWithoutScript(t *testing.T) {
+	db := openTestDB(t)
+	m := newTestMigrator(t, db, fstest.MapFS{"0001_a.up.sql": file(`CREATE TABLE a (id TEXT)`)})
+	if _, err := m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(1); err == nil || !strings.Contains(err.Error(), "cannot be reverted") {
+		t.Fatalf("Down error = %v, want cannot be reverted", err)
+	}
+	if got := appliedVersions(t, m); !equalInts(got, []int{1}) {
+		t.Fatalf("applied %v, want [1]", got)
+	}
+}
+
+func TestRunCommandArguments(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{args: []string{"sideways"}, wantErr: "unknown migrate command"},
+		{args: []string{"up", "x"}, wantErr: "expected a positive number"},
+		{args: []string{"down", "0"}, wantErr: "expected a positive number"},
+		{args: []string{"status"}},
+		{args: nil}, // up
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			err := RunCommand(newTestMigrator(t, openTestDB(t), testFiles), tt.args)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("RunCommand(%q): %v", tt.args, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RunCommand(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}